@@ -1,11 +1,16 @@
 package cion
 
 import (
+	"crypto/subtle"
 	"encoding/json"
+	"fmt"
 	"github.com/zenazn/goji/web"
+	"io"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
+	"time"
 )
 
 func NewJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
@@ -14,22 +19,119 @@ func NewJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	owner := c.URLParams["owner"]
 	repo := c.URLParams["repo"]
 	branch := c.URLParams["branch"]
+	tag := c.URLParams["tag"]
+	sha := c.URLParams["sha"]
+
+	j := NewJob(owner, repo, branch, tag, sha)
+	j.Trigger = TriggerManual
+	j.TriggeredBy = initiator(config, r)
+
+	params, err := parseParameters(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	j.Parameters = params
+
+	startJob(config, j, w)
+}
+
+func RebuildJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+
+	orig, err := config.JobStore.GetByNumber(owner, repo, number)
+	if err != nil || orig == nil {
+		log.Println("error getting job:", err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// pin the new job to the exact commit of the original, rather than the branch head
+	j := NewJob(owner, repo, orig.Branch, orig.Tag, orig.SHA)
+	j.Trigger = TriggerRebuild
+	j.TriggeredBy = initiator(config, r)
+	j.Parameters = orig.Parameters
+	j.RebuildOf = orig.Number
+
+	startJob(config, j, w)
+}
+
+func ApproveJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	decideJob(c, w, r, true)
+}
+
+func RejectJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	decideJob(c, w, r, false)
+}
+
+// decideJob approves or rejects a job that is waiting for approval, and writes the job to the
+// response. Jobs that agents are running are approved or rejected by their agents.
+func decideJob(c web.C, w http.ResponseWriter, r *http.Request, approved bool) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+
+	t := time.Now()
+	a := Approval{
+		Approved: approved,
+		By:       initiator(config, r),
+		At:       &t,
+	}
+
+	ref := JobRef{Owner: owner, Repo: repo, Number: number}
+	if !config.Tracker.Decide(owner, repo, number, a) && !decideOnAgent(config, ref, a) {
+		http.Error(w, "job is not waiting for approval", http.StatusConflict)
+		return
+	}
+
+	j, err := config.JobStore.GetByNumber(owner, repo, number)
+	if err != nil {
+		log.Println("error getting job:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(j, "", "\t")
+	w.Write(b)
+}
+
+// decideOnAgent sends an approval or rejection to the agent that is running a job, if the job
+// is waiting for approval. It returns false if it isn't.
+func decideOnAgent(config Config, ref JobRef, a Approval) bool {
+	if config.Queue == nil {
+		return false
+	}
+
+	j, err := config.JobStore.GetByNumber(ref.Owner, ref.Repo, ref.Number)
+	if err != nil || j == nil || j.Status != JobAwaitingApproval {
+		return false
+	}
+
+	return config.Queue.send(agentCommand{Job: ref, Approval: &a}) == nil
+}
+
+// startJob saves a new job, runs it in the background or queues it for an agent, and writes
+// the job to the response.
+func startJob(config Config, j *Job, w http.ResponseWriter) {
+	if config.Queue != nil {
+		j.Status = JobQueued
+	}
 
-	j := NewJob(owner, repo, branch, "")
 	if err := config.JobStore.Save(j); err != nil {
 		log.Println("error saving job:", err)
 	}
 
-	jr := &JobRequest{
-		Job:            j,
-		Executor:       config.Executor,
-		Store:          config.JobStore,
-		GitHubClientID: config.GitHubClientID,
-		GitHubSecret:   config.GitHubSecret,
+	if config.Queue != nil {
+		config.Queue.push(j)
+	} else {
+		go config.NewJobRequest(j).Run()
 	}
 
-	go jr.Run()
-
 	w.Header().Set("Content-Type", "application/json")
 	b, _ := json.MarshalIndent(j, "", "\t")
 	w.Write(b)
@@ -52,6 +154,30 @@ func GetJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+// GetArtifactsHandler writes a tar archive of a job's artifacts.
+func GetArtifactsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+
+	j, err := config.JobStore.GetByNumber(owner, repo, number)
+	if err != nil {
+		log.Println("error getting job:", err)
+	}
+
+	if j == nil || !j.Artifacts {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	if err := config.JobStore.GetArtifacts(j, w); err != nil {
+		log.Println("error getting job artifacts:", err)
+	}
+}
+
 func GetLogHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	config := c.Env["config"].(Config)
 
@@ -70,13 +196,61 @@ func GetLogHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// GetServiceLogHandler writes the log of one of a job's services. Only the services that the job
+// ran have logs.
+func GetServiceLogHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+	service := c.URLParams["service"]
+
+	j, err := config.JobStore.GetByNumber(owner, repo, number)
+	if err != nil {
+		log.Println("error getting job:", err)
+	}
+
+	if j == nil || !hasService(j, service) {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	sl := config.JobStore.GetLogger(j).Stream(service)
+	if _, err := sl.WriteTo(w); err != nil {
+		log.Println("error getting service logs:", err)
+	}
+}
+
+// hasService returns true if a job ran a service with a name.
+func hasService(j *Job, name string) bool {
+	for _, s := range j.Services {
+		if s == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 func ListJobsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	config := c.Env["config"].(Config)
 
 	owner := c.URLParams["owner"]
 	repo := c.URLParams["repo"]
 
-	l, err := config.JobStore.List(owner, repo)
+	q := r.URL.Query()
+	f := JobFilter{
+		Branch:      q.Get("branch"),
+		SHA:         q.Get("sha"),
+		Tag:         q.Get("tag"),
+		Trigger:     Trigger(q.Get("trigger")),
+		TriggeredBy: q.Get("triggered_by"),
+		Status:      JobStatus(q.Get("status")),
+	}
+
+	l, err := config.JobStore.List(owner, repo, f)
 	if err != nil {
 		log.Println("error getting job list:", err)
 	}
@@ -86,6 +260,82 @@ func ListJobsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	w.Write(b)
 }
 
+func ListEnvironmentsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+
+	l, err := config.JobStore.ListDeployments(owner, repo, "")
+	if err != nil {
+		log.Println("error getting deployments list:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(currentDeployments(l), "", "\t")
+	w.Write(b)
+}
+
+func ListCachesHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+
+	l, err := config.JobStore.ListCaches(owner, repo)
+	if err != nil {
+		log.Println("error getting caches list:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(l, "", "\t")
+	w.Write(b)
+}
+
+// PurgeCachesHandler removes all of the caches for a repo. Caches that are in use by a running
+// job can't be removed.
+func PurgeCachesHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+
+	l, err := config.JobStore.ListCaches(owner, repo)
+	if err != nil {
+		log.Println("error getting caches list:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	for _, entry := range l {
+		if err := removeCache(config.JobStore, config.Executor, entry); err != nil {
+			log.Println("error removing cache:", err)
+			http.Error(w, fmt.Sprintf("couldn't remove cache %s: %v", entry.Key, err),
+				http.StatusConflict)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func ListDeploymentsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	env := c.URLParams["environment"]
+
+	l, err := config.JobStore.ListDeployments(owner, repo, env)
+	if err != nil {
+		log.Println("error getting deployments list:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(l, "", "\t")
+	w.Write(b)
+}
+
 func ListOwnersHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	config := c.Env["config"].(Config)
 	log.Println("hello")
@@ -113,3 +363,509 @@ func ListReposHandler(c web.C, w http.ResponseWriter, r *http.Request) {
 	b, _ := json.MarshalIndent(l, "", "\t")
 	w.Write(b)
 }
+
+// parseParameters reads job parameters from a JSON object in the request body, if there is one.
+// Parameter values may be strings, numbers, or booleans. Numbers are kept as they were written,
+// rather than being formatted as floats.
+func parseParameters(r *http.Request) (map[string]string, error) {
+	d := json.NewDecoder(r.Body)
+	d.UseNumber()
+
+	var body map[string]interface{}
+	if err := d.Decode(&body); err == io.EOF {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid job parameters: %v", err)
+	}
+
+	params := make(map[string]string, len(body))
+	for k, v := range body {
+		switch v.(type) {
+		case string, json.Number, bool:
+			params[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("invalid value for job parameter %q", k)
+		}
+	}
+
+	return params, nil
+}
+
+// UnverifiedPrefix is prepended to the user that made an API request when the user wasn't
+// authenticated, since anyone can claim to be anyone with the X-Cion-User header.
+const UnverifiedPrefix = "unverified:"
+
+// initiator returns the user that made an API request. It's only trusted if it's from the
+// config's UserHeader, which is set by an authenticating proxy in front of cion. Otherwise, the
+// X-Cion-User header or the remote address of the request is used, with UnverifiedPrefix.
+func initiator(config Config, r *http.Request) string {
+	if config.UserHeader != "" {
+		if u := r.Header.Get(config.UserHeader); u != "" {
+			return u
+		}
+	}
+
+	if u := r.Header.Get("X-Cion-User"); u != "" {
+		return UnverifiedPrefix + u
+	}
+
+	return UnverifiedPrefix + r.RemoteAddr
+}
+
+// AgentAuth is middleware for the agent API, which requires the agent token. If the server
+// doesn't have a token, every request is rejected.
+func AgentAuth(c *web.C, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		config := c.Env["config"].(Config)
+
+		auth := []byte(r.Header.Get("Authorization"))
+		if config.AgentToken == "" ||
+			subtle.ConstantTimeCompare(auth, []byte("Bearer "+config.AgentToken)) != 1 {
+
+			http.Error(w, "invalid agent token", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func ListAgentsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(config.Queue.list(), "", "\t")
+	w.Write(b)
+}
+
+func RegisterAgentHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	var info AgentInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil || info.Name == "" {
+		http.Error(w, "agents need a name", http.StatusBadRequest)
+		return
+	}
+
+	info.ID = config.Queue.register(info.Name)
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(info, "", "\t")
+	w.Write(b)
+}
+
+func AgentHeartbeatHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	if err := config.Queue.seen(c.URLParams["agent"]); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PollJobHandler waits for a queued job for an agent, and writes the job to the response. If
+// there isn't a job before AgentPollTimeout, nothing is written.
+func PollJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	j, err := config.Queue.poll(c.URLParams["agent"], AgentPollTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if j == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(j, "", "\t")
+	w.Write(b)
+}
+
+// AgentCommandsHandler waits for commands for an agent's jobs, like approvals, and writes them
+// to the response. If there aren't any before AgentPollTimeout, nothing is written.
+func AgentCommandsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	cmds, err := config.Queue.receive(c.URLParams["agent"], AgentPollTimeout)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if len(cmds) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.MarshalIndent(cmds, "", "\t")
+	w.Write(b)
+}
+
+// AckJobHandler acknowledges a job that an agent polled, so that it isn't queued again. It
+// fails if the job was already queued again because the agent took too long.
+func AckJobHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+	ref := JobRef{Owner: c.URLParams["owner"], Repo: c.URLParams["repo"], Number: number}
+
+	if err := config.Queue.ack(c.URLParams["agent"], ref); err != nil {
+		agentError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// AgentStoreHandler calls a JobStore method for a job that an agent is running, with the
+// arguments in the request body, and writes the results to the response. Jobs can be read
+// freely, but an agent can only change its job, the records of its job's repo, and the jobs
+// that its job replaces.
+func AgentStoreHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+	s := config.JobStore
+
+	j := agentJob(c, w, r)
+	if j == nil {
+		return
+	}
+
+	var req storeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ownRepo := func(owner, repo string) bool {
+		return owner == j.Owner && repo == j.Repo
+	}
+
+	var resp storeResponse
+	var err error
+	allowed := true
+
+	switch c.URLParams["method"] {
+	case "get":
+		resp.Job, err = s.GetByNumber(req.Owner, req.Repo, req.Number)
+	case "list_owners":
+		resp.Names, err = s.ListOwners()
+	case "list_repos":
+		resp.Names, err = s.ListRepos(req.Owner)
+	case "list":
+		var f JobFilter
+		if req.Filter != nil {
+			f = *req.Filter
+		}
+		resp.Jobs, err = s.List(req.Owner, req.Repo, f)
+	case "save":
+		if req.Job == nil {
+			http.Error(w, "no job to save", http.StatusBadRequest)
+			return
+		}
+
+		resp.Job, allowed, err = saveForAgent(config, c.URLParams["agent"], j, req.Job)
+	case "save_deployment":
+		d := req.Deployment
+		if allowed = d != nil && ownRepo(d.Owner, d.Repo) && d.JobNumber == j.Number; allowed {
+			err = s.SaveDeployment(d)
+		}
+	case "list_deployments":
+		if allowed = ownRepo(req.Owner, req.Repo); allowed {
+			resp.Deployments, err = s.ListDeployments(req.Owner, req.Repo, req.Environment)
+		}
+	case "acquire_lock", "release_lock":
+		// locks are named for the repo of the job that holds them
+		allowed = req.Ref != nil && *req.Ref == refOf(j) &&
+			strings.HasPrefix(req.Name, j.Owner+"/"+j.Repo+"/")
+		if !allowed {
+			break
+		}
+
+		if c.URLParams["method"] == "acquire_lock" {
+			resp.Lock, resp.Acquired, err = s.AcquireLock(req.Name, *req.Ref)
+		} else {
+			err = s.ReleaseLock(req.Name, *req.Ref)
+		}
+	case "save_cache":
+		if allowed = req.Cache != nil && ownRepo(req.Cache.Owner, req.Cache.Repo); allowed {
+			err = s.SaveCache(req.Cache)
+		}
+	case "list_caches":
+		if allowed = ownRepo(req.Owner, req.Repo); allowed {
+			resp.Caches, err = s.ListCaches(req.Owner, req.Repo)
+		}
+	case "delete_cache":
+		if allowed = ownRepo(req.Owner, req.Repo); allowed {
+			err = s.DeleteCache(req.Owner, req.Repo, req.Key)
+		}
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if !allowed {
+		http.Error(w, fmt.Sprintf("job %s/%s #%d can't %s for another job or repo", j.Owner,
+			j.Repo, j.Number, c.URLParams["method"]), http.StatusForbidden)
+		return
+	}
+
+	if err != nil {
+		log.Println("error calling job store for agent:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(resp)
+	w.Write(b)
+}
+
+// saveForAgent saves a job for an agent that is running another job, and returns the job that
+// was saved, or false if the agent isn't allowed to save it. An agent can save the results of
+// its job, but not what the job is for or how it was started. The older jobs that its job
+// replaces can only have their artifacts flag cleared, once their artifacts are deleted, or be
+// superseded by its job, which the agent running them does if they've started.
+func saveForAgent(config Config, agent string, j, save *Job) (*Job, bool, error) {
+	s := config.JobStore
+
+	switch {
+	case refOf(save) == refOf(j):
+		// the agent only resolves the commit of a job for a branch
+		if j.SHA != "" {
+			save.SHA = j.SHA
+		}
+
+		save.Branch, save.Tag, save.LocalPath = j.Branch, j.Tag, j.LocalPath
+		save.Trigger, save.TriggeredBy, save.RebuildOf = j.Trigger, j.TriggeredBy, j.RebuildOf
+		save.Parameters, save.Agent = j.Parameters, j.Agent
+		save.Upstream, save.UpstreamChain = j.Upstream, j.UpstreamChain
+		save.Downstream = j.Downstream
+	default:
+		o, err := s.GetByNumber(save.Owner, save.Repo, save.Number)
+		if err != nil {
+			return nil, true, err
+		} else if o == nil || !replaces(j, o) {
+			return nil, false, nil
+		}
+
+		superseded := save.Status == JobSuperseded && save.SupersededBy == j.Number &&
+			o.EndedAt == nil && o.SHA != j.SHA
+		if superseded && !config.Queue.supersede(refOf(o), j.Number) {
+			t := time.Now()
+			o.EndedAt = &t
+			o.Status = JobSuperseded
+			o.SupersededBy = j.Number
+		}
+
+		o.Artifacts = o.Artifacts && save.Artifacts
+		return o, true, s.Save(o)
+	}
+
+	if err := s.Save(save); err != nil {
+		return nil, true, err
+	}
+
+	config.Queue.track(agent, save)
+	return save, true, nil
+}
+
+// replaces returns true if a job is for the same branch or tag as an older job, so that it
+// replaces the older job's artifacts.
+func replaces(j, o *Job) bool {
+	return o.Owner == j.Owner && o.Repo == j.Repo && o.Branch == j.Branch &&
+		o.Tag == j.Tag && o.Number < j.Number
+}
+
+// AgentTriggerHandler starts the downstream jobs of a job that an agent is running, and writes
+// their refs to the response. The targets are read from the job's .cion.yml on GitHub instead
+// of being taken from the agent, and are checked against the server's policy.
+func AgentTriggerHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	j := agentJob(c, w, r)
+	if j == nil {
+		return
+	}
+
+	if len(j.Downstream) > 0 {
+		http.Error(w, "job has already triggered downstream jobs", http.StatusConflict)
+		return
+	}
+
+	gh := newGitHubClient(config.GitHubToken, config.GitHubClientID, config.GitHubSecret)
+	jc, err := fetchJobConfig(j, gh, config.Policy)
+	if err != nil {
+		log.Println("error reading job config:", err)
+		http.Error(w, fmt.Sprintf("unable to read job config: %v", err),
+			http.StatusInternalServerError)
+		return
+	}
+
+	if j.LocalPath != "" || !jc.triggersBranch(j.Branch) {
+		http.Error(w, "job doesn't trigger downstream jobs", http.StatusForbidden)
+		return
+	}
+
+	jl := config.JobStore.GetLogger(j)
+	jobs, err := downstreamJobs(j, jc.Triggers, jl)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	refs := []JobRef{}
+	for _, dj := range jobs {
+		dj.Status = JobQueued
+		if err := config.JobStore.Save(dj); err != nil {
+			log.Println("error saving job:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		config.Queue.push(dj)
+
+		fmt.Fprintf(jl, "CION: triggered %s/%s job #%d\n", dj.Owner, dj.Repo, dj.Number)
+		refs = append(refs, refOf(dj))
+	}
+
+	j.Downstream = append(j.Downstream, refs...)
+	if err := config.JobStore.Save(j); err != nil {
+		log.Println("error saving job:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	b, _ := json.Marshal(refs)
+	w.Write(b)
+}
+
+// agentError writes an error about an agent or one of its jobs to the response.
+func agentError(w http.ResponseWriter, err error) {
+	switch err {
+	case errUnknownAgent:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errNotAgentJob:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// agentJob gets the job for an agent API request, or writes an error to the response if it
+// can't. Agents can only make requests for the jobs that they're running.
+func agentJob(c web.C, w http.ResponseWriter, r *http.Request) *Job {
+	config := c.Env["config"].(Config)
+
+	owner := c.URLParams["owner"]
+	repo := c.URLParams["repo"]
+	number, _ := strconv.ParseUint(c.URLParams["number"], 0, 64)
+
+	ref := JobRef{Owner: owner, Repo: repo, Number: number}
+	if err := config.Queue.owns(c.URLParams["agent"], ref); err != nil {
+		agentError(w, err)
+		return nil
+	}
+
+	j, err := config.JobStore.GetByNumber(owner, repo, number)
+	if err != nil {
+		log.Println("error getting job:", err)
+	}
+
+	if j == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+	}
+
+	return j
+}
+
+// AgentLogHandler writes the request body to a job's log for an agent, or writes a new build
+// step if the step parameter is set. Log streams are named by the stream parameters.
+func AgentLogHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	j := agentJob(c, w, r)
+	if j == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	jl := config.JobStore.GetLogger(j)
+	for _, s := range q["stream"] {
+		jl = jl.Stream(s)
+	}
+
+	var err error
+	switch {
+	case r.Method == "GET":
+		w.Header().Set("Content-Type", "text/plain")
+		_, err = jl.WriteTo(w)
+	case q.Get("step") != "":
+		err = jl.WriteStep(q.Get("step"))
+	default:
+		_, err = io.Copy(jl, r.Body)
+	}
+
+	if err != nil {
+		log.Println("error writing job logs for agent:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// AgentArtifactsHandler reads, saves, or deletes the artifacts of the job in the owner, repo,
+// and number parameters, for a job that an agent is running. An agent can read the artifacts
+// of any job, like its job's dependencies, but it can only save its job's artifacts and delete
+// the artifacts of its job and the older jobs that its job replaces.
+func AgentArtifactsHandler(c web.C, w http.ResponseWriter, r *http.Request) {
+	config := c.Env["config"].(Config)
+
+	j := agentJob(c, w, r)
+	if j == nil {
+		return
+	}
+
+	q := r.URL.Query()
+	number, _ := strconv.ParseUint(q.Get("number"), 0, 64)
+
+	target, err := config.JobStore.GetByNumber(q.Get("owner"), q.Get("repo"), number)
+	if err != nil {
+		log.Println("error getting job:", err)
+	}
+
+	if target == nil {
+		http.Error(w, "job not found", http.StatusNotFound)
+		return
+	}
+
+	own := refOf(target) == refOf(j)
+	if (r.Method == "PUT" && !own) || (r.Method == "DELETE" && !own && !replaces(j, target)) {
+		http.Error(w, fmt.Sprintf("job %s/%s #%d can't change the artifacts of another job",
+			j.Owner, j.Repo, j.Number), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/x-tar")
+		err = config.JobStore.GetArtifacts(target, w)
+	case "PUT":
+		err = config.JobStore.SaveArtifacts(target, r.Body)
+	case "DELETE":
+		err = config.JobStore.DeleteArtifacts(target)
+	}
+
+	if err != nil {
+		log.Println("error handling artifacts for agent:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
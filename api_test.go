@@ -0,0 +1,47 @@
+package cion
+
+import (
+	"github.com/zenazn/goji/web"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestGetServiceLogHandler(t *testing.T) {
+	s := NewInMemoryJobStore()
+	j := NewJob("owner", "repo", "master", "", "")
+	j.Services = []string{"db"}
+	if err := s.Save(j); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		number  uint64
+		service string
+		code    int
+	}{
+		{number: j.Number, service: "db", code: http.StatusOK},
+		{number: j.Number, service: "cache", code: http.StatusNotFound},
+		{number: j.Number + 1, service: "db", code: http.StatusNotFound},
+	}
+
+	for _, tt := range tests {
+		c := web.C{
+			Env: map[interface{}]interface{}{"config": Config{JobStore: s}},
+			URLParams: map[string]string{
+				"owner":   "owner",
+				"repo":    "repo",
+				"number":  strconv.FormatUint(tt.number, 10),
+				"service": tt.service,
+			},
+		}
+
+		w := httptest.NewRecorder()
+		GetServiceLogHandler(c, w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.code {
+			t.Errorf("job #%d service %s: status = %d, want %d", tt.number, tt.service, w.Code,
+				tt.code)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package cion
+
+import (
+	"fmt"
+	"time"
+)
+
+// DefaultApprovalTimeout is how long a manual stage waits for approval if its config doesn't
+// specify a timeout.
+const DefaultApprovalTimeout = time.Hour
+
+// Approval is a decision on whether a job that is waiting for approval should continue.
+type Approval struct {
+	Approved bool
+
+	// By is the user that approved or rejected the job.
+	By string
+	At *time.Time
+}
+
+// awaitApproval pauses a job before a manual stage until it is approved or rejected through
+// the API, or until the approval timeout passes. An error is returned unless the job was
+// approved.
+func awaitApproval(r JobRequest, stage string, cc ContainerConfig, jl JobLogger) error {
+	j := r.Job
+
+	if r.Tracker == nil {
+		return fmt.Errorf("can't wait for approval of %s stage without a job tracker", stage)
+	}
+
+	timeout := DefaultApprovalTimeout
+	if cc.ApprovalTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(cc.ApprovalTimeout); err != nil {
+			return fmt.Errorf("invalid approval timeout for %s stage: %v", stage, err)
+		}
+	}
+
+	c, err := r.Tracker.awaitApproval(j)
+	if err != nil {
+		return err
+	}
+	defer r.Tracker.stopAwaitingApproval(j)
+
+	deadline := time.Now().Add(timeout)
+	j.Status = JobAwaitingApproval
+	j.ApprovalDeadline = &deadline
+	if err := r.Store.Save(j); err != nil {
+		return err
+	}
+
+	jl.WriteStep(fmt.Sprintf("waiting for approval of %s stage until %s", stage,
+		deadline.Format(time.RFC3339)))
+
+	select {
+	case a := <-c:
+		j.Approval = &a
+	case <-r.Tracker.cancelled(j):
+		return errCancelled
+	case <-time.After(timeout):
+		j.Status = JobFailed
+		return fmt.Errorf("%s stage was not approved before %s", stage,
+			deadline.Format(time.RFC3339))
+	}
+
+	if !j.Approval.Approved {
+		j.Status = JobRejected
+		return fmt.Errorf("%s stage was rejected by %s", stage, j.Approval.By)
+	}
+
+	j.Status = JobRunning
+	if err := r.Store.Save(j); err != nil {
+		return err
+	}
+
+	jl.WriteStep(fmt.Sprintf("%s stage approved by %s", stage, j.Approval.By))
+	return nil
+}
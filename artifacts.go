@@ -0,0 +1,175 @@
+package cion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// DependenciesDir is where the artifacts of a job's dependencies are mounted in the build
+// container, in a directory for each owner/repo.
+const DependenciesDir = "/cion/dependencies"
+
+// DependencyConfig declares another repo whose artifacts the build container needs, defined
+// in .cion.yml.
+type DependencyConfig struct {
+	// Repo is the owner/repo of the dependency.
+	Repo string
+
+	// Branch restricts the dependency to jobs for a branch. If it's empty, the last successful
+	// job for any branch is used.
+	Branch string
+}
+
+// split returns the owner and repo of a dependency.
+func (dc DependencyConfig) split() (string, string, error) {
+	parts := strings.Split(dc.Repo, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", fmt.Errorf("dependency %q must be in the form owner/repo", dc.Repo)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// saveArtifacts copies the artifacts directory of a job into the JobStore, and removes the
+// artifacts of older jobs for the same branch or tag, which are no longer needed.
+func saveArtifacts(r JobRequest, wd string, jl io.Writer) error {
+	j, e, s := r.Job, r.Executor, r.Store
+
+	// check that there are any artifacts first, so that empty archives aren't stored
+	var files bytes.Buffer
+	if err := readFromWorkdir(wd, e, &files, jl, "ls", "-A", ArtifactsDir); err != nil {
+		return err
+	} else if files.Len() == 0 {
+		return nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(readFromWorkdir(wd, e, pw, jl, "tar", "-c", "-C", ArtifactsDir, "."))
+	}()
+
+	if err := s.SaveArtifacts(j, pr); err != nil {
+		pr.CloseWithError(err)
+		return err
+	}
+
+	j.Artifacts = true
+	if err := s.Save(j); err != nil {
+		return err
+	}
+
+	older, err := s.List(j.Owner, j.Repo, JobFilter{Branch: j.Branch, Tag: j.Tag})
+	if err != nil {
+		return err
+	}
+
+	for _, o := range older {
+		if o.Number >= j.Number || !o.Artifacts {
+			continue
+		}
+
+		if err := s.DeleteArtifacts(o); err != nil {
+			log.Println("error deleting artifacts:", err)
+			continue
+		}
+
+		o.Artifacts = false
+		s.Save(o)
+	}
+
+	return nil
+}
+
+// findDependency returns the last successful job for a dependency that has artifacts.
+func findDependency(s JobStore, dc DependencyConfig) (*Job, error) {
+	owner, repo, err := dc.split()
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := s.List(owner, repo, JobFilter{Branch: dc.Branch, Status: JobSucceeded})
+	if err != nil {
+		return nil, err
+	}
+
+	// job stores don't list jobs in any particular order, so the newest job is the one with
+	// the highest number
+	var latest *Job
+	for _, j := range jobs {
+		if j.Artifacts && (latest == nil || j.Number > latest.Number) {
+			latest = j
+		}
+	}
+
+	if latest == nil {
+		return nil, fmt.Errorf("no successful job with artifacts for dependency %s", dc.Repo)
+	}
+
+	return latest, nil
+}
+
+// fetchDependencies starts a container with the working directory and a volume for the
+// dependencies, and imports the artifacts of each dependency into it. The build container
+// uses the volumes from this container instead of the working directory container.
+func fetchDependencies(r JobRequest, deps []DependencyConfig, wd string,
+	jl io.Writer) (string, error) {
+
+	j, e, s := r.Job, r.Executor, r.Store
+
+	var upstream []*Job
+	var dirs []string
+	for _, dc := range deps {
+		dj, err := findDependency(s, dc)
+		if err != nil {
+			return "", err
+		}
+
+		upstream = append(upstream, dj)
+		dirs = append(dirs, path.Join(DependenciesDir, dj.Owner, dj.Repo))
+	}
+
+	opts := RunContainerOpts{
+		Image:       GitImage,
+		Cmd:         append([]string{"mkdir", "-p"}, dirs...),
+		Volumes:     []string{DependenciesDir},
+		VolumesFrom: []string{wd},
+		Pull:        PullIfNotPresent,
+		Internal:    true,
+	}
+
+	c, err := e.Run(opts)
+	if err != nil {
+		return "", err
+	}
+
+	if r, err := e.Wait(c); err != nil {
+		return "", err
+	} else if r != 0 {
+		return "", errors.New("unable to create dependency directories")
+	}
+
+	for i, dj := range upstream {
+		fmt.Fprintf(jl, "CION: fetching artifacts from %s/%s job #%d\n", dj.Owner, dj.Repo,
+			dj.Number)
+
+		pr, pw := io.Pipe()
+		go func(dj *Job) {
+			pw.CloseWithError(s.GetArtifacts(dj, pw))
+		}(dj)
+
+		if err := e.Import(c, dirs[i], pr); err != nil {
+			pr.CloseWithError(err)
+			return "", fmt.Errorf("unable to fetch artifacts for %s/%s: %v", dj.Owner, dj.Repo,
+				err)
+		}
+
+		j.Dependencies = append(j.Dependencies, refOf(dj))
+	}
+
+	return c, s.Save(j)
+}
@@ -8,11 +8,16 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"io"
+	"sort"
 )
 
 var (
-	JobsBucket    = []byte("jobs")
-	JobRefsBucket = []byte("jobrefs")
+	JobsBucket        = []byte("jobs")
+	JobRefsBucket     = []byte("jobrefs")
+	DeploymentsBucket = []byte("deployments")
+	LocksBucket       = []byte("locks")
+	CachesBucket      = []byte("caches")
+	ArtifactsBucket   = []byte("artifacts")
 )
 
 type BoltJobStore struct {
@@ -32,11 +37,13 @@ type buckets struct {
 	Logs  *bolt.Bucket
 }
 
-// boltJobRef is a reference to a job in a specific owner/repo/branch bucket.
+// boltJobRef is a reference to a job in a specific owner/repo/branch bucket, and optionally to
+// one of its named log streams.
 type boltJobRef struct {
 	Owner  string
 	Repo   string
 	Number uint64
+	Stream string
 }
 
 func NewBoltJobStore(path string) (*BoltJobStore, error) {
@@ -118,7 +125,7 @@ func (s *BoltJobStore) ListRepos(owner string) ([]string, error) {
 	return l, nil
 }
 
-func (s *BoltJobStore) List(owner, repo string) ([]*Job, error) {
+func (s *BoltJobStore) List(owner, repo string, f JobFilter) ([]*Job, error) {
 	var l []*Job
 
 	ref := boltJobRef{
@@ -141,7 +148,9 @@ func (s *BoltJobStore) List(owner, repo string) ([]*Job, error) {
 					return err
 				}
 
-				l = append(l, j)
+				if f.Match(j) {
+					l = append(l, j)
+				}
 			}
 		}
 
@@ -219,13 +228,21 @@ func (l BoltJobLogger) WriteStep(name string) error {
 	return err
 }
 
+func (l BoltJobLogger) Stream(name string) JobLogger {
+	ref := l.ref
+	ref.Stream = name
+
+	return BoltJobLogger{db: l.db, ref: ref}
+}
+
 // Save writes job data to various buckets in the Bolt database. We use this nesting pattern
 // for buckets:
 //
 //    jobs -> (owner) -> (repo) -> logs_(job number)
 //
 // The actual data for a job is saved to the bucket for its repo, and its logs are stored in
-// the logs_<number> sub-bucket.
+// the logs_<number> sub-bucket. Named log streams for the job are stored in the
+// logs_<number>_<stream> sub-buckets.
 func (s *BoltJobStore) Save(j *Job) error {
 	ref := boltJobRef{
 		Owner:  j.Owner,
@@ -259,6 +276,344 @@ func (s *BoltJobStore) Save(j *Job) error {
 	})
 }
 
+// SaveDeployment writes a deployment record to the Bolt database. Deployments are stored by
+// sequence number in a separate set of buckets:
+//
+//	deployments -> (owner) -> (repo)
+func (s *BoltJobStore) SaveDeployment(d *Deployment) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getDeploymentsBucket(d.Owner, d.Repo, tx)
+		if err != nil {
+			return err
+		}
+
+		i, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		val, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		return b.Put(Uint64ToBytes(i), val)
+	})
+}
+
+func (s *BoltJobStore) ListDeployments(owner, repo, environment string) ([]*Deployment, error) {
+	var l []*Deployment
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := getDeploymentsBucket(owner, repo, tx)
+		if err != nil {
+			return err
+		} else if b == nil {
+			// nothing has been deployed yet
+			return nil
+		}
+
+		c := b.Cursor()
+		for key, val := c.Last(); key != nil; key, val = c.Prev() {
+			d := &Deployment{}
+			if err := json.Unmarshal(val, d); err != nil {
+				return err
+			}
+
+			if environment == "" || d.Environment == environment {
+				l = append(l, d)
+			}
+		}
+
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// getDeploymentsBucket returns the deployments bucket for an owner/repo. In a read-only
+// transaction, it returns nil if the bucket doesn't exist.
+func getDeploymentsBucket(owner, repo string, tx *bolt.Tx) (*bolt.Bucket, error) {
+	return getRepoBucket(DeploymentsBucket, owner, repo, tx)
+}
+
+// getRepoBucket returns the bucket for an owner/repo under a top-level bucket. In a read-only
+// transaction, it returns nil if the bucket doesn't exist.
+func getRepoBucket(root []byte, owner, repo string, tx *bolt.Tx) (*bolt.Bucket, error) {
+	names := [][]byte{root, []byte(owner), []byte(repo)}
+
+	if !tx.Writable() {
+		b := tx.Bucket(names[0])
+		for _, n := range names[1:] {
+			if b == nil {
+				return nil, nil
+			}
+			b = b.Bucket(n)
+		}
+
+		return b, nil
+	}
+
+	b, err := tx.CreateBucketIfNotExists(names[0])
+	for _, n := range names[1:] {
+		if err != nil {
+			return nil, err
+		}
+		b, err = b.CreateBucketIfNotExists(n)
+	}
+
+	return b, err
+}
+
+// SaveCache writes a cache record to the Bolt database. Caches are stored by key in a separate
+// set of buckets:
+//
+//	caches -> (owner) -> (repo)
+func (s *BoltJobStore) SaveCache(c *CacheEntry) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getRepoBucket(CachesBucket, c.Owner, c.Repo, tx)
+		if err != nil {
+			return err
+		}
+
+		val, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(c.Key), val)
+	})
+}
+
+func (s *BoltJobStore) ListCaches(owner, repo string) ([]*CacheEntry, error) {
+	var l []*CacheEntry
+
+	if err := s.db.View(func(tx *bolt.Tx) error {
+		b, err := getRepoBucket(CachesBucket, owner, repo, tx)
+		if err != nil || b == nil {
+			return err
+		}
+
+		return b.ForEach(func(key, val []byte) error {
+			c := &CacheEntry{}
+			if err := json.Unmarshal(val, c); err != nil {
+				return err
+			}
+
+			l = append(l, c)
+			return nil
+		})
+	}); err != nil {
+		return nil, err
+	}
+
+	sort.Sort(cachesByUse(l))
+	return l, nil
+}
+
+func (s *BoltJobStore) DeleteCache(owner, repo, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := getRepoBucket(CachesBucket, owner, repo, tx)
+		if err != nil {
+			return err
+		}
+
+		return b.Delete([]byte(key))
+	})
+}
+
+// artifactsChunkSize is the size of the chunks that artifacts are split into, so that large
+// archives aren't written in a single transaction.
+const artifactsChunkSize = 1 << 20
+
+// SaveArtifacts writes a job's artifacts to the Bolt database, as a sequence of compressed
+// chunks in a separate set of buckets:
+//
+//	artifacts -> (owner) -> (repo) -> (job number)
+func (s *BoltJobStore) SaveArtifacts(j *Job, r io.Reader) error {
+	if err := s.DeleteArtifacts(j); err != nil {
+		return err
+	}
+
+	buf := make([]byte, artifactsChunkSize)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		if rerr == io.EOF {
+			return nil
+		} else if rerr != nil && rerr != io.ErrUnexpectedEOF {
+			return rerr
+		}
+
+		if err := s.db.Update(func(tx *bolt.Tx) error {
+			rb, err := getRepoBucket(ArtifactsBucket, j.Owner, j.Repo, tx)
+			if err != nil {
+				return err
+			}
+
+			b, err := rb.CreateBucketIfNotExists(Uint64ToBytes(j.Number))
+			if err != nil {
+				return err
+			}
+
+			i, err := b.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			val, err := snappy.Encode(nil, buf[:n])
+			if err != nil {
+				return err
+			}
+
+			return b.Put(Uint64ToBytes(i), val)
+		}); err != nil {
+			return err
+		}
+
+		if rerr == io.ErrUnexpectedEOF {
+			return nil
+		}
+	}
+}
+
+func (s *BoltJobStore) GetArtifacts(j *Job, w io.Writer) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		rb, err := getRepoBucket(ArtifactsBucket, j.Owner, j.Repo, tx)
+		if err != nil {
+			return err
+		}
+
+		var b *bolt.Bucket
+		if rb != nil {
+			b = rb.Bucket(Uint64ToBytes(j.Number))
+		}
+		if b == nil {
+			return errors.New("no artifacts saved for job")
+		}
+
+		return b.ForEach(func(key, val []byte) error {
+			chunk, err := snappy.Decode(nil, val)
+			if err != nil {
+				return err
+			}
+
+			_, err = w.Write(chunk)
+			return err
+		})
+	})
+}
+
+func (s *BoltJobStore) DeleteArtifacts(j *Job) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		rb, err := getRepoBucket(ArtifactsBucket, j.Owner, j.Repo, tx)
+		if err != nil {
+			return err
+		}
+
+		if err := rb.DeleteBucket(Uint64ToBytes(j.Number)); err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		return nil
+	})
+}
+
+// AcquireLock tries to acquire a lock, which is stored by name in the locks bucket. Since locks
+// are persisted, jobs that were interrupted by a restart are released from their locks once
+// they're marked as ended.
+func (s *BoltJobStore) AcquireLock(name string, ref JobRef) (*Lock, bool, error) {
+	l := &Lock{Name: name}
+	var acquired bool
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(LocksBucket)
+		if err != nil {
+			return err
+		}
+
+		if val := b.Get([]byte(name)); val != nil {
+			if err := json.Unmarshal(val, l); err != nil {
+				return err
+			}
+		}
+
+		acquired, err = l.acquire(ref, func(r JobRef) (bool, error) {
+			j, err := getJob(r, tx)
+			if err != nil {
+				return false, err
+			}
+
+			return j == nil || j.EndedAt != nil, nil
+		})
+		if err != nil {
+			return err
+		}
+
+		val, err := json.Marshal(l)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(name), val)
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return l, acquired, nil
+}
+
+func (s *BoltJobStore) ReleaseLock(name string, ref JobRef) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(LocksBucket)
+		if err != nil {
+			return err
+		}
+
+		val := b.Get([]byte(name))
+		if val == nil {
+			return nil
+		}
+
+		l := &Lock{}
+		if err := json.Unmarshal(val, l); err != nil {
+			return err
+		}
+
+		l.release(ref)
+
+		if val, err = json.Marshal(l); err != nil {
+			return err
+		}
+
+		return b.Put([]byte(name), val)
+	})
+}
+
+// getJob reads a job within a transaction. It returns nil if the job doesn't exist.
+func getJob(ref JobRef, tx *bolt.Tx) (*Job, error) {
+	b := tx.Bucket(JobsBucket)
+	for _, n := range []string{ref.Owner, ref.Repo} {
+		if b == nil {
+			return nil, nil
+		}
+		b = b.Bucket([]byte(n))
+	}
+	if b == nil {
+		return nil, nil
+	}
+
+	val := b.Get(Uint64ToBytes(ref.Number))
+	if val == nil {
+		return nil, nil
+	}
+
+	j := &Job{}
+	return j, json.Unmarshal(val, j)
+}
+
 func getBuckets(ref boltJobRef, tx *bolt.Tx) (*buckets, error) {
 	var jb, ob, rb, lb *bolt.Bucket
 	var err error
@@ -298,6 +653,9 @@ func getBuckets(ref boltJobRef, tx *bolt.Tx) (*buckets, error) {
 
 	if ref.Number != 0 {
 		lbn := "logs_" + string(ref.Number)
+		if ref.Stream != "" {
+			lbn += "_" + ref.Stream
+		}
 
 		if tx.Writable() {
 			lb, err = rb.CreateBucketIfNotExists([]byte(lbn))
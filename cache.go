@@ -0,0 +1,302 @@
+package cion
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheMount is where a cache volume is mounted in the containers that restore and save it.
+const cacheMount = "/cion-cache"
+
+// CacheConfig declares paths in the build container that are cached across jobs, defined in
+// .cion.yml.
+type CacheConfig struct {
+	// Key identifies the cache, and can refer to $BRANCH, $TAG, $SHA, $NUMBER, and job
+	// parameters. It defaults to "default".
+	Key string
+
+	// Files are paths in the repo, like "go.sum", whose contents are hashed into the key, so
+	// the cache is replaced when they change.
+	Files []string
+
+	// Paths are the absolute paths in the build container to cache, like "/root/.m2".
+	Paths []string
+}
+
+// CacheEntry is a record of a cache that was saved for a repo.
+type CacheEntry struct {
+	Owner string
+	Repo  string
+	Key   string
+
+	// Volume is the name of the volume that holds the cache.
+	Volume string
+
+	// Host is the Docker host that the volume is on, when jobs can run on several hosts, like
+	// the hosts in a pool or the hosts of agents. The cache is only restored on that host.
+	Host string
+
+	// Size is the size of the cache in bytes.
+	Size int64
+
+	CreatedAt *time.Time
+	UsedAt    *time.Time
+}
+
+// jobCacheKey returns the key for a job's cache, including a hash of any files in the key.
+func jobCacheKey(j *Job, c CacheConfig, wd string, e Executor, jl io.Writer) (string, error) {
+	key := expandJobVars(j, c.Key)
+	if key == "" {
+		key = "default"
+	}
+
+	if len(c.Files) > 0 {
+		var files bytes.Buffer
+		cmd := append([]string{"cat"}, c.Files...)
+		if err := readFromWorkdir(wd, e, &files, jl, cmd...); err != nil {
+			return "", fmt.Errorf("unable to read cache key files: %v", err)
+		}
+
+		h := sha256.Sum256(files.Bytes())
+		key += "-" + hex.EncodeToString(h[:])[:16]
+	}
+
+	return key, nil
+}
+
+// cacheHost returns the name of the Docker host that a job's caches are kept on, which is the
+// agent that runs the job, if any, and the job's host in a pool, if it runs on one.
+func (r JobRequest) cacheHost() string {
+	var parts []string
+	if r.Job.Agent != "" {
+		parts = append(parts, r.Job.Agent)
+	}
+	if r.placement != nil {
+		parts = append(parts, r.placement.hostName())
+	}
+
+	return strings.Join(parts, "/")
+}
+
+// cacheVolume returns the name of the volume for a repo's cache.
+func cacheVolume(owner, repo, key string) string {
+	h := sha256.Sum256([]byte(key))
+	repoName := nonAlphanumericRegexp.ReplaceAllString(owner+"-"+repo, "-")
+
+	return "cion-cache-" + strings.ToLower(repoName) + "-" + hex.EncodeToString(h[:])[:16]
+}
+
+// restoreCache starts a container with the working directory and a volume for each cache
+// path, and copies any saved cache into them. The build container uses the volumes from this
+// container instead of the working directory container. The returned entry is nil if there
+// wasn't a saved cache on the job's Docker host.
+func restoreCache(r JobRequest, c CacheConfig, key, wd string, jl io.Writer) (string,
+	*CacheEntry, error) {
+
+	j, e := r.Job, r.Executor
+
+	entry, err := findCache(r.Store, j.Owner, j.Repo, key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	// the volume on any other host would be a new, empty one
+	if entry != nil && entry.Host != r.cacheHost() {
+		fmt.Fprintf(jl, "CION: cache %s was saved on another Docker host\n", key)
+		entry = nil
+	}
+
+	var binds []string
+	if entry != nil {
+		fmt.Fprintf(jl, "CION: restoring cache %s\n", key)
+		binds = append(binds, entry.Volume+":"+cacheMount+":ro")
+	} else {
+		fmt.Fprintf(jl, "CION: no cache saved for %s\n", key)
+	}
+
+	// copy each saved path into its volume, if it was saved
+	script := `i=0; for p in "$@"; do
+		if [ -d "$CACHE/$i" ]; then cp -a "$CACHE/$i/." "$p/" || exit 1; fi
+		i=$((i+1))
+	done`
+
+	cc, err := runCacheContainer(script, c.Paths, binds, []string{wd}, e, jl, nil)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to restore cache: %v", err)
+	}
+
+	if entry != nil {
+		t := time.Now()
+		entry.UsedAt = &t
+		if err := r.Store.SaveCache(entry); err != nil {
+			log.Println("error saving cache entry:", err)
+		}
+	}
+
+	return cc, entry, nil
+}
+
+// saveCache copies the cache paths from the container that the build used into the cache
+// volume, records the cache, and evicts older caches if the repo is over its size limit.
+func saveCache(r JobRequest, c CacheConfig, key, cc string, jl io.Writer) error {
+	j, e := r.Job, r.Executor
+	volume := cacheVolume(j.Owner, j.Repo, key)
+
+	fmt.Fprintf(jl, "CION: saving cache %s\n", key)
+
+	// replace each saved path, then print the size of the cache in kilobytes
+	script := `i=0; for p in "$@"; do
+		rm -rf "$CACHE/$i.new" && mkdir -p "$CACHE/$i.new" &&
+			cp -a "$p/." "$CACHE/$i.new/" &&
+			rm -rf "$CACHE/$i" && mv "$CACHE/$i.new" "$CACHE/$i" || exit 1
+		i=$((i+1))
+	done
+	du -sk "$CACHE" | cut -f1`
+
+	var stdout bytes.Buffer
+	_, err := runCacheContainer(script, c.Paths, []string{volume + ":" + cacheMount},
+		[]string{cc}, e, jl, &stdout)
+	if err != nil {
+		return err
+	}
+
+	kb, err := strconv.ParseInt(strings.TrimSpace(stdout.String()), 10, 64)
+	if err != nil {
+		return fmt.Errorf("unable to determine cache size: %v", err)
+	}
+
+	t := time.Now()
+	entry, err := findCache(r.Store, j.Owner, j.Repo, key)
+	if err != nil {
+		return err
+	} else if entry == nil {
+		entry = &CacheEntry{
+			Owner:     j.Owner,
+			Repo:      j.Repo,
+			Key:       key,
+			Volume:    volume,
+			CreatedAt: &t,
+		}
+	}
+
+	entry.Host = r.cacheHost()
+	entry.Size = kb * 1024
+	entry.UsedAt = &t
+	if err := r.Store.SaveCache(entry); err != nil {
+		return err
+	}
+
+	if r.MaxCacheSize > 0 {
+		evictCaches(r.Store, e, j.Owner, j.Repo, r.MaxCacheSize, jl)
+	}
+
+	return nil
+}
+
+// runCacheContainer runs a script in a container with the given volumes, passing it the cache
+// paths as arguments, and waits for it to finish. The container isn't removed, so that its
+// volumes can be used by other containers.
+func runCacheContainer(script string, paths, binds, volumesFrom []string, e Executor,
+	jl io.Writer, stdout io.Writer) (string, error) {
+
+	if stdout == nil {
+		stdout = jl
+	}
+
+	opts := RunContainerOpts{
+		Image:       GitImage,
+		Cmd:         append([]string{"sh", "-c", script, "sh"}, paths...),
+		Env:         []string{"CACHE=" + cacheMount},
+		Volumes:     paths,
+		Binds:       binds,
+		VolumesFrom: volumesFrom,
+		Pull:        PullIfNotPresent,
+		Internal:    true,
+	}
+
+	c, err := e.Run(opts)
+	if err != nil {
+		return "", err
+	}
+
+	if err := e.Attach(c, stdout, jl); err != nil {
+		return "", err
+	}
+
+	if r, err := e.Wait(c); err != nil {
+		return "", err
+	} else if r != 0 {
+		return "", fmt.Errorf("exit status %d from cache container", r)
+	}
+
+	return c, nil
+}
+
+// findCache returns the cache entry for a key, or nil if there isn't one.
+func findCache(s JobStore, owner, repo, key string) (*CacheEntry, error) {
+	l, err := s.ListCaches(owner, repo)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range l {
+		if entry.Key == key {
+			return entry, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// evictCaches removes the least recently used caches for a repo until their total size is
+// within the limit.
+func evictCaches(s JobStore, e Executor, owner, repo string, limit int64, jl io.Writer) {
+	l, err := s.ListCaches(owner, repo)
+	if err != nil {
+		log.Println("error getting caches list:", err)
+		return
+	}
+
+	var total int64
+	for _, entry := range l {
+		total += entry.Size
+	}
+
+	// caches are listed from most to least recently used
+	for i := len(l) - 1; i >= 0 && total > limit; i-- {
+		fmt.Fprintf(jl, "CION: evicting cache %s\n", l[i].Key)
+
+		if err := removeCache(s, e, l[i]); err != nil {
+			// the cache may be in use by another job
+			log.Println("error evicting cache:", err)
+			continue
+		}
+
+		total -= l[i].Size
+	}
+}
+
+// removeCache removes a cache's volume and its record.
+func removeCache(s JobStore, e Executor, entry *CacheEntry) error {
+	if err := e.RemoveVolume(entry.Volume); err != nil {
+		return err
+	}
+
+	return s.DeleteCache(entry.Owner, entry.Repo, entry.Key)
+}
+
+// cachesByUse sorts caches from most to least recently used.
+type cachesByUse []*CacheEntry
+
+func (l cachesByUse) Len() int      { return len(l) }
+func (l cachesByUse) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l cachesByUse) Less(i, j int) bool {
+	return l[i].UsedAt != nil && (l[j].UsedAt == nil || l[i].UsedAt.After(*l[j].UsedAt))
+}
@@ -0,0 +1,52 @@
+package cion
+
+import (
+	"io/ioutil"
+	"testing"
+)
+
+func TestRestoreCacheHost(t *testing.T) {
+	tests := []struct {
+		host     string
+		restored bool
+	}{
+		{host: "a", restored: true},
+		{host: "b", restored: false},
+		{host: "", restored: false},
+	}
+
+	for _, tt := range tests {
+		p, fakes := newTestPool(PoolHostConfig{Name: "a", Capacity: 1})
+		pj := p.pin()
+
+		wd, err := pj.Run(RunContainerOpts{Image: GitImage, Volumes: []string{BuildDir}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := NewInMemoryJobStore()
+		j := NewJob("owner", "repo", "master", "", "")
+		if err := s.Save(j); err != nil {
+			t.Fatal(err)
+		}
+
+		entry := &CacheEntry{Owner: "owner", Repo: "repo", Key: "default", Volume: "vol",
+			Host: tt.host}
+		if err := s.SaveCache(entry); err != nil {
+			t.Fatal(err)
+		}
+
+		r := JobRequest{Job: j, Executor: pj, Store: s, placement: pj}
+		c := CacheConfig{Paths: []string{"/root/.m2"}}
+		if _, entry, err = restoreCache(r, c, "default", wd, ioutil.Discard); err != nil {
+			t.Fatal(err)
+		}
+
+		// a cache saved on another host would only mount an empty volume with the same name
+		binds := fakes[0].Containers()[1].Opts.Binds
+		if restored := entry != nil; restored != tt.restored || restored != (len(binds) == 1) {
+			t.Errorf("cache on %q restored = %v with binds %v, want %v", tt.host, restored,
+				binds, tt.restored)
+		}
+	}
+}
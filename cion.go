@@ -9,56 +9,333 @@ import (
 	"github.com/zenazn/goji/web/middleware"
 	"log"
 	"net/http"
+	"os"
 	"regexp"
+	"time"
 )
 
 type Config struct {
-	Executor       Executor
+	Executor Executor
+
+	// Pool is the pool of Docker hosts that jobs are spread across, if they run on several
+	// hosts. It's the Executor too, but jobs are pinned to one of its hosts.
+	Pool *PoolExecutor
+
 	JobStore       JobStore
 	GitHubClientID string
 	GitHubSecret   string
+	GitHubToken    string
+
+	// GitHubDeployments specifies whether releases to an environment are recorded with the
+	// GitHub Deployments API. This requires a GitHubToken.
+	GitHubDeployments bool
+
+	// Tracker tracks the jobs running in this process.
+	Tracker *JobTracker
+
+	// Policy restricts the options that job configs can use.
+	Policy *Policy
+
+	// RegistryAuth is a list of credentials for pulling images from Docker registries.
+	RegistryAuth RegistryAuth
+
+	// MaxCacheSize is the maximum total size of the caches for each repo, in bytes.
+	MaxCacheSize int64
+
+	// Queue holds jobs for remote agents to run, if jobs are run by agents instead of by the
+	// server. AgentToken is the token that agents must send, which is required when there's a
+	// Queue.
+	Queue      *JobQueue
+	AgentToken string
+
+	// UserHeader is the request header that identifies the user making an API request, which
+	// is set by an authenticating proxy in front of cion. If it's empty, users aren't verified.
+	UserHeader string
+}
+
+// Options are the options used to configure cion, typically set from the command line.
+type Options struct {
+	// Executor is the kind of executor to run containers with, "docker", "kubernetes", or
+	// "local".
+	Executor string
+
+	// LocalRoot is the directory for the volumes of the local executor, which uses a temporary
+	// directory if it's empty. Toolchains are the images that the local executor can run, in
+	// the form "name" or "name=/path/to/bin", and LocalIsolate specifies whether it runs
+	// processes in their own namespaces, which doesn't chroot them.
+	LocalRoot    string
+	Toolchains   []string
+	LocalIsolate bool
+
+	// KubeConfig is the path to a kubeconfig file for the Kubernetes executor, which uses the
+	// in-cluster configuration if it's empty. KubeNamespace is the namespace to run pods in,
+	// and KubeStorageClass is the storage class for container volumes.
+	KubeConfig       string
+	KubeNamespace    string
+	KubeStorageClass string
+
+	DockerEndpoint string
+	DockerCertPath string
+
+	// DockerHostsPath is the path to a YAML file listing several Docker hosts, which jobs are
+	// spread across instead of running on DockerEndpoint.
+	DockerHostsPath string
+
+	DBPath            string
+	GitHubClientID    string
+	GitHubSecret      string
+	GitHubToken       string
+	GitHubDeployments bool
+
+	// MaxCPUs, MaxMemory, MaxMemorySwap, and MaxPids are the maximum resource limits for any
+	// container. Memory limits are amounts like "512m" or "2g".
+	MaxCPUs       float64
+	MaxMemory     string
+	MaxMemorySwap string
+	MaxPids       int
+
+	// PolicyPath is the path to a YAML file with a Policy for job configs.
+	PolicyPath string
+
+	// RegistryAuthPath is the path to a YAML file with a list of registry credentials, and
+	// DockerConfigPath is the path to a Docker client config.json with more credentials.
+	RegistryAuthPath string
+	DockerConfigPath string
+
+	// DefaultPull is the pull policy for containers that don't specify one.
+	DefaultPull string
+
+	// MaxCacheSize is the maximum total size of the caches for each repo, like "10g".
+	MaxCacheSize string
+
+	// Agents specifies whether jobs are queued for remote agents instead of being run by the
+	// server. AgentToken is the token that agents authenticate with.
+	Agents     bool
+	AgentToken string
+
+	// UserHeader is the request header that an authenticating proxy sets to the user's name.
+	UserHeader string
 }
 
-func Configure(dockerEndpoint, dockerCertPath, cionDbPath, ghClientID, ghSecret string) Config {
+func Configure(opts Options) Config {
 	var err error
 	c := Config{}
 
-	c.Executor, err = NewDockerExecutor(dockerEndpoint, dockerCertPath)
+	if opts.PolicyPath != "" {
+		c.Policy, err = LoadPolicy(opts.PolicyPath)
+		if err != nil {
+			log.Fatalf("error loading policy: %v", err)
+		}
+	}
+
+	if opts.RegistryAuthPath != "" {
+		c.RegistryAuth, err = LoadRegistryAuth(opts.RegistryAuthPath)
+		if err != nil {
+			log.Fatalf("error loading registry credentials: %v", err)
+		}
+	}
+
+	if opts.DockerConfigPath != "" {
+		ra, err := LoadDockerConfig(opts.DockerConfigPath)
+		if err != nil {
+			log.Fatalf("error loading docker config: %v", err)
+		}
+
+		c.RegistryAuth = append(c.RegistryAuth, ra...)
+	}
+
+	defaultPull, err := ParsePullPolicy(opts.DefaultPull)
 	if err != nil {
-		log.Fatalf("error initializing executor: %v", err)
+		log.Fatalf("error configuring executor: %v", err)
 	}
 
-	if cionDbPath == "" {
+	maxResources := ResourceLimits{
+		CPUs:      opts.MaxCPUs,
+		PidsLimit: int64(opts.MaxPids),
+	}
+	if maxResources.Memory, err = ParseBytes(opts.MaxMemory); err != nil {
+		log.Fatalf("invalid max memory: %v", err)
+	}
+	if maxResources.MemorySwap, err = ParseBytes(opts.MaxMemorySwap); err != nil {
+		log.Fatalf("invalid max memory swap: %v", err)
+	}
+	if c.MaxCacheSize, err = ParseBytes(opts.MaxCacheSize); err != nil {
+		log.Fatalf("invalid max cache size: %v", err)
+	}
+
+	limit := func(e Executor) Executor {
+		if maxResources == (ResourceLimits{}) {
+			return e
+		}
+
+		return limitingExecutor{Executor: e, max: maxResources}
+	}
+
+	switch opts.Executor {
+	case "", "docker":
+		if opts.DockerHostsPath != "" {
+			c.Pool = configurePool(opts.DockerHostsPath, c.Policy, defaultPull, limit)
+			c.Executor = c.Pool
+			break
+		}
+
+		de, err := NewDockerExecutor(opts.DockerEndpoint, opts.DockerCertPath)
+		if err != nil {
+			log.Fatalf("error initializing executor: %v", err)
+		}
+
+		de.Policy = c.Policy
+		de.DefaultPull = defaultPull
+		c.Executor = limit(de)
+	case "kubernetes":
+		ke, err := configureKubernetes(opts, c.Policy, defaultPull)
+		if err != nil {
+			log.Fatalf("error initializing executor: %v", err)
+		}
+
+		c.Executor = limit(ke)
+	case "local":
+		le, err := NewLocalExecutor(opts.LocalRoot)
+		if err != nil {
+			log.Fatalf("error initializing executor: %v", err)
+		}
+
+		le.Toolchains = ParseToolchains(opts.Toolchains)
+		le.Isolate = opts.LocalIsolate
+		c.Executor = le
+	default:
+		log.Fatalf("unknown executor: %s", opts.Executor)
+	}
+
+	if opts.DBPath == "" {
 		c.JobStore = NewInMemoryJobStore()
 	} else {
-		c.JobStore, err = NewBoltJobStore(cionDbPath)
+		c.JobStore, err = NewBoltJobStore(opts.DBPath)
 		if err != nil {
 			log.Fatalf("error initializing job store: %v", err)
 		}
+
+		failInterruptedJobs(c.JobStore, opts.Agents)
+	}
+
+	if opts.Agents {
+		// the agent API can change any job that an agent is running, so it can't be open
+		if opts.AgentToken == "" {
+			log.Fatal("running jobs on agents needs an agent token")
+		}
+
+		c.Queue = NewJobQueue(c.JobStore)
 	}
+	c.AgentToken = opts.AgentToken
+	c.UserHeader = opts.UserHeader
 
-	c.GitHubClientID = ghClientID
-	c.GitHubSecret = ghSecret
+	c.GitHubClientID = opts.GitHubClientID
+	c.GitHubSecret = opts.GitHubSecret
+	c.GitHubToken = opts.GitHubToken
+	c.GitHubDeployments = opts.GitHubDeployments
+	c.Tracker = NewJobTracker()
 
 	return c
 }
 
-func ConfigureLocal(dockerEndpoint, dockerCertPath, ghClientID, ghSecret string) Config {
-	return Configure(dockerEndpoint, dockerCertPath, "", ghClientID, ghSecret)
+// configurePool returns a PoolExecutor for the Docker hosts listed in a file. The resource
+// limits are applied on each host, so that the pool can pin jobs to hosts.
+func configurePool(filename string, p *Policy, defaultPull PullPolicy,
+	limit func(Executor) Executor) *PoolExecutor {
+
+	configs, err := LoadPoolHosts(filename)
+	if err != nil {
+		log.Fatalf("error loading docker hosts: %v", err)
+	}
+
+	var hosts []*PoolHost
+	for _, hc := range configs {
+		de, err := NewDockerExecutor(hc.Endpoint, hc.CertPath)
+		if err != nil {
+			log.Fatalf("error initializing executor for %s: %v", hc.Name, err)
+		}
+
+		de.Policy = p
+		de.DefaultPull = defaultPull
+		hosts = append(hosts, &PoolHost{PoolHostConfig: hc, Docker: de, Executor: limit(de)})
+	}
+
+	return NewPoolExecutor(hosts)
 }
 
-func RunLocal(path string, conf Config) {
-	j := &Job{LocalPath: path}
+// failInterruptedJobs marks any jobs that were still running when cion last stopped as failed,
+// which also releases any concurrency group locks that they held. If jobs are run by agents,
+// queued jobs are left to be queued again.
+func failInterruptedJobs(s JobStore, agents bool) {
+	owners, err := s.ListOwners()
+	if err != nil {
+		// there are no jobs yet
+		return
+	}
+
+	for _, o := range owners {
+		repos, err := s.ListRepos(o)
+		if err != nil {
+			log.Println("error getting repos list:", err)
+			continue
+		}
 
-	jr := &JobRequest{
-		Job:            j,
-		Executor:       conf.Executor,
-		Store:          conf.JobStore,
-		GitHubClientID: conf.GitHubClientID,
-		GitHubSecret:   conf.GitHubSecret,
+		for _, r := range repos {
+			jobs, err := s.List(o, r, JobFilter{})
+			if err != nil {
+				log.Println("error getting job list:", err)
+				continue
+			}
+
+			for _, j := range jobs {
+				if j.EndedAt != nil || (agents && j.Status == JobQueued) {
+					continue
+				}
+
+				t := time.Now()
+				j.EndedAt = &t
+				j.Status = JobFailed
+
+				if err := s.Save(j); err != nil {
+					log.Println("error saving interrupted job:", err)
+				}
+			}
+		}
 	}
+}
 
-	jr.Run()
+// ConfigureLocal configures cion for running a single local job, which is never persisted.
+func ConfigureLocal(opts Options) Config {
+	opts.DBPath = ""
+	return Configure(opts)
+}
+
+// NewJobRequest creates a JobRequest to run a job with this configuration.
+func (c Config) NewJobRequest(j *Job) *JobRequest {
+	return &JobRequest{
+		Job:               j,
+		Executor:          c.Executor,
+		Store:             c.JobStore,
+		GitHubClientID:    c.GitHubClientID,
+		GitHubSecret:      c.GitHubSecret,
+		GitHubToken:       c.GitHubToken,
+		GitHubDeployments: c.GitHubDeployments,
+		Tracker:           c.Tracker,
+		Policy:            c.Policy,
+		RegistryAuth:      c.RegistryAuth,
+		MaxCacheSize:      c.MaxCacheSize,
+		Pool:              c.Pool,
+	}
+}
+
+func RunLocal(path string, conf Config) {
+	j := &Job{
+		LocalPath:   path,
+		Trigger:     TriggerLocal,
+		TriggeredBy: os.Getenv("USER"),
+	}
+
+	conf.NewJobRequest(j).Run()
 
 	fmt.Println("---")
 	if j.Success {
@@ -80,6 +357,29 @@ func Run(conf Config) {
 	api := web.New()
 	api.Use(middleware.SubRouter)
 
+	if conf.Queue != nil {
+		agents := web.New()
+		agents.Use(middleware.SubRouter)
+		agents.Use(AgentAuth)
+
+		// this has to be handled before the rest of the API, where it would match an owner
+		goji.Handle("/api/agents/*", agents)
+
+		agents.Get("/", ListAgentsHandler)
+		agents.Post("/", RegisterAgentHandler)
+		agents.Post("/:agent/heartbeat", AgentHeartbeatHandler)
+		agents.Get("/:agent/poll", PollJobHandler)
+		agents.Get("/:agent/commands", AgentCommandsHandler)
+		agents.Post("/:agent/jobs/:owner/:repo/:number/ack", AckJobHandler)
+		agents.Post("/:agent/jobs/:owner/:repo/:number/store/:method", AgentStoreHandler)
+		agents.Post("/:agent/jobs/:owner/:repo/:number/trigger", AgentTriggerHandler)
+		agents.Get("/:agent/jobs/:owner/:repo/:number/log", AgentLogHandler)
+		agents.Post("/:agent/jobs/:owner/:repo/:number/log", AgentLogHandler)
+		agents.Get("/:agent/jobs/:owner/:repo/:number/artifacts", AgentArtifactsHandler)
+		agents.Put("/:agent/jobs/:owner/:repo/:number/artifacts", AgentArtifactsHandler)
+		agents.Delete("/:agent/jobs/:owner/:repo/:number/artifacts", AgentArtifactsHandler)
+	}
+
 	goji.Handle("/api/*", api)
 
 	api.Get("/", ListOwnersHandler)
@@ -92,7 +392,18 @@ func Run(conf Config) {
 	api.Handle("/:owner/:repo/*", repo)
 	repo.Post("/new", NewJobHandler)
 	repo.Post(regexp.MustCompile("^/branch/(?P<branch>.+)/new"), NewJobHandler)
+	repo.Post(regexp.MustCompile("^/tag/(?P<tag>.+)/new"), NewJobHandler)
+	repo.Post(regexp.MustCompile("^/commit/(?P<sha>[0-9a-fA-F]+)/new"), NewJobHandler)
+	repo.Get("/caches", ListCachesHandler)
+	repo.Delete("/caches", PurgeCachesHandler)
+	repo.Get("/environments", ListEnvironmentsHandler)
+	repo.Get("/environments/:environment", ListDeploymentsHandler)
+	repo.Post("/:number/rebuild", RebuildJobHandler)
+	repo.Post("/:number/approve", ApproveJobHandler)
+	repo.Post("/:number/reject", RejectJobHandler)
 	repo.Get("/:number/log", GetLogHandler)
+	repo.Get("/:number/artifacts", GetArtifactsHandler)
+	repo.Get("/:number/services/:service/log", GetServiceLogHandler)
 	repo.Get("/:number", GetJobHandler)
 	repo.Get("/", ListJobsHandler)
 
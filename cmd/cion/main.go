@@ -15,6 +15,44 @@ func main() {
 	app.Email = ""
 
 	app.Flags = []cli.Flag{
+		cli.StringFlag{
+			Name:   "executor",
+			Usage:  "executor for running containers: docker, kubernetes, or local",
+			Value:  "docker",
+			EnvVar: "CION_EXECUTOR",
+		},
+		cli.StringFlag{
+			Name:   "kubeconfig",
+			Usage:  "path to a kubeconfig file for the kubernetes executor (in-cluster by default)",
+			EnvVar: "KUBECONFIG",
+		},
+		cli.StringFlag{
+			Name:   "kube-namespace",
+			Usage:  "namespace to run pods in with the kubernetes executor",
+			Value:  "default",
+			EnvVar: "CION_KUBE_NAMESPACE",
+		},
+		cli.StringFlag{
+			Name:   "kube-storage-class",
+			Usage:  "storage class for container volumes with the kubernetes executor",
+			EnvVar: "CION_KUBE_STORAGE_CLASS",
+		},
+		cli.StringFlag{
+			Name:   "local-root",
+			Usage:  "directory for container volumes with the local executor (temporary by default)",
+			EnvVar: "CION_LOCAL_ROOT",
+		},
+		cli.StringSliceFlag{
+			Name:   "toolchain",
+			Usage:  "image that the local executor can run, as name or name=/path/to/bin",
+			Value:  &cli.StringSlice{},
+			EnvVar: "CION_TOOLCHAINS",
+		},
+		cli.BoolFlag{
+			Name:   "local-isolate",
+			Usage:  "run local executor processes in their own namespaces, without a chroot (linux only)",
+			EnvVar: "CION_LOCAL_ISOLATE",
+		},
 		cli.StringFlag{
 			Name:   "docker",
 			Usage:  "docker endpoint for running containers",
@@ -26,6 +64,11 @@ func main() {
 			Usage:  "path to certificates for Docker TLS",
 			EnvVar: "DOCKER_CERT_PATH",
 		},
+		cli.StringFlag{
+			Name:   "docker-hosts",
+			Usage:  "path to a file listing several Docker hosts to run jobs on, instead of --docker",
+			EnvVar: "CION_DOCKER_HOSTS",
+		},
 		cli.StringFlag{
 			Name:   "db",
 			Usage:  "path to cion.db",
@@ -42,31 +85,134 @@ func main() {
 			Usage:  "github client secret",
 			EnvVar: "CION_GITHUB_SECRET",
 		},
+		cli.StringFlag{
+			Name:   "github-token",
+			Usage:  "github access token",
+			EnvVar: "CION_GITHUB_TOKEN",
+		},
+		cli.BoolFlag{
+			Name:   "github-deployments",
+			Usage:  "record releases with the github deployments api (requires --github-token)",
+			EnvVar: "CION_GITHUB_DEPLOYMENTS",
+		},
+		cli.Float64Flag{
+			Name:   "max-cpus",
+			Usage:  "maximum number of cpus for any container",
+			EnvVar: "CION_MAX_CPUS",
+		},
+		cli.StringFlag{
+			Name:   "max-memory",
+			Usage:  "maximum memory for any container, e.g. 4g",
+			EnvVar: "CION_MAX_MEMORY",
+		},
+		cli.StringFlag{
+			Name:   "max-memory-swap",
+			Usage:  "maximum memory plus swap for any container, e.g. 8g",
+			EnvVar: "CION_MAX_MEMORY_SWAP",
+		},
+		cli.IntFlag{
+			Name:   "max-pids",
+			Usage:  "maximum number of processes in any container",
+			EnvVar: "CION_MAX_PIDS",
+		},
+		cli.StringFlag{
+			Name:   "policy",
+			Usage:  "path to a policy file restricting what job configs can use",
+			EnvVar: "CION_POLICY",
+		},
+		cli.StringFlag{
+			Name:   "registry-auth",
+			Usage:  "path to a file with credentials for private Docker registries",
+			EnvVar: "CION_REGISTRY_AUTH",
+		},
+		cli.StringFlag{
+			Name:   "docker-config",
+			Usage:  "path to a Docker config.json with credentials for private Docker registries",
+			EnvVar: "CION_DOCKER_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "pull",
+			Value:  "always",
+			Usage:  "default pull policy for images: always, if-not-present, or never",
+			EnvVar: "CION_PULL",
+		},
+		cli.StringFlag{
+			Name:   "max-cache-size",
+			Usage:  "maximum total size of the caches for each repo, e.g. 10g",
+			EnvVar: "CION_MAX_CACHE_SIZE",
+		},
+		cli.BoolFlag{
+			Name:   "agents",
+			Usage:  "queue jobs for remote agents instead of running them on the server",
+			EnvVar: "CION_AGENTS",
+		},
+		cli.StringFlag{
+			Name:   "agent-token",
+			Usage:  "token that agents authenticate with the server with (required with --agents)",
+			EnvVar: "CION_AGENT_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "user-header",
+			Usage:  "request header set to the user's name by an authenticating proxy",
+			EnvVar: "CION_USER_HEADER",
+		},
+	}
+
+	app.Commands = []cli.Command{
+		{
+			Name:  "agent",
+			Usage: "run jobs from a cion server on this host",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "server",
+					Usage:  "base url of the cion server",
+					Value:  "http://localhost:8000",
+					EnvVar: "CION_SERVER",
+				},
+				cli.StringFlag{
+					Name:   "name",
+					Usage:  "name of the agent (the hostname by default)",
+					EnvVar: "CION_AGENT_NAME",
+				},
+				cli.IntFlag{
+					Name:   "concurrency",
+					Usage:  "number of jobs to run at once",
+					Value:  1,
+					EnvVar: "CION_AGENT_CONCURRENCY",
+				},
+			},
+			Action: func(c *cli.Context) {
+				opts := options(c)
+
+				// the agent writes to the server's job store rather than a local one
+				opts.DBPath = ""
+
+				name := c.String("name")
+				if name == "" {
+					name, _ = os.Hostname()
+				}
+
+				a := &cion.Agent{
+					Server:      c.String("server"),
+					Token:       opts.AgentToken,
+					Name:        name,
+					Concurrency: c.Int("concurrency"),
+					Config:      cion.Configure(opts),
+				}
+
+				a.Run()
+			},
+		},
 	}
 
 	app.Action = func(c *cli.Context) {
-		dockerEndpoint := c.String("docker")
-		dockerCertPath := c.String("docker-cert-path")
-		cionDbPath := c.String("db")
-		ghClientID := c.String("github-id")
-		ghSecret := c.String("github-secret")
+		opts := options(c)
 
 		if !c.Args().Present() {
-			conf := cion.Configure(
-				dockerEndpoint,
-				dockerCertPath,
-				cionDbPath,
-				ghClientID,
-				ghSecret,
-			)
+			conf := cion.Configure(opts)
 			cion.Run(conf)
 		} else {
-			conf := cion.ConfigureLocal(
-				dockerEndpoint,
-				dockerCertPath,
-				ghClientID,
-				ghSecret,
-			)
+			conf := cion.ConfigureLocal(opts)
 			localPath := c.Args()[0]
 
 			cion.RunLocal(localPath, conf)
@@ -75,3 +221,36 @@ func main() {
 
 	app.Run(os.Args)
 }
+
+// options returns the cion options from the global flags.
+func options(c *cli.Context) cion.Options {
+	return cion.Options{
+		Executor:          c.GlobalString("executor"),
+		KubeConfig:        c.GlobalString("kubeconfig"),
+		KubeNamespace:     c.GlobalString("kube-namespace"),
+		KubeStorageClass:  c.GlobalString("kube-storage-class"),
+		LocalRoot:         c.GlobalString("local-root"),
+		Toolchains:        c.GlobalStringSlice("toolchain"),
+		LocalIsolate:      c.GlobalBool("local-isolate"),
+		DockerEndpoint:    c.GlobalString("docker"),
+		DockerCertPath:    c.GlobalString("docker-cert-path"),
+		DockerHostsPath:   c.GlobalString("docker-hosts"),
+		DBPath:            c.GlobalString("db"),
+		GitHubClientID:    c.GlobalString("github-id"),
+		GitHubSecret:      c.GlobalString("github-secret"),
+		GitHubToken:       c.GlobalString("github-token"),
+		GitHubDeployments: c.GlobalBool("github-deployments"),
+		MaxCPUs:           c.GlobalFloat64("max-cpus"),
+		MaxMemory:         c.GlobalString("max-memory"),
+		MaxMemorySwap:     c.GlobalString("max-memory-swap"),
+		MaxPids:           c.GlobalInt("max-pids"),
+		PolicyPath:        c.GlobalString("policy"),
+		RegistryAuthPath:  c.GlobalString("registry-auth"),
+		DockerConfigPath:  c.GlobalString("docker-config"),
+		DefaultPull:       c.GlobalString("pull"),
+		MaxCacheSize:      c.GlobalString("max-cache-size"),
+		Agents:            c.GlobalBool("agents"),
+		AgentToken:        c.GlobalString("agent-token"),
+		UserHeader:        c.GlobalString("user-header"),
+	}
+}
@@ -0,0 +1,126 @@
+package cion
+
+import (
+	"fmt"
+	"github.com/google/go-github/github"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Deployment is a record of a release of a job to an environment.
+type Deployment struct {
+	Owner       string
+	Repo        string
+	Environment string
+
+	JobNumber uint64
+	Branch    string
+	Tag       string
+	SHA       string
+
+	DeployedAt *time.Time
+
+	Success bool
+}
+
+// release runs the release stage of a job. If the release container deploys to an environment,
+// a Deployment is recorded for it in the JobStore. An environment that expands to an empty name
+// fails the job, rather than releasing without recording where to.
+func release(r JobRequest, jc JobConfig, env []string, network string, wd string,
+	jl JobLogger, gh *github.Client) error {
+
+	j := r.Job
+	envName := os.Expand(jc.Release.Environment, func(k string) string {
+		return j.Parameters[k]
+	})
+
+	if envName == "" && jc.Release.Environment != "" {
+		return fmt.Errorf("release environment %q is empty for the job's parameters",
+			jc.Release.Environment)
+	} else if envName == "" {
+		return runStage("release", jc.Release, jc.Retry, env, network, wd, r.Executor, jl)
+	}
+
+	var ghd *github.Deployment
+	if r.GitHubDeployments && j.LocalPath == "" {
+		var err error
+		if ghd, err = createGitHubDeployment(j, envName, gh); err != nil {
+			// GitHub being unavailable shouldn't block a release
+			log.Println("error creating github deployment:", err)
+			io.WriteString(jl, fmt.Sprintf("WARNING: couldn't create GitHub deployment: %v\n", err))
+		}
+	}
+
+	env = append(env, "DEPLOY_ENVIRONMENT="+envName)
+	err := runStage("release to "+envName, jc.Release, jc.Retry, env, network, wd,
+		r.Executor, jl)
+
+	t := time.Now()
+	d := &Deployment{
+		Owner:       j.Owner,
+		Repo:        j.Repo,
+		Environment: envName,
+		JobNumber:   j.Number,
+		Branch:      j.Branch,
+		Tag:         j.Tag,
+		SHA:         j.SHA,
+		DeployedAt:  &t,
+		Success:     err == nil,
+	}
+	if serr := r.Store.SaveDeployment(d); serr != nil {
+		log.Println("error saving deployment:", serr)
+	}
+
+	if ghd != nil {
+		if serr := updateGitHubDeployment(j, *ghd.ID, err == nil, gh); serr != nil {
+			log.Println("error updating github deployment status:", serr)
+		}
+	}
+
+	return err
+}
+
+func createGitHubDeployment(j *Job, envName string, gh *github.Client) (*github.Deployment,
+	error) {
+
+	req := &github.DeploymentRequest{
+		Ref:         github.String(j.SHA),
+		AutoMerge:   github.Bool(false),
+		Environment: github.String(envName),
+		Description: github.String(fmt.Sprintf("cion job #%d", j.Number)),
+	}
+
+	d, _, err := gh.Repositories.CreateDeployment(j.Owner, j.Repo, req)
+	return d, err
+}
+
+func updateGitHubDeployment(j *Job, id int, success bool, gh *github.Client) error {
+	state := "success"
+	if !success {
+		state = "failure"
+	}
+
+	req := &github.DeploymentStatusRequest{
+		State:       github.String(state),
+		Description: github.String(fmt.Sprintf("cion job #%d", j.Number)),
+	}
+
+	_, _, err := gh.Repositories.CreateDeploymentStatus(j.Owner, j.Repo, id, req)
+	return err
+}
+
+// currentDeployments returns the latest successful deployment for each environment, given a
+// list of deployments ordered from newest to oldest.
+func currentDeployments(l []*Deployment) map[string]*Deployment {
+	m := make(map[string]*Deployment)
+
+	for _, d := range l {
+		if _, ok := m[d.Environment]; !ok && d.Success {
+			m[d.Environment] = d
+		}
+	}
+
+	return m
+}
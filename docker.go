@@ -1,15 +1,33 @@
 package cion
 
 import (
+	"bytes"
 	"code.google.com/p/go-uuid/uuid"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"github.com/fsouza/go-dockerclient"
 	"io"
+	"io/ioutil"
 	"path/filepath"
 )
 
+// cpuPeriod is the CFS scheduler period used to limit the CPUs for a container, in
+// microseconds.
+const cpuPeriod = 100000
+
 // DockerExecutor is an Executor that runs against a single Docker host.
 type DockerExecutor struct {
 	client *docker.Client
+
+	// Policy restricts which images can be pulled.
+	Policy *Policy
+
+	// DefaultPull specifies when to pull images for containers that don't have a pull policy.
+	// If it's empty, images are always pulled.
+	DefaultPull PullPolicy
+
+	pulls *pullGroup
 }
 
 func NewDockerExecutor(endpoint, certPath string) (*DockerExecutor, error) {
@@ -30,7 +48,7 @@ func NewDockerExecutor(endpoint, certPath string) (*DockerExecutor, error) {
 		return nil, err
 	}
 
-	return &DockerExecutor{client: c}, nil
+	return &DockerExecutor{client: c, pulls: newPullGroup()}, nil
 }
 
 func (e DockerExecutor) Run(opts RunContainerOpts) (string, error) {
@@ -40,8 +58,11 @@ func (e DockerExecutor) Run(opts RunContainerOpts) (string, error) {
 	}
 
 	if !opts.LocalImage {
-		pio := docker.PullImageOptions{Repository: opts.Image}
-		if err := e.client.PullImage(pio, docker.AuthConfiguration{}); err != nil {
+		if !opts.Internal && !e.Policy.AllowsImage(opts.Image) {
+			return "", fmt.Errorf("image %s is not allowed by policy", opts.Image)
+		}
+
+		if err := e.pull(opts); err != nil {
 			return "", err
 		}
 	}
@@ -51,6 +72,25 @@ func (e DockerExecutor) Run(opts RunContainerOpts) (string, error) {
 		ep[docker.Port(p)] = struct{}{}
 	}
 
+	hc := docker.HostConfig{
+		Memory:          opts.Resources.Memory,
+		MemorySwap:      opts.Resources.MemorySwap,
+		NetworkMode:     opts.Network,
+		Links:           opts.Links,
+		Binds:           opts.Binds,
+		Privileged:      opts.Privileged,
+		VolumesFrom:     opts.VolumesFrom,
+		PublishAllPorts: true,
+	}
+
+	if opts.Resources.CPUs > 0 {
+		hc.CPUPeriod = cpuPeriod
+		hc.CPUQuota = int64(opts.Resources.CPUs * cpuPeriod)
+	}
+	if opts.Resources.PidsLimit > 0 {
+		hc.PidsLimit = &opts.Resources.PidsLimit
+	}
+
 	cco := docker.CreateContainerOptions{
 		Name: uuid.New(),
 		Config: &docker.Config{
@@ -61,13 +101,15 @@ func (e DockerExecutor) Run(opts RunContainerOpts) (string, error) {
 			Volumes:      vols,
 			WorkingDir:   opts.WorkingDir,
 		},
+		HostConfig: &hc,
 	}
 
-	hc := docker.HostConfig{
-		Links:           opts.Links,
-		Privileged:      opts.Privileged,
-		VolumesFrom:     opts.VolumesFrom,
-		PublishAllPorts: true,
+	if opts.Network != "" {
+		cco.NetworkingConfig = &docker.NetworkingConfig{
+			EndpointsConfig: map[string]*docker.EndpointConfig{
+				opts.Network: {Aliases: opts.NetworkAliases},
+			},
+		}
 	}
 
 	c, err := e.client.CreateContainer(cco)
@@ -75,13 +117,104 @@ func (e DockerExecutor) Run(opts RunContainerOpts) (string, error) {
 		return "", err
 	}
 
-	if err := e.client.StartContainer(c.ID, &hc); err != nil {
+	// the host config was already provided when creating the container
+	if err := e.client.StartContainer(c.ID, nil); err != nil {
 		return "", err
 	}
 
 	return c.Name, nil
 }
 
+// pull pulls the image for a container according to its pull policy.
+func (e DockerExecutor) pull(opts RunContainerOpts) error {
+	policy := opts.Pull
+	if policy == "" {
+		policy = e.DefaultPull
+	}
+
+	switch policy {
+	case PullNever:
+		return nil
+	case PullIfNotPresent:
+		if ok, err := e.HasImage(opts.Image); err != nil || ok {
+			return err
+		}
+	case "", PullAlways:
+	default:
+		return fmt.Errorf("invalid pull policy %q", policy)
+	}
+
+	output := opts.PullOutput
+	if output == nil {
+		output = ioutil.Discard
+	}
+
+	auth := docker.AuthConfiguration{}
+	credentials := ""
+	if rc := opts.RegistryAuth.lookup(opts.Image); rc != nil {
+		auth = rc.dockerAuth()
+		credentials = rc.key()
+	}
+
+	return e.pulls.do(opts.Image, credentials, output, func() error {
+		fmt.Fprintf(output, "CION: pulling %s\n", opts.Image)
+
+		pio := docker.PullImageOptions{
+			Repository:   opts.Image,
+			OutputStream: output,
+		}
+		return e.client.PullImage(pio, auth)
+	})
+}
+
+// Ping checks that the Docker host is reachable.
+func (e DockerExecutor) Ping() error {
+	return e.client.Ping()
+}
+
+func (e DockerExecutor) HasImage(image string) (bool, error) {
+	if _, err := e.client.InspectImage(image); err == docker.ErrNoSuchImage {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+func (e DockerExecutor) Tag(image, repository, tag string) error {
+	return e.client.TagImage(image, docker.TagImageOptions{
+		Repo:  repository,
+		Tag:   tag,
+		Force: true,
+	})
+}
+
+func (e DockerExecutor) Push(opts PushOpts) (string, error) {
+	auth := docker.AuthConfiguration{}
+	if rc := opts.RegistryAuth.lookup(opts.Repository); rc != nil {
+		auth = rc.dockerAuth()
+	}
+
+	// keep the output to find the digest of the pushed image
+	var out bytes.Buffer
+	output := io.Writer(&out)
+	if opts.Output != nil {
+		output = io.MultiWriter(&out, opts.Output)
+	}
+
+	pio := docker.PushImageOptions{
+		Name:         opts.Repository,
+		Tag:          opts.Tag,
+		OutputStream: output,
+	}
+	if err := e.client.PushImage(pio, auth); err != nil {
+		return "", err
+	}
+
+	return parsePushDigest(out.String()), nil
+}
+
 func (e DockerExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) error {
 	opts := docker.AttachToContainerOptions{
 		Container: id,
@@ -99,24 +232,161 @@ func (e DockerExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) er
 }
 
 func (e DockerExecutor) Wait(id string) (int, error) {
-	return e.client.WaitContainer(id)
+	r, err := e.client.WaitContainer(id)
+	if err != nil || r == 0 {
+		return r, err
+	}
+
+	// figure out if the container failed because it ran out of memory
+	c, err := e.client.InspectContainer(id)
+	if err != nil {
+		return r, err
+	} else if c.State.OOMKilled {
+		return r, ErrOOMKilled
+	}
+
+	return r, nil
 }
 
 func (e DockerExecutor) Kill(id string) error {
 	return e.client.KillContainer(docker.KillContainerOptions{ID: id})
 }
 
-func (e DockerExecutor) Build(input io.Reader, output io.Writer) (string, error) {
-	name := uuid.New()
-	opts := docker.BuildImageOptions{
+func (e DockerExecutor) CreateNetwork(name string) (string, error) {
+	n, err := e.client.CreateNetwork(docker.CreateNetworkOptions{
+		Name:           name,
+		Driver:         "bridge",
+		CheckDuplicate: true,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return n.ID, nil
+}
+
+func (e DockerExecutor) RemoveNetwork(id string) error {
+	return e.client.RemoveNetwork(id)
+}
+
+func (e DockerExecutor) Import(id, path string, input io.Reader) error {
+	return e.client.UploadToContainer(id, docker.UploadToContainerOptions{
+		InputStream: input,
+		Path:        path,
+	})
+}
+
+func (e DockerExecutor) RemoveVolume(name string) error {
+	// stopped containers still hold on to their volumes
+	l, err := e.client.ListContainers(docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"volume": {name},
+			"status": {"created", "exited"},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, c := range l {
+		if err := e.client.RemoveContainer(docker.RemoveContainerOptions{ID: c.ID}); err != nil {
+			return err
+		}
+	}
+
+	return e.client.RemoveVolume(name)
+}
+
+func (e DockerExecutor) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	ex, err := e.client.CreateExec(docker.CreateExecOptions{
+		Container:    id,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	seo := docker.StartExecOptions{
+		OutputStream: stdout,
+		ErrorStream:  stderr,
+	}
+	if err := e.client.StartExec(ex.ID, seo); err != nil {
+		return 0, err
+	}
+
+	ei, err := e.client.InspectExec(ex.ID)
+	if err != nil {
+		return 0, err
+	}
+
+	return ei.ExitCode, nil
+}
+
+func (e DockerExecutor) Build(opts BuildOpts) (string, error) {
+	name := opts.Name
+	if name == "" {
+		name = uuid.New()
+	}
+
+	bio := docker.BuildImageOptions{
 		Name:         name,
-		InputStream:  input,
-		OutputStream: output,
+		Dockerfile:   opts.Dockerfile,
+		InputStream:  opts.Input,
+		OutputStream: opts.Output,
+		AuthConfigs: docker.AuthConfigurations{
+			Configs: make(map[string]docker.AuthConfiguration),
+		},
+	}
+
+	for k, v := range opts.BuildArgs {
+		bio.BuildArgs = append(bio.BuildArgs, docker.BuildArg{Name: k, Value: v})
 	}
 
-	if err := e.client.BuildImage(opts); err != nil {
+	// the first credentials for each registry take precedence
+	for i := len(opts.RegistryAuth) - 1; i >= 0; i-- {
+		rc := opts.RegistryAuth[i]
+		bio.AuthConfigs.Configs[rc.serverAddress()] = rc.dockerAuth()
+	}
+
+	if err := e.client.BuildImage(bio); err != nil {
 		return "", err
 	} else {
 		return name, nil
 	}
 }
+
+func (rc RegistryCredentials) dockerAuth() docker.AuthConfiguration {
+	return docker.AuthConfiguration{
+		Username:      rc.Username,
+		Password:      rc.Password,
+		Email:         rc.Email,
+		ServerAddress: rc.serverAddress(),
+	}
+}
+
+// key returns a hash that identifies the credentials, without including the password itself.
+func (rc RegistryCredentials) key() string {
+	h := sha256.Sum256([]byte(rc.Registry + "\x00" + rc.Username + "\x00" + rc.Password))
+	return hex.EncodeToString(h[:])
+}
+
+// serverAddress returns the address that Docker uses to identify the registry.
+func (rc RegistryCredentials) serverAddress() string {
+	if rc.Registry == DockerHubRegistry {
+		return "https://index.docker.io/v1/"
+	}
+
+	return rc.Registry
+}
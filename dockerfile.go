@@ -0,0 +1,324 @@
+package cion
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// buildStageImage builds the image for a stage from the Dockerfile in its config, and returns
+// the config with its image set to the result. Images are named by a hash of the Dockerfile,
+// build args, and build context, so they are only rebuilt when those change.
+func buildStageImage(j *Job, stage string, cc ContainerConfig, wd string, e Executor,
+	p *Policy, jl io.Writer) (ContainerConfig, error) {
+
+	context := path.Clean(cc.Context)
+	dockerfile, err := contextPath(context, cc.Dockerfile)
+	if err != nil {
+		return cc, err
+	}
+
+	var df bytes.Buffer
+	if err := readFromWorkdir(wd, e, &df, jl, "cat", cc.Dockerfile); err != nil {
+		return cc, fmt.Errorf("unable to read %s: %v", cc.Dockerfile, err)
+	}
+
+	if err := p.checkDockerfile(df.Bytes(), cc.BuildArgs); err != nil {
+		return cc, fmt.Errorf("%s violates policy: %v", cc.Dockerfile, err)
+	}
+
+	f, err := readContext(context, wd, e, jl)
+	if err != nil {
+		return cc, err
+	}
+	defer removeContext(f)
+
+	sum, err := hashContext(f)
+	if err != nil {
+		return cc, fmt.Errorf("unable to read build context %s: %v", context, err)
+	}
+
+	image := stageImageName(j, cc, df.Bytes(), sum)
+	if ok, err := e.HasImage(image); err != nil {
+		return cc, err
+	} else if ok {
+		fmt.Fprintf(jl, "CION: using cached image %s for %s\n", image, stage)
+	} else if err := buildImage(image, f, dockerfile, cc.BuildArgs, e, jl); err != nil {
+		return cc, err
+	}
+
+	cc.Image = image
+	cc.localImage = true
+	return cc, nil
+}
+
+// checkDockerfile returns an error if a Dockerfile builds on an image that the policy doesn't
+// allow, since the base images are pulled by the build rather than by the executor.
+func (p *Policy) checkDockerfile(dockerfile []byte, args map[string]string) error {
+	if p == nil {
+		return nil
+	}
+
+	images, err := baseImages(dockerfile, args)
+	if err != nil {
+		return err
+	}
+
+	for _, image := range images {
+		if !p.AllowsImage(image) {
+			return fmt.Errorf("base image %s is not allowed", image)
+		}
+	}
+
+	return nil
+}
+
+// baseImages returns the images in the FROM instructions of a Dockerfile, with any build args
+// substituted. Earlier build stages and scratch aren't images, so they aren't included.
+func baseImages(dockerfile []byte, args map[string]string) ([]string, error) {
+	vars := make(map[string]string, len(args))
+	for k, v := range args {
+		vars[k] = v
+	}
+
+	var images []string
+	stages := map[string]bool{"scratch": true}
+
+	for _, line := range dockerfileInstructions(dockerfile) {
+		fields := strings.Fields(line)
+
+		switch strings.ToUpper(fields[0]) {
+		case "ARG":
+			// only the args declared before the first FROM can be used in it
+			if len(images) > 0 || len(fields) < 2 {
+				continue
+			}
+
+			parts := strings.SplitN(fields[1], "=", 2)
+			if _, ok := vars[parts[0]]; !ok && len(parts) == 2 {
+				vars[parts[0]] = strings.Trim(parts[1], `"'`)
+			}
+		case "FROM":
+			fields = fields[1:]
+			for len(fields) > 0 && strings.HasPrefix(fields[0], "--") {
+				fields = fields[1:]
+			}
+			if len(fields) == 0 {
+				return nil, errors.New("FROM without an image")
+			}
+
+			unresolved := false
+			image := os.Expand(fields[0], func(k string) string {
+				v, ok := vars[k]
+				unresolved = unresolved || !ok
+				return v
+			})
+			if unresolved || image == "" {
+				return nil, fmt.Errorf("can't determine the image for FROM %s", fields[0])
+			}
+
+			if !stages[strings.ToLower(image)] {
+				images = append(images, image)
+			}
+
+			if len(fields) == 3 && strings.ToUpper(fields[1]) == "AS" {
+				stages[strings.ToLower(fields[2])] = true
+			}
+		}
+	}
+
+	return images, nil
+}
+
+// dockerfileInstructions returns the instructions in a Dockerfile, with continued lines joined
+// and comments removed.
+func dockerfileInstructions(dockerfile []byte) []string {
+	var instructions []string
+	var current string
+
+	for _, line := range strings.Split(string(dockerfile), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") || (line == "" && current == "") {
+			continue
+		}
+
+		if strings.HasSuffix(line, "\\") {
+			current += strings.TrimSuffix(line, "\\") + " "
+			continue
+		}
+
+		if current += line; strings.TrimSpace(current) != "" {
+			instructions = append(instructions, current)
+		}
+		current = ""
+	}
+
+	if strings.TrimSpace(current) != "" {
+		instructions = append(instructions, current)
+	}
+
+	return instructions
+}
+
+// contextPath returns the path of the Dockerfile relative to the build context, where both are
+// relative to the root of the repo.
+func contextPath(context, dockerfile string) (string, error) {
+	if path.IsAbs(context) || strings.HasPrefix(context, "../") || context == ".." {
+		return "", errors.New("build context must be in the repo")
+	}
+
+	dockerfile = path.Clean(dockerfile)
+	if context == "." {
+		return dockerfile, nil
+	} else if !strings.HasPrefix(dockerfile, context+"/") {
+		return "", fmt.Errorf("Dockerfile %s must be in the build context %s", dockerfile,
+			context)
+	}
+
+	return strings.TrimPrefix(dockerfile, context+"/"), nil
+}
+
+// stageImageName returns the name for an image built from a Dockerfile for a repo, with the
+// hash of its build context.
+func stageImageName(j *Job, cc ContainerConfig, dockerfile []byte, context string) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00", path.Clean(cc.Context), path.Clean(cc.Dockerfile),
+		context)
+	h.Write(dockerfile)
+
+	args := make([]string, 0, len(cc.BuildArgs))
+	for k, v := range cc.BuildArgs {
+		args = append(args, k+"="+v)
+	}
+	sort.Strings(args)
+
+	for _, a := range args {
+		fmt.Fprintf(h, "\x00%s", a)
+	}
+
+	repo := nonAlphanumericRegexp.ReplaceAllString(j.Owner+"-"+j.Repo, "-")
+	return "cion/" + strings.ToLower(repo) + ":" + hex.EncodeToString(h.Sum(nil))[:16]
+}
+
+// buildFromWorkdir builds an image from a build context in the working directory container.
+func buildFromWorkdir(image, context, dockerfile string, args map[string]string, wd string,
+	e Executor, jl io.Writer) error {
+
+	f, err := readContext(context, wd, e, jl)
+	if err != nil {
+		return err
+	}
+	defer removeContext(f)
+
+	return buildImage(image, f, dockerfile, args, e, jl)
+}
+
+// readContext reads a build context from the working directory container into a temporary
+// file as a tar archive, since it may be large. The file is removed with removeContext.
+func readContext(context, wd string, e Executor, jl io.Writer) (*os.File, error) {
+	f, err := ioutil.TempFile("", "cion-context")
+	if err != nil {
+		return nil, err
+	}
+
+	if err := readFromWorkdir(wd, e, f, jl, "tar", "-c", "-C", context, "."); err != nil {
+		removeContext(f)
+		return nil, fmt.Errorf("unable to read build context %s: %v", context, err)
+	}
+
+	return f, nil
+}
+
+// removeContext closes and removes the temporary file for a build context.
+func removeContext(f *os.File) {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// hashContext returns a hash of the files in a build context. Modification times and owners
+// aren't included, since they change every time the sources are fetched.
+func hashContext(f *os.File) (string, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		fmt.Fprintf(h, "%s\x00%c\x00%o\x00%s\x00%d\x00", path.Clean(hdr.Name), hdr.Typeflag,
+			hdr.Mode, hdr.Linkname, hdr.Size)
+		if _, err := io.Copy(h, tr); err != nil {
+			return "", err
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildImage builds an image from a build context read with readContext.
+func buildImage(image string, f *os.File, dockerfile string, args map[string]string,
+	e Executor, jl io.Writer) error {
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return err
+	}
+
+	_, err := e.Build(BuildOpts{
+		Name:       image,
+		Input:      f,
+		Output:     jl,
+		Dockerfile: dockerfile,
+		BuildArgs:  args,
+	})
+	return err
+}
+
+// readFromWorkdir runs a command in the working directory and writes its stdout to a writer.
+func readFromWorkdir(wd string, e Executor, stdout io.Writer, stderr io.Writer,
+	cmd ...string) error {
+
+	opts := RunContainerOpts{
+		Image:       GitImage,
+		Cmd:         cmd,
+		VolumesFrom: []string{wd},
+		WorkingDir:  BuildDir,
+
+		// the image was just used for the working directory
+		Pull:     PullIfNotPresent,
+		Internal: true,
+	}
+
+	c, err := e.Run(opts)
+	if err != nil {
+		return err
+	}
+	defer e.Kill(c)
+
+	if err := e.Attach(c, stdout, stderr); err != nil {
+		return err
+	}
+
+	if r, err := e.Wait(c); err != nil {
+		return err
+	} else if r != 0 {
+		return fmt.Errorf("exit status %d", r)
+	}
+
+	return nil
+}
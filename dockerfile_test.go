@@ -0,0 +1,131 @@
+package cion
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// contextFile writes a tar archive of files to a temporary file, like readContext.
+func contextFile(t *testing.T, modTime time.Time, files map[string]string) *os.File {
+	f, err := ioutil.TempFile(t.TempDir(), "context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+
+	tw := tar.NewWriter(f)
+	for _, name := range []string{"Dockerfile", "main.go", "run.sh"} {
+		body, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(body)), ModTime: modTime}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return f
+}
+
+func TestHashContext(t *testing.T) {
+	files := map[string]string{"Dockerfile": "FROM golang\n", "main.go": "package main\n"}
+	now := time.Now()
+
+	base, err := hashContext(contextFile(t, now, files))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// fetching the sources again changes modification times, but not the hash
+	if sum, err := hashContext(contextFile(t, now.Add(time.Hour), files)); err != nil ||
+		sum != base {
+		t.Errorf("hash with new modification times = %s, %v, want %s", sum, err, base)
+	}
+
+	tests := []map[string]string{
+		{"Dockerfile": "FROM golang\n", "main.go": "package main // changed\n"},
+		{"Dockerfile": "FROM golang\n", "main.go": "package main\n", "run.sh": ""},
+		{"Dockerfile": "FROM golang\n"},
+	}
+
+	for _, changed := range tests {
+		if sum, err := hashContext(contextFile(t, now, changed)); err != nil || sum == base {
+			t.Errorf("hash of %v = %s, %v, want a different hash", changed, sum, err)
+		}
+	}
+
+	// images built from the same Dockerfile with different contexts are different
+	j := NewJob("owner", "repo", "master", "", "")
+	cc := ContainerConfig{Context: ".", Dockerfile: "Dockerfile"}
+	if stageImageName(j, cc, []byte(files["Dockerfile"]), base) ==
+		stageImageName(j, cc, []byte(files["Dockerfile"]), "other") {
+		t.Error("stage image name doesn't depend on the build context")
+	}
+}
+
+func TestBaseImages(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		args       map[string]string
+		images     []string
+		err        bool
+	}{
+		{dockerfile: "FROM golang:1.5\nRUN make\n", images: []string{"golang:1.5"}},
+		{dockerfile: "# syntax\nfrom golang\n", images: []string{"golang"}},
+		{dockerfile: "FROM scratch\nCOPY app /\n"},
+		{
+			dockerfile: "FROM golang AS build\nFROM build\nFROM alpine\nCOPY --from=build / /\n",
+			images:     []string{"golang", "alpine"},
+		},
+		{
+			dockerfile: "FROM --platform=linux/amd64 registry.example.com/team/app\n",
+			images:     []string{"registry.example.com/team/app"},
+		},
+		{
+			dockerfile: "FROM \\\n  golang\n",
+			images:     []string{"golang"},
+		},
+		{
+			dockerfile: "ARG VERSION=1.5\nFROM golang:${VERSION}\n",
+			images:     []string{"golang:1.5"},
+		},
+		{
+			dockerfile: "ARG VERSION=1.5\nFROM golang:$VERSION\n",
+			args:       map[string]string{"VERSION": "1.6"},
+			images:     []string{"golang:1.6"},
+		},
+		{
+			dockerfile: "ARG IMAGE\nFROM $IMAGE\n",
+			args:       map[string]string{"IMAGE": "evil.example.com/x"},
+			images:     []string{"evil.example.com/x"},
+		},
+		{dockerfile: "FROM golang:$VERSION\n", err: true},
+		{dockerfile: "ARG IMAGE\nFROM $IMAGE\n", err: true},
+		{dockerfile: "FROM golang\nARG VERSION=1.5\nFROM alpine:$VERSION\n", err: true},
+		{dockerfile: "FROM --platform=linux/amd64\n", err: true},
+	}
+
+	for _, tt := range tests {
+		images, err := baseImages([]byte(tt.dockerfile), tt.args)
+		if tt.err {
+			if err == nil {
+				t.Errorf("baseImages(%q) = %v, want an error", tt.dockerfile, images)
+			}
+		} else if err != nil || strings.Join(images, " ") != strings.Join(tt.images, " ") {
+			t.Errorf("baseImages(%q) = %v, %v, want %v", tt.dockerfile, images, err, tt.images)
+		}
+	}
+}
@@ -1,6 +1,12 @@
 package cion
 
-import "io"
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotSupported is returned by an Executor for operations that it can't perform.
+var ErrNotSupported = errors.New("operation not supported by executor")
 
 // An Executor runs Docker containers against a Docker host or Docker-like cluster.
 type Executor interface {
@@ -10,14 +16,43 @@ type Executor interface {
 	// Attach attaches to a container and writes stdout/stderr to the provided writers.
 	Attach(id string, stdout io.Writer, stderr io.Writer) error
 
-	// Wait blocks until a container exits, and returns its exit code.
+	// Wait blocks until a container exits, and returns its exit code. If the container was
+	// killed because it ran out of memory, ErrOOMKilled is returned.
 	Wait(id string) (int, error)
 
 	// Kill kills a container dead.
 	Kill(id string) error
 
+	// Exec runs a command in a running container, writes stdout/stderr to the provided writers,
+	// and returns the command's exit code.
+	Exec(id string, cmd []string, stdout io.Writer, stderr io.Writer) (int, error)
+
 	// Build builds a Docker image and returns the image name if successful.
-	Build(input io.Reader, output io.Writer) (string, error)
+	Build(opts BuildOpts) (string, error)
+
+	// HasImage returns true if an image is already available to run, without pulling it.
+	HasImage(image string) (bool, error)
+
+	// Tag tags an image into a repository.
+	Tag(image, repository, tag string) error
+
+	// Push pushes a tagged image to its registry, and returns the digest of the pushed image if
+	// it's known.
+	Push(opts PushOpts) (string, error)
+
+	// CreateNetwork creates an isolated network that containers can be attached to, and
+	// returns the network ID if successful.
+	CreateNetwork(name string) (string, error)
+
+	// RemoveNetwork removes a network.
+	RemoveNetwork(id string) error
+
+	// Import extracts a tar archive to a path in a container.
+	Import(id, path string, input io.Reader) error
+
+	// RemoveVolume removes a named volume, along with any stopped containers that use it. It
+	// fails if the volume is in use by a running container.
+	RemoveVolume(name string) error
 }
 
 // RunContainerOpts are options for running a new container.
@@ -38,6 +73,17 @@ type RunContainerOpts struct {
 	// in the form "container_nname:alias".
 	Links []string
 
+	// Network is the network to attach the container to.
+	Network string
+
+	// NetworkAliases is a list of hostnames that other containers on the network can use to
+	// reach the container.
+	NetworkAliases []string
+
+	// Binds is a list of named volumes to mount in the container, in the form
+	// "volume_name:/path[:ro]". Volumes that don't exist yet are created.
+	Binds []string
+
 	// VolumesFrom is a list of existing containers whose volumes should be mounted in the new
 	// container, in the form "container_name[:ro|:rw]".
 	VolumesFrom []string
@@ -51,7 +97,64 @@ type RunContainerOpts struct {
 	// Ports is a list of container ports to expose, in the format <port>/<tcp|udp>.
 	Ports []string
 
+	// Resources are limits on the resources that the container can use.
+	Resources ResourceLimits
+
 	// LocalImage specifies whether the image was built locally (so we shouldn't try to pull it
 	// from a remote repo).
 	LocalImage bool
+
+	// RegistryAuth is a list of credentials that can be used to pull the image.
+	RegistryAuth RegistryAuth
+
+	// Pull specifies when to pull the image. If it's empty, the Executor's default is used.
+	Pull PullPolicy
+
+	// PullOutput is where the output of pulling the image is written.
+	PullOutput io.Writer
+
+	// Internal specifies whether the container is one of cion's own containers, like the
+	// working directory, rather than one from a job config. Only internal containers can
+	// always run GitImage.
+	Internal bool
+}
+
+// BuildOpts are options for building a new image.
+type BuildOpts struct {
+	// Name is the name for the image. If it's empty, a unique name is generated.
+	Name string
+
+	// Input is a tar archive of the build context, including the Dockerfile.
+	Input io.Reader
+
+	// Dockerfile is the path to the Dockerfile in the build context. It defaults to
+	// "Dockerfile".
+	Dockerfile string
+
+	// BuildArgs are build-time variables for the build.
+	BuildArgs map[string]string
+
+	// Output is where the build output is written.
+	Output io.Writer
+
+	// RegistryAuth is a list of credentials that can be used to pull base images.
+	RegistryAuth RegistryAuth
+
+	// Internal specifies whether the image is built by cion itself rather than from a
+	// Dockerfile in a repo.
+	Internal bool
+}
+
+// PushOpts are options for pushing an image.
+type PushOpts struct {
+	// Repository and Tag identify the image to push, e.g. "registry.example.com/rohan/app" and
+	// "latest".
+	Repository string
+	Tag        string
+
+	// Output is where the push output is written.
+	Output io.Writer
+
+	// RegistryAuth is a list of credentials that can be used to push the image.
+	RegistryAuth RegistryAuth
 }
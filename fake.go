@@ -0,0 +1,496 @@
+package cion
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// FakeResult is the scripted outcome of a container, exec, or build run by a FakeExecutor.
+type FakeResult struct {
+	// Stdout and Stderr are written when a container is attached to, or when a command is
+	// exec'd. For builds, Stdout is written to the build output.
+	Stdout string
+	Stderr string
+
+	// ExitCode is the exit code of the container or command.
+	ExitCode int
+
+	// Err is returned instead of running the container, command, or build.
+	Err error
+
+	// OOMKilled specifies whether waiting for the container returns ErrOOMKilled.
+	OOMKilled bool
+
+	// Block specifies whether waiting for the container blocks until it's killed, like a
+	// service that runs until the job is done.
+	Block bool
+}
+
+// fakeRule scripts the result for containers or commands that match an image and command.
+type fakeRule struct {
+	image  string
+	cmd    []string
+	result FakeResult
+}
+
+// matches returns whether a rule applies to an image and command. An empty image matches any
+// image, and the rule's command matches any command that it's a prefix of.
+func (r fakeRule) matches(image string, cmd []string) bool {
+	if r.image != "" && r.image != image {
+		return false
+	}
+
+	if len(r.cmd) > len(cmd) {
+		return false
+	}
+
+	for i := range r.cmd {
+		if r.cmd[i] != cmd[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FakeContainer is a container that was run by a FakeExecutor.
+type FakeContainer struct {
+	ID     string
+	Opts   RunContainerOpts
+	Result FakeResult
+
+	// Killed and Exited record what happened to the container.
+	Killed bool
+	Exited bool
+
+	// Execs are the commands that were exec'd in the container, and Imports are the tar
+	// archives that were imported into it, by path.
+	Execs   [][]string
+	Imports map[string][]byte
+
+	killed chan struct{}
+}
+
+// FakeBuild is an image build done by a FakeExecutor.
+type FakeBuild struct {
+	Opts BuildOpts
+
+	// Context is the tar archive of the build context that was read from the build input.
+	Context []byte
+}
+
+// FakeExecutor is an Executor that doesn't run anything. It records what it's asked to do,
+// and gives containers, commands, and builds scripted results, so that jobs can be run
+// without a Docker host, e.g. to test pipelines and job configs.
+type FakeExecutor struct {
+	// Default is the result for containers and commands that don't match any script.
+	Default FakeResult
+
+	mu          sync.Mutex
+	rules       []fakeRule
+	buildRules  []fakeRule
+	containers  []*FakeContainer
+	builds      []FakeBuild
+	pushes      []PushOpts
+	images      map[string]bool
+	networks    map[string]bool
+	volumes     []string
+	nextID      int
+	byID        map[string]*FakeContainer
+	networkSeen []string
+}
+
+// NewFakeExecutor returns a FakeExecutor where every container and command exits successfully
+// without any output, until results are scripted for them.
+func NewFakeExecutor() *FakeExecutor {
+	return &FakeExecutor{
+		images:   make(map[string]bool),
+		networks: make(map[string]bool),
+		byID:     make(map[string]*FakeContainer),
+	}
+}
+
+// Script sets the result for containers and exec'd commands with an image and a command that
+// starts with cmd. An empty image matches any image, and no cmd matches any command. When
+// several scripts match, the last one added is used.
+func (e *FakeExecutor) Script(image string, cmd []string, r FakeResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.rules = append(e.rules, fakeRule{image: image, cmd: cmd, result: r})
+}
+
+// ScriptBuild sets the result for builds of an image with a name. An empty name matches any
+// build. Builds succeed if they don't match any script.
+func (e *FakeExecutor) ScriptBuild(name string, r FakeResult) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.buildRules = append(e.buildRules, fakeRule{image: name, result: r})
+}
+
+// AddImage makes an image available to run without pulling it.
+func (e *FakeExecutor) AddImage(image string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.images[image] = true
+}
+
+// Containers returns the containers that were run, in order.
+func (e *FakeExecutor) Containers() []*FakeContainer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]*FakeContainer{}, e.containers...)
+}
+
+// Ran returns the containers that were run with an image, in order.
+func (e *FakeExecutor) Ran(image string) []*FakeContainer {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var l []*FakeContainer
+	for _, c := range e.containers {
+		if c.Opts.Image == image {
+			l = append(l, c)
+		}
+	}
+
+	return l
+}
+
+// Builds returns the builds that were done, in order.
+func (e *FakeExecutor) Builds() []FakeBuild {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]FakeBuild{}, e.builds...)
+}
+
+// Pushes returns the images that were pushed, in order.
+func (e *FakeExecutor) Pushes() []PushOpts {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]PushOpts{}, e.pushes...)
+}
+
+// Networks returns the networks that were created, and whether each one still exists.
+func (e *FakeExecutor) Networks() map[string]bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m := make(map[string]bool, len(e.networkSeen))
+	for _, n := range e.networkSeen {
+		m[n] = e.networks[n]
+	}
+
+	return m
+}
+
+// RemovedVolumes returns the names of the volumes that were removed, in order.
+func (e *FakeExecutor) RemovedVolumes() []string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]string{}, e.volumes...)
+}
+
+// result returns the scripted result for an image and command. The lock must be held.
+func (e *FakeExecutor) result(rules []fakeRule, image string, cmd []string,
+	def FakeResult) FakeResult {
+
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].matches(image, cmd) {
+			return rules[i].result
+		}
+	}
+
+	return def
+}
+
+// newID returns a unique ID with a prefix. The lock must be held.
+func (e *FakeExecutor) newID(prefix string) string {
+	e.nextID++
+	return fmt.Sprintf("fake-%s-%d", prefix, e.nextID)
+}
+
+// container returns a container that was run.
+func (e *FakeExecutor) container(id string) (*FakeContainer, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, ok := e.byID[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+
+	return c, nil
+}
+
+func (e *FakeExecutor) Run(opts RunContainerOpts) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	r := e.result(e.rules, opts.Image, opts.Cmd, e.Default)
+	if r.Err != nil {
+		return "", r.Err
+	}
+
+	if opts.Network != "" && !e.networks[opts.Network] {
+		return "", fmt.Errorf("no such network: %s", opts.Network)
+	}
+
+	for _, v := range opts.VolumesFrom {
+		if _, ok := e.byID[containerName(v)]; !ok {
+			return "", fmt.Errorf("no such container: %s", v)
+		}
+	}
+
+	c := &FakeContainer{
+		ID:      e.newID("container"),
+		Opts:    opts,
+		Result:  r,
+		Imports: make(map[string][]byte),
+		killed:  make(chan struct{}),
+	}
+
+	e.containers = append(e.containers, c)
+	e.byID[c.ID] = c
+	e.images[opts.Image] = true
+
+	return c.ID, nil
+}
+
+func (e *FakeExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	if err := writeFakeOutput(c.Result, stdout, stderr); err != nil {
+		return err
+	}
+
+	// attaching to a container lasts until it exits
+	if c.Result.Block {
+		<-c.killed
+	}
+
+	return nil
+}
+
+func (e *FakeExecutor) Wait(id string) (int, error) {
+	c, err := e.container(id)
+	if err != nil {
+		return 0, err
+	}
+
+	if c.Result.Block {
+		<-c.killed
+		return 137, nil
+	}
+
+	e.mu.Lock()
+	c.Exited = true
+	e.mu.Unlock()
+
+	if c.Result.OOMKilled {
+		return 137, ErrOOMKilled
+	}
+
+	return c.Result.ExitCode, nil
+}
+
+func (e *FakeExecutor) Kill(id string) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !c.Killed {
+		c.Killed = true
+		close(c.killed)
+	}
+
+	return nil
+}
+
+func (e *FakeExecutor) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	c, err := e.container(id)
+	if err != nil {
+		return 0, err
+	}
+
+	e.mu.Lock()
+	c.Execs = append(c.Execs, cmd)
+	r := e.result(e.rules, c.Opts.Image, cmd, e.Default)
+	e.mu.Unlock()
+
+	if r.Err != nil {
+		return 0, r.Err
+	}
+
+	if err := writeFakeOutput(r, stdout, stderr); err != nil {
+		return 0, err
+	}
+
+	return r.ExitCode, nil
+}
+
+func (e *FakeExecutor) Build(opts BuildOpts) (string, error) {
+	var context []byte
+	if opts.Input != nil {
+		var err error
+		if context, err = ioutil.ReadAll(opts.Input); err != nil {
+			return "", err
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if opts.Name == "" {
+		opts.Name = e.newID("image")
+	}
+
+	r := e.result(e.buildRules, opts.Name, nil, FakeResult{})
+	if r.Err != nil {
+		return "", r.Err
+	}
+
+	if opts.Output != nil {
+		io.WriteString(opts.Output, r.Stdout)
+	}
+
+	if r.ExitCode != 0 {
+		return "", fmt.Errorf("build of %s failed", opts.Name)
+	}
+
+	e.builds = append(e.builds, FakeBuild{Opts: opts, Context: context})
+	e.images[opts.Name] = true
+
+	return opts.Name, nil
+}
+
+func (e *FakeExecutor) HasImage(image string) (bool, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.images[image], nil
+}
+
+func (e *FakeExecutor) Tag(image, repository, tag string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.images[image] {
+		return fmt.Errorf("no such image: %s", image)
+	}
+
+	e.images[repository+":"+tag] = true
+	return nil
+}
+
+// Push records the push, and returns a digest of the image name.
+func (e *FakeExecutor) Push(opts PushOpts) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	image := opts.Repository + ":" + opts.Tag
+	if !e.images[image] {
+		return "", fmt.Errorf("no such image: %s", image)
+	}
+
+	e.pushes = append(e.pushes, opts)
+
+	h := sha256.Sum256([]byte(image))
+	return "sha256:" + hex.EncodeToString(h[:]), nil
+}
+
+func (e *FakeExecutor) CreateNetwork(name string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	id := e.newID("network")
+	e.networks[id] = true
+	e.networkSeen = append(e.networkSeen, id)
+
+	return id, nil
+}
+
+func (e *FakeExecutor) RemoveNetwork(id string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if !e.networks[id] {
+		return fmt.Errorf("no such network: %s", id)
+	}
+
+	e.networks[id] = false
+	return nil
+}
+
+func (e *FakeExecutor) Import(id, path string, input io.Reader) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadAll(input)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c.Imports[path] = b
+	return nil
+}
+
+func (e *FakeExecutor) RemoveVolume(name string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.volumes = append(e.volumes, name)
+	return nil
+}
+
+// writeFakeOutput writes the output of a scripted result.
+func writeFakeOutput(r FakeResult, stdout io.Writer, stderr io.Writer) error {
+	if stdout != nil && r.Stdout != "" {
+		if _, err := io.WriteString(stdout, r.Stdout); err != nil {
+			return err
+		}
+	}
+
+	if stderr != nil && r.Stderr != "" {
+		if _, err := io.WriteString(stderr, r.Stderr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// containerName returns the container name from a VolumesFrom entry, without any ":ro" or
+// ":rw" suffix.
+func containerName(volumesFrom string) string {
+	if i := strings.LastIndex(volumesFrom, ":"); i >= 0 {
+		return volumesFrom[:i]
+	}
+
+	return volumesFrom
+}
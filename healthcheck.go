@@ -0,0 +1,227 @@
+package cion
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultHealthcheckTimeout is how long to wait for a service to become ready if its
+	// healthcheck doesn't specify a timeout.
+	DefaultHealthcheckTimeout = time.Minute
+
+	// DefaultHealthcheckInterval is how often a healthcheck is retried if it doesn't specify an
+	// interval.
+	DefaultHealthcheckInterval = time.Second
+)
+
+// HealthcheckConfig is a check for whether a service container is ready, defined in .cion.yml.
+// The check either connects to a port on the service, optionally making an HTTP request, or
+// runs a command in the service container.
+type HealthcheckConfig struct {
+	// Port is the service port to connect to, in the format <port>[/tcp].
+	Port string
+
+	// Path is an HTTP path to request from the port. If it's empty, the check only makes a TCP
+	// connection.
+	Path string
+
+	// Cmd is a command to run in the service container. The service is ready once it exits
+	// successfully.
+	Cmd []string
+
+	// Timeout is how long to wait for the service to become ready, e.g. "2m".
+	Timeout string
+
+	// Interval is how long to wait between checks, e.g. "5s".
+	Interval string
+}
+
+// waitForServices waits until each service with a healthcheck is ready, checking all of the
+// services at once. An error is returned if any service doesn't become ready before its
+// healthcheck times out.
+func waitForServices(jc JobConfig, services map[string]string, network string, e Executor,
+	jl io.Writer) error {
+
+	// healthchecks are checked before waiting for any of them
+	names := make([]string, 0, len(jc.Services))
+	for s, cc := range jc.Services {
+		if hc := cc.Healthcheck; hc != nil {
+			if _, _, err := hc.durations(); err != nil {
+				return fmt.Errorf("invalid healthcheck for service %s: %v", s, err)
+			} else if len(hc.Cmd) == 0 && hc.Port == "" {
+				return fmt.Errorf("invalid healthcheck for service %s: needs a port or command",
+					s)
+			}
+
+			names = append(names, s)
+		}
+	}
+	sort.Strings(names)
+
+	lw := &lockedWriter{w: jl}
+	errs := make([]error, len(names))
+
+	var wg sync.WaitGroup
+	for i, s := range names {
+		wg.Add(1)
+		go func(i int, s string) {
+			defer wg.Done()
+			errs[i] = waitForService(s, *jc.Services[s].Healthcheck, services[s], network, e, lw)
+		}(i, s)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// waitForService waits until a service is ready.
+func waitForService(s string, hc HealthcheckConfig, sc, network string, e Executor,
+	jl io.Writer) error {
+
+	timeout, interval, _ := hc.durations()
+	fmt.Fprintf(jl, "CION: waiting up to %v for service %s to be ready\n", timeout, s)
+
+	var err error
+	if len(hc.Cmd) > 0 {
+		err = waitForExec(sc, hc.Cmd, timeout, interval, e)
+	} else {
+		err = waitForPort(s, network, hc, timeout, interval, e)
+	}
+
+	if err != nil {
+		return fmt.Errorf("service %s did not become ready: %v", s, err)
+	}
+
+	fmt.Fprintf(jl, "CION: service %s is ready\n", s)
+	return nil
+}
+
+// durations returns the timeout and interval of a healthcheck. Both have to be positive, since
+// an interval of zero would retry the check as fast as it can.
+func (hc HealthcheckConfig) durations() (time.Duration, time.Duration, error) {
+	timeout := DefaultHealthcheckTimeout
+	interval := DefaultHealthcheckInterval
+	var err error
+
+	if hc.Timeout != "" {
+		if timeout, err = time.ParseDuration(hc.Timeout); err != nil {
+			return 0, 0, err
+		} else if timeout <= 0 {
+			return 0, 0, fmt.Errorf("timeout %s must be positive", hc.Timeout)
+		}
+	}
+
+	if hc.Interval != "" {
+		if interval, err = time.ParseDuration(hc.Interval); err != nil {
+			return 0, 0, err
+		} else if interval <= 0 {
+			return 0, 0, fmt.Errorf("interval %s must be positive", hc.Interval)
+		}
+	}
+
+	return timeout, interval, nil
+}
+
+// lockedWriter serializes the writes of the healthchecks that run at the same time.
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (lw *lockedWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+
+	return lw.w.Write(p)
+}
+
+// waitForExec runs a command in a service container until it exits successfully.
+func waitForExec(sc string, cmd []string, timeout, interval time.Duration, e Executor) error {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		r, err := e.Exec(sc, cmd, nil, nil)
+		if err == nil && r == 0 {
+			return nil
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			if err == nil {
+				err = fmt.Errorf("exit status %d from healthcheck command", r)
+			}
+
+			return fmt.Errorf("timed out after %v: %v", timeout, err)
+		}
+
+		time.Sleep(interval)
+	}
+}
+
+// waitForPort runs a probe container on the job's network, which retries connecting to the
+// service port until it succeeds.
+func waitForPort(s, network string, hc HealthcheckConfig, timeout, interval time.Duration,
+	e Executor) error {
+
+	port := strings.SplitN(hc.Port, "/", 2)[0]
+
+	check := `nc -z -w 1 "$SERVICE" "$PORT"`
+	if hc.Path != "" {
+		check = `curl -fs -o /dev/null "http://$SERVICE:$PORT$HEALTHCHECK_PATH"`
+	}
+
+	secs := int(interval / time.Second)
+	if secs < 1 {
+		secs = 1
+	}
+
+	opts := RunContainerOpts{
+		Image: GitImage,
+		Cmd: []string{
+			"sh", "-c",
+			"until " + check + " 2>/dev/null; do sleep " + fmt.Sprint(secs) + "; done",
+		},
+		Env: []string{
+			"SERVICE=" + s,
+			"PORT=" + port,
+			"HEALTHCHECK_PATH=" + hc.Path,
+		},
+		Network:  network,
+		Pull:     PullIfNotPresent,
+		Internal: true,
+	}
+
+	c, err := e.Run(opts)
+	if err != nil {
+		return err
+	}
+	defer e.Kill(c)
+
+	done := make(chan error, 1)
+	go func() {
+		if r, err := e.Wait(c); err != nil {
+			done <- err
+		} else if r != 0 {
+			done <- fmt.Errorf("exit status %d from healthcheck container", r)
+		} else {
+			done <- nil
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("timed out after %v", timeout)
+	}
+}
@@ -0,0 +1,65 @@
+package cion
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthcheckDurations(t *testing.T) {
+	tests := []struct {
+		hc                HealthcheckConfig
+		timeout, interval time.Duration
+		err               bool
+	}{
+		{hc: HealthcheckConfig{}, timeout: time.Minute, interval: time.Second},
+		{hc: HealthcheckConfig{Timeout: "2m", Interval: "5s"}, timeout: 2 * time.Minute,
+			interval: 5 * time.Second},
+		{hc: HealthcheckConfig{Interval: "0s"}, err: true},
+		{hc: HealthcheckConfig{Interval: "-1s"}, err: true},
+		{hc: HealthcheckConfig{Timeout: "0"}, err: true},
+		{hc: HealthcheckConfig{Timeout: "soon"}, err: true},
+	}
+
+	for _, tt := range tests {
+		timeout, interval, err := tt.hc.durations()
+		if tt.err {
+			if err == nil {
+				t.Errorf("%+v: durations() succeeded", tt.hc)
+			}
+		} else if err != nil || timeout != tt.timeout || interval != tt.interval {
+			t.Errorf("%+v: durations() = %v, %v, %v", tt.hc, timeout, interval, err)
+		}
+	}
+}
+
+func TestWaitForServicesConcurrently(t *testing.T) {
+	hc := &HealthcheckConfig{Port: "5432", Timeout: "200ms"}
+	jc := JobConfig{Services: map[string]ContainerConfig{
+		"a": {Image: "postgres", Healthcheck: hc},
+		"b": {Image: "postgres", Healthcheck: hc},
+		"c": {Image: "postgres", Healthcheck: hc},
+	}}
+
+	// the probes never succeed, so each healthcheck waits until it times out
+	fe := NewFakeExecutor()
+	fe.Script(GitImage, []string{"sh"}, FakeResult{Block: true})
+	network, err := fe.CreateNetwork("net")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = waitForServices(jc, map[string]string{}, network, fe, ioutil.Discard)
+	if err == nil || !strings.Contains(err.Error(), "service a did not become ready") {
+		t.Errorf("err = %v, want a timeout for service a", err)
+	}
+
+	if d := time.Since(start); d >= 500*time.Millisecond {
+		t.Errorf("waiting for 3 services took %v, want them to be waited for at once", d)
+	}
+	if probes := fe.Ran(GitImage); len(probes) != 3 {
+		t.Errorf("ran %d probes, want 3", len(probes))
+	}
+}
@@ -0,0 +1,188 @@
+package cion
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// DefaultImageTags are the tags that an image is pushed with if its config doesn't list any.
+var DefaultImageTags = []string{"$SHA"}
+
+var (
+	invalidTagRegexp = regexp.MustCompile("[^A-Za-z0-9_.-]")
+	digestRegexp     = regexp.MustCompile(`digest: (sha256:[0-9a-f]{64})`)
+)
+
+// ImageConfig is an image to build from a Dockerfile in the repo and push once the build
+// stage succeeds, defined in .cion.yml.
+type ImageConfig struct {
+	// Name is the repository to push the image to, e.g. "registry.example.com/rohan/app".
+	Name string
+
+	// Dockerfile is the path to the Dockerfile in the repo, which defaults to "Dockerfile".
+	// Context is the path to the build context, which defaults to the root of the repo, and
+	// BuildArgs are build-time variables for the build.
+	Dockerfile string
+	Context    string
+	BuildArgs  map[string]string `yaml:"build_args"`
+
+	// Tags are the tags to push the image with. They can refer to $BRANCH, $TAG, $SHA, $NUMBER,
+	// and job parameters.
+	Tags []string
+}
+
+// PublishedImage is a record of an image that was pushed by a job.
+type PublishedImage struct {
+	Name   string
+	Tag    string
+	Digest string
+}
+
+// validate returns an error if the image config can't be published.
+func (ic ImageConfig) validate() error {
+	if ic.Name == "" {
+		return errors.New("images need a name")
+	}
+
+	// the name is a repository, and the tags that it's pushed with are listed separately
+	if strings.Contains(ic.Name, "@") ||
+		strings.LastIndex(ic.Name, ":") > strings.LastIndex(ic.Name, "/") {
+
+		return fmt.Errorf("image name %s can't include a tag or digest", ic.Name)
+	}
+
+	return nil
+}
+
+// publishImages builds each image in the job config from the working directory, and pushes it
+// with its tags. The pushed images are recorded on the job. Images are only pushed with the
+// registry credentials that are limited to the job's repo.
+func publishImages(r JobRequest, jc JobConfig, wd string, jl io.Writer) error {
+	j, e := r.Job, r.Executor
+	auth := r.RegistryAuth.forPush(j.Owner, j.Repo)
+
+	for _, ic := range jc.Images {
+		if err := ic.validate(); err != nil {
+			return err
+		}
+
+		dockerfile := ic.Dockerfile
+		if dockerfile == "" {
+			dockerfile = path.Join(ic.Context, "Dockerfile")
+		}
+
+		context := path.Clean(ic.Context)
+		rel, err := contextPath(context, dockerfile)
+		if err != nil {
+			return err
+		}
+
+		var df bytes.Buffer
+		if err := readFromWorkdir(wd, e, &df, jl, "cat", dockerfile); err != nil {
+			return fmt.Errorf("unable to read %s: %v", dockerfile, err)
+		}
+
+		if err := r.Policy.checkDockerfile(df.Bytes(), ic.BuildArgs); err != nil {
+			return fmt.Errorf("%s violates policy: %v", dockerfile, err)
+		}
+
+		tags := ic.imageTags(j)
+		image := ic.Name + ":" + tags[0]
+
+		fmt.Fprintf(jl, "CION: building image %s\n", image)
+		if err := buildFromWorkdir(image, context, rel, ic.BuildArgs, wd, e, jl); err != nil {
+			return fmt.Errorf("unable to build image %s: %v", image, err)
+		}
+
+		for _, t := range tags {
+			if err := e.Tag(image, ic.Name, t); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(jl, "CION: pushing image %s:%s\n", ic.Name, t)
+			digest, err := e.Push(PushOpts{
+				Repository:   ic.Name,
+				Tag:          t,
+				Output:       jl,
+				RegistryAuth: auth,
+			})
+			if err != nil {
+				return fmt.Errorf("unable to push image %s:%s: %v", ic.Name, t, err)
+			}
+
+			j.Images = append(j.Images, PublishedImage{Name: ic.Name, Tag: t, Digest: digest})
+			if err := r.Store.Save(j); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// imageTags returns the tags for an image pushed by a job, with any variables expanded and
+// any characters that aren't allowed in tags replaced.
+func (ic ImageConfig) imageTags(j *Job) []string {
+	templates := ic.Tags
+	if len(templates) == 0 {
+		templates = DefaultImageTags
+	}
+
+	var tags []string
+	seen := make(map[string]bool)
+
+	for _, tmpl := range templates {
+		t := expandJobVars(j, tmpl)
+		t = invalidTagRegexp.ReplaceAllString(t, "-")
+		t = strings.TrimLeft(t, ".-")
+		if len(t) > 128 {
+			t = t[:128]
+		}
+
+		// tags that expand to nothing (e.g. $TAG for a branch job) are skipped
+		if t != "" && !seen[t] {
+			seen[t] = true
+			tags = append(tags, t)
+		}
+	}
+
+	if len(tags) == 0 {
+		tags = append(tags, fmt.Sprintf("job-%d", j.Number))
+	}
+
+	return tags
+}
+
+// expandJobVars expands references to $BRANCH, $TAG, $SHA, $NUMBER, and job parameters in a
+// string.
+func expandJobVars(j *Job, s string) string {
+	vars := map[string]string{
+		"BRANCH": j.Branch,
+		"TAG":    j.Tag,
+		"SHA":    j.SHA,
+		"NUMBER": fmt.Sprint(j.Number),
+	}
+
+	return os.Expand(s, func(k string) string {
+		if v, ok := vars[k]; ok {
+			return v
+		}
+
+		return j.Parameters[k]
+	})
+}
+
+// parsePushDigest returns the digest of a pushed image from the output of the push.
+func parsePushDigest(output string) string {
+	if m := digestRegexp.FindStringSubmatch(output); m != nil {
+		return m[1]
+	}
+
+	return ""
+}
@@ -2,6 +2,7 @@ package cion
 
 import (
 	"bytes"
+	"code.google.com/p/go-uuid/uuid"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/pkg/archive"
@@ -12,7 +13,10 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -28,6 +32,8 @@ const (
 	ArtifactsDir = "/cion/artifacts"
 )
 
+var nonAlphanumericRegexp = regexp.MustCompile("[^A-Za-z0-9]")
+
 // JobRequest defines a job that needs to be run and the dependencies needed to run it.
 type JobRequest struct {
 	Job      *Job
@@ -36,8 +42,72 @@ type JobRequest struct {
 
 	GitHubClientID string
 	GitHubSecret   string
+	GitHubToken    string
+
+	// GitHubDeployments specifies whether releases to an environment should be recorded with
+	// the GitHub Deployments API.
+	GitHubDeployments bool
+
+	// Tracker tracks the job while it runs so that it can be controlled through the API.
+	Tracker *JobTracker
+
+	// Policy restricts the options that the job config can use.
+	Policy *Policy
+
+	// RegistryAuth is a list of credentials for pulling images from Docker registries.
+	RegistryAuth RegistryAuth
+
+	// MaxCacheSize is the maximum total size of the caches for the job's repo, in bytes. If it's
+	// zero, caches aren't limited.
+	MaxCacheSize int64
+
+	// Pool is the pool of Docker hosts that the job runs on, if any. The job is pinned to a host
+	// in the pool, which runs its containers instead of the Executor.
+	Pool *PoolExecutor
+
+	// Server is the cion server that an agent runs the job for, if any. The server starts the
+	// job's downstream jobs, after checking them against the job's config.
+	Server *RemoteJobStore
+
+	// baseExecutor is the Executor before it was wrapped for this job, which downstream jobs
+	// are run with.
+	baseExecutor Executor
+
+	// placement is the job's place in a PoolExecutor, if it's run with one.
+	placement *poolJob
 }
 
+// JobStatus is the current state of a job.
+type JobStatus string
+
+const (
+	JobQueued           JobStatus = "queued"
+	JobRunning          JobStatus = "running"
+	JobAwaitingApproval JobStatus = "awaiting_approval"
+	JobWaiting          JobStatus = "waiting"
+	JobSucceeded        JobStatus = "succeeded"
+	JobFailed           JobStatus = "failed"
+	JobRejected         JobStatus = "rejected"
+	JobSuperseded       JobStatus = "superseded"
+)
+
+// Trigger identifies what caused a job to be created.
+type Trigger string
+
+const (
+	// TriggerManual is a job started through the API.
+	TriggerManual Trigger = "manual"
+
+	// TriggerRebuild is a job started as a rebuild of an existing job.
+	TriggerRebuild Trigger = "rebuild"
+
+	// TriggerLocal is a job started from a local path with RunLocal.
+	TriggerLocal Trigger = "local"
+
+	// TriggerUpstream is a job started by the success of a job in another repo.
+	TriggerUpstream Trigger = "upstream"
+)
+
 // Job represents the job data that should be persisted to a JobStore.
 type Job struct {
 	Number uint64
@@ -45,14 +115,85 @@ type Job struct {
 	Owner  string
 	Repo   string
 	Branch string
+	Tag    string
 	SHA    string
 
+	// CommitMessage and CommitAuthor are fetched from GitHub along with the SHA.
+	CommitMessage string
+	CommitAuthor  string
+
 	LocalPath string
 
+	// Trigger is what caused the job to be created, and TriggeredBy is the user or upstream
+	// job that initiated it. Users that weren't authenticated start with UnverifiedPrefix.
+	Trigger     Trigger
+	TriggeredBy string
+
+	// Parameters are the parameters provided when the job was triggered. Once the job config
+	// has been parsed, they are validated and defaults are filled in.
+	Parameters map[string]string
+
+	// RebuildOf is the number of the job that this job is a rebuild of, if any.
+	RebuildOf uint64
+
+	// Services are the names of the service containers started for the job, which each have
+	// their own log stream.
+	Services []string
+
 	StartedAt *time.Time
 	EndedAt   *time.Time
 
+	Status  JobStatus
 	Success bool
+
+	// Error is the error that caused the job to fail, if any.
+	Error string
+
+	// ApprovalDeadline is when a job waiting for approval of a manual stage will give up, and
+	// Approval is the decision on whether it could continue.
+	ApprovalDeadline *time.Time
+	Approval         *Approval
+
+	// SupersededBy is the number of the newer job that superseded this one, if any.
+	SupersededBy uint64
+
+	// Images are the images that were pushed by the job.
+	Images []PublishedImage
+
+	// Artifacts specifies whether the job's artifacts are kept in the JobStore, and
+	// Dependencies are the upstream jobs whose artifacts the job used.
+	Artifacts    bool
+	Dependencies []JobRef
+
+	// Upstream is the job whose success triggered this job, if any, and UpstreamChain is the
+	// whole chain of jobs that led to this one, starting with the first. Downstream are the
+	// jobs that this job triggered.
+	Upstream      *JobRef
+	UpstreamChain []JobRef
+	Downstream    []JobRef
+
+	// Agent is the name of the remote agent that ran the job, if any.
+	Agent string
+}
+
+// JobFilter restricts the jobs returned by JobStore.List. Empty fields match any job.
+type JobFilter struct {
+	Branch      string
+	Tag         string
+	SHA         string
+	Trigger     Trigger
+	TriggeredBy string
+	Status      JobStatus
+}
+
+// Match returns true if the job satisfies the filter.
+func (f JobFilter) Match(j *Job) bool {
+	return (f.Branch == "" || f.Branch == j.Branch) &&
+		(f.Tag == "" || f.Tag == j.Tag) &&
+		(f.SHA == "" || f.SHA == j.SHA) &&
+		(f.Trigger == "" || f.Trigger == j.Trigger) &&
+		(f.TriggeredBy == "" || f.TriggeredBy == j.TriggeredBy) &&
+		(f.Status == "" || f.Status == j.Status)
 }
 
 // JobConfig is the job configuration defined by .cion.yml.
@@ -60,6 +201,41 @@ type JobConfig struct {
 	Build    ContainerConfig
 	Release  ContainerConfig
 	Services map[string]ContainerConfig
+
+	// Parameters declares the parameters that can be provided when triggering a job. They are
+	// passed to the build and release containers as environment variables.
+	Parameters map[string]ParameterConfig
+
+	// Retry is the number of times a failed build or release stage is retried before the
+	// job is marked as failed. Retries run in the same working directory, so they see any
+	// files that the failed attempt changed.
+	Retry int
+
+	// CancelSuperseded specifies whether a new job for a branch cancels any unfinished jobs
+	// for older commits on the same branch.
+	CancelSuperseded bool `yaml:"cancel_superseded"`
+
+	// Images are images to build and push once the build stage succeeds.
+	Images []ImageConfig
+
+	// Cache declares paths in the build container that are cached across jobs.
+	Cache *CacheConfig
+
+	// Dependencies are other repos whose artifacts are mounted in the build container.
+	Dependencies []DependencyConfig
+
+	// Triggers are downstream repos to start jobs for when a job succeeds, in the form
+	// owner/repo[@branch].
+	Triggers []string
+
+	// TriggerBranches are patterns like "release/*" for the branches whose jobs start the
+	// Triggers. If it's empty, only jobs for master start them. Jobs for tags and commits
+	// never do.
+	TriggerBranches []string `yaml:"trigger_branches"`
+
+	// HostLabels are labels that the Docker host for the job must have, like "arch: arm64",
+	// when jobs run on a pool of hosts.
+	HostLabels map[string]string `yaml:"host_labels"`
 }
 
 // ContainerConfig is a container configuration defined in .cion.yml.
@@ -69,10 +245,70 @@ type ContainerConfig struct {
 	Env        []string
 	Ports      []string
 	Privileged bool
+
+	// Manual specifies whether the stage waits to be approved through the API before it runs.
+	Manual bool
+
+	// ApprovalTimeout is how long a manual stage waits for approval, e.g. "30m".
+	ApprovalTimeout string `yaml:"approval_timeout"`
+
+	// Concurrency is the name of a concurrency group for the stage. Only one job for the repo
+	// runs a stage in the group at a time, and other jobs wait for it to finish.
+	Concurrency string
+
+	// Supersede specifies whether a job waiting for the concurrency group gives up when a
+	// newer job starts waiting for it.
+	Supersede bool
+
+	// CPU, Memory, MemorySwap, and PidsLimit are resource limits for the container, which
+	// are clamped to the server's maximums. Memory limits are amounts like "512m" or "2g", and
+	// MemorySwap can be "-1" for unlimited swap. Swap is only limited along with memory.
+	CPU        float64
+	Memory     string
+	MemorySwap string `yaml:"memory_swap"`
+	PidsLimit  int64  `yaml:"pids_limit"`
+
+	// Healthcheck is a check for whether a service container is ready. The build doesn't start
+	// until all services are ready.
+	Healthcheck *HealthcheckConfig
+
+	// Pull specifies when to pull the image: "always", "if-not-present", or "never". If it's
+	// empty, the server's default is used.
+	Pull PullPolicy
+
+	// Dockerfile is the path to a Dockerfile in the repo to build the image from, instead of
+	// using a prebuilt image. Context is the path to the build context, which defaults to the
+	// root of the repo, and BuildArgs are build-time variables for the build.
+	Dockerfile string
+	Context    string
+	BuildArgs  map[string]string `yaml:"build_args"`
+
+	// localImage is set once the image has been built from the Dockerfile.
+	localImage bool
+
+	// Environment is the name of the environment that the release container deploys to. It
+	// may refer to job parameters, e.g. "$DEPLOY_ENV".
+	Environment string
+}
+
+// containers returns all of the containers in the job config, keyed by a description like
+// "build" or "service docker".
+func (jc JobConfig) containers() map[string]ContainerConfig {
+	m := map[string]ContainerConfig{
+		"build":   jc.Build,
+		"release": jc.Release,
+	}
+	for s, cc := range jc.Services {
+		m["service "+s] = cc
+	}
+
+	return m
 }
 
-func NewJob(owner, repo, branch, sha string) *Job {
-	if branch == "" && sha == "" {
+// NewJob creates a job for a branch, tag, or commit sha. If none of them are specified, the job
+// is for the master branch.
+func NewJob(owner, repo, branch, tag, sha string) *Job {
+	if branch == "" && tag == "" && sha == "" {
 		branch = "master"
 	}
 
@@ -81,6 +317,7 @@ func NewJob(owner, repo, branch, sha string) *Job {
 		Owner:     owner,
 		Repo:      repo,
 		Branch:    branch,
+		Tag:       tag,
 		SHA:       sha,
 		StartedAt: &t,
 	}
@@ -88,38 +325,72 @@ func NewJob(owner, repo, branch, sha string) *Job {
 
 // Run executes a JobRequest and logs the results to the JobStore.
 func (r JobRequest) Run() {
-	jl := r.Store.GetLogger(r.Job)
+	r.Job.Status = JobRunning
+	if err := r.Store.Save(r.Job); err != nil {
+		log.Println("error saving job:", err)
+	}
 
-	var c *http.Client
-	if r.GitHubClientID != "" {
-		t := &github.UnauthenticatedRateLimitedTransport{
-			ClientID:     r.GitHubClientID,
-			ClientSecret: r.GitHubSecret,
-		}
+	r.baseExecutor = r.Executor
 
-		c = t.Client()
+	if r.Pool != nil {
+		r.placement = r.Pool.pin()
+		defer r.placement.release()
+
+		r.Executor = r.placement
 	}
 
-	gh := github.NewClient(c)
+	if r.Tracker != nil {
+		r.Tracker.add(r.Job)
+		defer r.Tracker.remove(r.Job)
 
-	if r.Job.LocalPath == "" && r.Job.SHA == "" {
-		// figure out the latest commit sha for the branch
-		com, _, err := gh.Repositories.GetCommit(r.Job.Owner, r.Job.Repo, r.Job.Branch)
-		if err != nil {
+		r.Executor = r.Tracker.executor(r.Job, r.Executor)
+	}
+
+	if len(r.RegistryAuth) > 0 {
+		r.Executor = authExecutor{
+			Executor:   r.Executor,
+			auth:       r.RegistryAuth.forRepo(r.Job.Owner, r.Job.Repo),
+			restricted: r.RegistryAuth.restricted(r.Job.Owner, r.Job.Repo),
+		}
+	}
+
+	jl := r.Store.GetLogger(r.Job)
+
+	gh := newGitHubClient(r.GitHubToken, r.GitHubClientID, r.GitHubSecret)
+
+	var err error
+	if r.Job.LocalPath == "" {
+		if err = resolveCommit(r.Job, gh); err != nil {
 			log.Println("couldn't determine SHA for job:", err)
-			io.WriteString(jl, fmt.Sprintf("ERROR: %v", err))
-			return
+		} else {
+			r.Store.Save(r.Job)
 		}
+	}
 
-		r.Job.SHA = *com.SHA
-		r.Store.Save(r.Job)
+	if err == nil {
+		err = runJob(r, jl, gh)
 	}
 
-	if err := runJob(r.Job, r.Executor, r.Store, jl, gh); err != nil {
+	if err != nil {
 		log.Println("job execution error:", err)
 		io.WriteString(jl, fmt.Sprintf("ERROR: %v", err))
+
+		r.Job.Error = err.Error()
+		if r.Job.Status != JobRejected && r.Job.Status != JobSuperseded {
+			r.Job.Status = JobFailed
+		}
 	} else {
 		r.Job.Success = true
+		r.Job.Status = JobSucceeded
+	}
+
+	if r.Tracker != nil {
+		if n := r.Tracker.supersededBy(r.Job); n != 0 {
+			jl.WriteStep(fmt.Sprintf("superseded by job #%d", n))
+			r.Job.Success = false
+			r.Job.Status = JobSuperseded
+			r.Job.SupersededBy = n
+		}
 	}
 
 	t := time.Now()
@@ -130,29 +401,191 @@ func (r JobRequest) Run() {
 	}
 }
 
-func runJob(j *Job, e Executor, s JobStore, jl JobLogger, gh *github.Client) error {
-	jl.WriteStep("fetch sources")
+// newGitHubClient returns a GitHub client that authenticates with a token, or with an OAuth
+// application's client ID and secret if there's no token.
+func newGitHubClient(token, clientID, secret string) *github.Client {
+	var c *http.Client
+	if token != "" {
+		c = &http.Client{Transport: tokenTransport{token: token}}
+	} else if clientID != "" {
+		t := &github.UnauthenticatedRateLimitedTransport{
+			ClientID:     clientID,
+			ClientSecret: secret,
+		}
 
-	var wd string
-	var err error
+		c = t.Client()
+	}
 
-	if j.LocalPath == "" {
-		wd, err = startWorkdirContainer(j.Owner, j.Repo, j.SHA, e, jl, gh)
-	} else {
-		wd, err = startLocalWorkdirContainer(j.LocalPath, e, jl)
+	return github.NewClient(c)
+}
+
+// resolveCommit figures out the commit for a job, which is either the commit for the tag or the
+// latest commit for the branch if we don't have a sha yet.
+func resolveCommit(j *Job, gh *github.Client) error {
+	ref := j.SHA
+	if ref == "" && j.Tag != "" {
+		sha, err := resolveTag(j.Owner, j.Repo, j.Tag, gh)
+		if err != nil {
+			return err
+		}
+
+		ref = sha
+	} else if ref == "" {
+		ref = j.Branch
 	}
+
+	com, _, err := gh.Repositories.GetCommit(j.Owner, j.Repo, ref)
 	if err != nil {
 		return err
 	}
 
+	j.SHA = *com.SHA
+	if com.Commit != nil {
+		if com.Commit.Message != nil {
+			j.CommitMessage = *com.Commit.Message
+		}
+		if com.Commit.Author != nil && com.Commit.Author.Name != nil {
+			j.CommitAuthor = *com.Commit.Author.Name
+		}
+	}
+
+	return nil
+}
+
+// tokenTransport is an http.RoundTripper that authenticates GitHub API requests with an access
+// token.
+type tokenTransport struct {
+	token string
+}
+
+func (t tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// requests must not be modified by a RoundTripper, so set the header on a copy
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+
+	r.Header.Set("Authorization", "token "+t.token)
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// resolveTag returns the sha of the commit that a tag points to.
+func resolveTag(owner, repo, tag string, gh *github.Client) (string, error) {
+	ref, _, err := gh.Git.GetRef(owner, repo, "tags/"+tag)
+	if err != nil {
+		return "", err
+	}
+
+	obj := ref.Object
+	if obj != nil && obj.Type != nil && *obj.Type == "tag" {
+		// annotated tags point to a tag object, which in turn points to the commit
+		t, _, err := gh.Git.GetTag(owner, repo, *obj.SHA)
+		if err != nil {
+			return "", err
+		}
+
+		obj = t.Object
+	}
+
+	if obj == nil || obj.SHA == nil {
+		return "", errors.New("no commit found for tag " + tag)
+	}
+
+	return *obj.SHA, nil
+}
+
+func runJob(r JobRequest, jl JobLogger, gh *github.Client) error {
+	j, e, s := r.Job, r.Executor, r.Store
+
+	fetch := func() (string, error) {
+		if j.LocalPath == "" {
+			return startWorkdirContainer(j.Owner, j.Repo, j.SHA, e, jl, gh)
+		}
+
+		return startLocalWorkdirContainer(j.LocalPath, e, jl)
+	}
+
+	jl.WriteStep("fetch sources")
+	wd, err := fetch()
+	if err != nil {
+		return err
+	}
+
+	// the working directory is removed once the job is done, on executors that remove the
+	// volumes of containers that are killed
+	defer func() { e.Kill(wd) }()
+
 	jl.WriteStep("parse job config")
-	jc, err := parseJobConfig(wd, e, jl)
+	jc, err := parseJobConfig(j, wd, e, jl, r.Policy)
 	if err != nil {
 		return err
 	}
 
+	if r.placement != nil && len(jc.HostLabels) > 0 {
+		moved, err := r.placement.require(jc.HostLabels)
+		if err != nil {
+			return err
+		}
+
+		// the sources are fetched again on the new host, and the working directory on the
+		// previous host isn't needed anymore
+		if moved {
+			e.Kill(wd)
+
+			jl.WriteStep("fetch sources on " + r.placement.hostName())
+			if wd, err = fetch(); err != nil {
+				return err
+			}
+		}
+	}
+
+	params, err := resolveParameters(jc.Parameters, j.Parameters)
+	if err != nil {
+		return err
+	}
+
+	j.Parameters = params
+	if err := s.Save(j); err != nil {
+		return err
+	}
+	// parameters are set as environment variables, which the policy has to allow
+	env := parameterEnv(j.Parameters)
+	if err := r.Policy.checkEnv(j.Owner, j.Repo, env); err != nil {
+		return fmt.Errorf("parameters violate policy: %v", err)
+	}
+
+	if jc.CancelSuperseded && j.Branch != "" {
+		supersedeOlderJobs(r, jl)
+	}
+
+	if jc.Build.Dockerfile != "" || jc.Release.Dockerfile != "" {
+		jl.WriteStep("build images")
+
+		if jc.Build.Dockerfile != "" {
+			if jc.Build, err = buildStageImage(j, "build", jc.Build, wd, e, r.Policy,
+				jl); err != nil {
+				return err
+			}
+		}
+
+		if jc.Release.Dockerfile != "" {
+			if jc.Release, err = buildStageImage(j, "release", jc.Release, wd, e, r.Policy,
+				jl); err != nil {
+				return err
+			}
+		}
+	}
+
 	jl.WriteStep("start services")
-	services, err := startServices(*jc, wd, e)
+	network, err := e.CreateNetwork("cion-" + uuid.New())
+	if err != nil {
+		return err
+	}
+	defer e.RemoveNetwork(network)
+
+	services, err := startServices(*jc, network, e, jl)
 	for _, sc := range services {
 		// ensure any started services are shut down when we're done
 		defer e.Kill(sc)
@@ -161,17 +594,178 @@ func runJob(j *Job, e Executor, s JobStore, jl JobLogger, gh *github.Client) err
 		return err
 	}
 
-	jl.WriteStep("build")
-	if err := run(jc.Build, services, wd, e, jl); err != nil {
+	for name := range services {
+		j.Services = append(j.Services, name)
+	}
+	sort.Strings(j.Services)
+	if err := s.Save(j); err != nil {
 		return err
 	}
 
+	if err := waitForServices(*jc, services, network, e, jl); err != nil {
+		return err
+	}
+
+	// services are reachable on the network by name, but we also provide the environment
+	// variables that Docker links would have, for compatibility
+	env = append(env, linkEnv(jc.Services)...)
+
+	// the build container uses the volumes from the dependencies and cache containers, which
+	// each include the volumes of the container before them, starting with the working
+	// directory
+	buildWd := wd
+	buildEnv := env
+	if len(jc.Dependencies) > 0 {
+		jl.WriteStep("fetch dependencies")
+		if buildWd, err = fetchDependencies(r, jc.Dependencies, buildWd, jl); err != nil {
+			return err
+		}
+		defer e.Kill(buildWd)
+
+		buildEnv = append(append([]string(nil), env...), "DEPENDENCIES_DIR="+DependenciesDir)
+	}
+
+	var cacheKey string
+	if jc.Cache != nil && len(jc.Cache.Paths) > 0 {
+		jl.WriteStep("restore cache")
+		if cacheKey, err = jobCacheKey(j, *jc.Cache, wd, e, jl); err != nil {
+			return err
+		}
+
+		if buildWd, _, err = restoreCache(r, *jc.Cache, cacheKey, buildWd, jl); err != nil {
+			return err
+		}
+		defer e.Kill(buildWd)
+	}
+
+	if err := gateStage(r, "build", jc.Build, jl, func() error {
+		return runStage("build", jc.Build, jc.Retry, buildEnv, network, buildWd, e, jl)
+	}); err != nil {
+		return err
+	}
+
+	if cacheKey != "" {
+		jl.WriteStep("save cache")
+		if err := saveCache(r, *jc.Cache, cacheKey, buildWd, jl); err != nil {
+			// a cache that can't be saved shouldn't fail the job
+			log.Println("error saving cache:", err)
+			fmt.Fprintf(jl, "WARNING: couldn't save cache: %v\n", err)
+		}
+	}
+
+	if len(jc.Images) > 0 {
+		jl.WriteStep("publish images")
+		if err := publishImages(r, *jc, wd, jl); err != nil {
+			return err
+		}
+	}
+
 	if jc.Release.Image != "" {
-		jl.WriteStep("release")
-		return run(jc.Release, services, wd, e, jl)
-	} else {
-		return nil
+		if err := gateStage(r, "release", jc.Release, jl, func() error {
+			return release(r, *jc, env, network, wd, jl, gh)
+		}); err != nil {
+			return err
+		}
+	}
+
+	jl.WriteStep("save artifacts")
+	if err := saveArtifacts(r, wd, jl); err != nil {
+		return fmt.Errorf("unable to save artifacts: %v", err)
+	}
+
+	if len(jc.Triggers) > 0 && j.LocalPath == "" && jc.triggersBranch(j.Branch) {
+		jl.WriteStep("trigger downstream jobs")
+		if err := triggerDownstream(r, jc.Triggers, jl); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// supersedeOlderJobs cancels any unfinished jobs for older commits on the same branch as a job.
+func supersedeOlderJobs(r JobRequest, jl JobLogger) {
+	j := r.Job
+
+	jobs, err := r.Store.List(j.Owner, j.Repo, JobFilter{Branch: j.Branch})
+	if err != nil {
+		log.Println("error getting job list:", err)
+		return
+	}
+
+	for _, o := range jobs {
+		if o.Number >= j.Number || o.EndedAt != nil || o.SHA == j.SHA {
+			continue
+		}
+
+		fmt.Fprintf(jl, "CION: cancelling superseded job #%d\n", o.Number)
+
+		if r.Tracker != nil && r.Tracker.Supersede(refOf(o), j.Number, r.Executor) {
+			// the job is running in this process, and will record that it was superseded
+			continue
+		}
+
+		t := time.Now()
+		o.EndedAt = &t
+		o.Status = JobSuperseded
+		o.SupersededBy = j.Number
+
+		if err := r.Store.Save(o); err != nil {
+			log.Println("error saving superseded job:", err)
+		}
+	}
+}
+
+// gateStage runs a stage once it is allowed to: after it's been approved if it's a manual
+// stage, and while holding the lock for its concurrency group if it has one.
+func gateStage(r JobRequest, stage string, cc ContainerConfig, jl JobLogger,
+	fn func() error) error {
+
+	// a job doesn't use its host while it waits, so it gives up its place there until it's
+	// allowed to run the stage
+	if r.placement != nil && (cc.Manual || cc.Concurrency != "") {
+		r.placement.suspend()
+	}
+
+	if cc.Manual {
+		if err := awaitApproval(r, stage, cc, jl); err != nil {
+			return err
+		}
+	}
+
+	if cc.Concurrency != "" {
+		unlock, err := lockGroup(r, stage, cc, jl)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+
+	if r.placement != nil {
+		if err := r.placement.resume(); err != nil {
+			return err
+		}
+	}
+
+	return fn()
+}
+
+// runStage runs the container for a stage, retrying it up to the given number of times if it
+// fails. The working directory isn't reset between attempts, so a stage that's retried should
+// cope with whatever an earlier attempt left behind.
+func runStage(name string, cc ContainerConfig, retry int, env []string,
+	network string, wd string, e Executor, jl JobLogger) error {
+
+	jl.WriteStep(name)
+	err := run(cc, env, network, wd, e, jl)
+
+	for i := 1; err != nil && i <= retry; i++ {
+		io.WriteString(jl, fmt.Sprintf("ERROR: %v\n", err))
+		jl.WriteStep(fmt.Sprintf("%s (retry %d of %d)", name, i, retry))
+		err = run(cc, env, network, wd, e, jl)
 	}
+
+	return err
 }
 
 func startLocalWorkdirContainer(localPath string, e Executor, jl io.Writer) (string, error) {
@@ -211,7 +805,7 @@ func startLocalWorkdirContainer(localPath string, e Executor, jl io.Writer) (str
 		return "", err
 	}
 
-	image, err := e.Build(input, jl)
+	image, err := e.Build(BuildOpts{Input: input, Output: jl, Internal: true})
 	if err != nil {
 		return "", err
 	}
@@ -233,6 +827,7 @@ func startLocalWorkdirContainer(localPath string, e Executor, jl io.Writer) (str
 			"BUILD_DIR=" + BuildDir,
 			"SOURCES=/" + sourceArchiveName,
 		},
+		Internal: true,
 	}
 
 	wd, err := e.Run(opts)
@@ -283,6 +878,8 @@ func startWorkdirContainer(owner, repo, sha string, e Executor, jl io.Writer,
 			"CLONE_URL=" + *r.CloneURL,
 			"REFSPEC=" + sha,
 		},
+		PullOutput: jl,
+		Internal:   true,
 	}
 
 	wd, err := e.Run(opts)
@@ -305,12 +902,19 @@ func startWorkdirContainer(owner, repo, sha string, e Executor, jl io.Writer,
 	return wd, nil
 }
 
-func parseJobConfig(wd string, e Executor, jl io.Writer) (*JobConfig, error) {
+// parseJobConfig reads the job config from the working directory container, and checks it
+// against the server's policy.
+func parseJobConfig(j *Job, wd string, e Executor, jl io.Writer, p *Policy) (*JobConfig,
+	error) {
 	opts := RunContainerOpts{
 		Image:       GitImage,
 		Cmd:         []string{"cat", ".cion.yml"},
 		VolumesFrom: []string{wd},
 		WorkingDir:  BuildDir,
+
+		// the image was just used for the working directory
+		Pull:     PullIfNotPresent,
+		Internal: true,
 	}
 
 	c, err := e.Run(opts)
@@ -332,29 +936,97 @@ func parseJobConfig(wd string, e Executor, jl io.Writer) (*JobConfig, error) {
 	}
 
 	// if things worked out, the .cion.yml should have been read into stdout
+	return decodeJobConfig(j, stdout.Bytes(), p)
+}
+
+// decodeJobConfig decodes and validates the contents of a job's .cion.yml, and checks it
+// against the server's policy.
+func decodeJobConfig(j *Job, b []byte, p *Policy) (*JobConfig, error) {
 	jc := &JobConfig{}
-	if err := yaml.Unmarshal(stdout.Bytes(), jc); err != nil {
+	if err := yaml.Unmarshal(b, jc); err != nil {
 		return nil, err
 	}
 
-	if jc.Build.Image == "" {
+	if jc.Build.Image == "" && jc.Build.Dockerfile == "" {
 		// this is really the only thing that's required in the JobConfig
 		return nil, errors.New("no build image specified")
 	}
 
+	for name, cc := range jc.containers() {
+		if _, err := ParsePullPolicy(string(cc.Pull)); err != nil {
+			return nil, fmt.Errorf("%s container: %v", name, err)
+		}
+
+		if cc.Image != "" && cc.Dockerfile != "" {
+			return nil, fmt.Errorf("%s container can't have both an image and a Dockerfile",
+				name)
+		} else if cc.Dockerfile != "" && strings.HasPrefix(name, "service ") {
+			return nil, fmt.Errorf("%s container can't be built from a Dockerfile", name)
+		}
+	}
+
+	for _, ic := range jc.Images {
+		if err := ic.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dc := range jc.Dependencies {
+		if _, _, err := dc.split(); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, t := range jc.Triggers {
+		if _, _, _, err := parseTriggerTarget(t); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, b := range jc.TriggerBranches {
+		if _, err := path.Match(b, ""); err != nil {
+			return nil, fmt.Errorf("invalid trigger branch %q: %v", b, err)
+		}
+	}
+
+	if jc.Cache != nil {
+		for _, p := range jc.Cache.Paths {
+			if !path.IsAbs(p) {
+				return nil, fmt.Errorf("cache path %s must be absolute", p)
+			}
+		}
+	}
+
+	if err := p.Check(j.Owner, j.Repo, jc); err != nil {
+		return nil, err
+	}
+
 	return jc, nil
 }
 
-func startServices(jc JobConfig, wd string, e Executor) (map[string]string, error) {
+// startServices starts the service containers for a job on its network, where they can be
+// reached by name. The output of each service is written to its own log stream.
+func startServices(jc JobConfig, network string, e Executor, jl JobLogger) (map[string]string,
+	error) {
 	started := make(map[string]string, len(jc.Services))
 
 	for s, cc := range jc.Services {
+		rl, err := cc.resources()
+		if err != nil {
+			return started, fmt.Errorf("service %s: %v", s, err)
+		}
+
 		opts := RunContainerOpts{
-			Image:      cc.Image,
-			Cmd:        cc.Cmd,
-			Env:        cc.Env,
-			Ports:      cc.Ports,
-			Privileged: cc.Privileged,
+			Image:          cc.Image,
+			Cmd:            cc.Cmd,
+			Env:            cc.Env,
+			Ports:          cc.Ports,
+			Privileged:     cc.Privileged,
+			Network:        network,
+			NetworkAliases: []string{s},
+			Resources:      rl,
+			Pull:           cc.Pull,
+			PullOutput:     jl,
 		}
 
 		c, err := e.Run(opts)
@@ -363,47 +1035,102 @@ func startServices(jc JobConfig, wd string, e Executor) (map[string]string, erro
 		}
 
 		started[s] = c
+
+		go func(s, c string) {
+			sl := jl.Stream(s)
+			if err := e.Attach(c, sl, sl); err != nil {
+				fmt.Fprintf(jl, "ERROR: couldn't attach to service %s: %v\n", s, err)
+			}
+		}(s, c)
 	}
 
 	return started, nil
 }
 
-func run(cc ContainerConfig, services map[string]string, wd string,
+// run runs a build or release container on the job's network. Any extra environment variables
+// are passed to the container in addition to the ones from its config.
+func run(cc ContainerConfig, extraEnv []string, network string, wd string,
 	e Executor, jl io.Writer) error {
-	links := make([]string, 0, len(services))
-	for s, sc := range services {
-		links = append(links, sc+":"+s)
-	}
-
-	env := make([]string, 0, len(cc.Env)+2)
-	copy(env, cc.Env)
+	env := make([]string, 0, len(cc.Env)+len(extraEnv)+2)
+	env = append(env, cc.Env...)
+	env = append(env, extraEnv...)
 
 	env = append(env, "BUILD_DIR="+BuildDir)
 	env = append(env, "ARTIFACTS_DIR="+ArtifactsDir)
 
+	rl, err := cc.resources()
+	if err != nil {
+		return err
+	}
+
 	opts := RunContainerOpts{
 		Image:       cc.Image,
 		Cmd:         cc.Cmd,
 		Ports:       cc.Ports,
 		Privileged:  cc.Privileged,
 		Env:         env,
-		Links:       links,
+		Network:     network,
 		VolumesFrom: []string{wd},
 		WorkingDir:  BuildDir,
+		Resources:   rl,
+		Pull:        cc.Pull,
+		PullOutput:  jl,
+		LocalImage:  cc.localImage,
 	}
 
 	c, err := e.Run(opts)
 	if err != nil {
 		return err
 	}
+	defer e.Kill(c)
 
 	if err := e.Attach(c, jl, jl); err != nil {
 		return err
 	}
 
-	if r, err := e.Wait(c); r != 0 {
+	if r, err := e.Wait(c); err != nil {
+		return err
+	} else if r != 0 {
 		return errors.New("non-zero exit status from container")
 	} else {
-		return err
+		return nil
+	}
+}
+
+// linkEnv returns the environment variables that Docker links would provide for the services,
+// using their names on the job's network as addresses.
+func linkEnv(services map[string]ContainerConfig) []string {
+	var env []string
+
+	for s, cc := range services {
+		prefix := strings.ToUpper(nonAlphanumericRegexp.ReplaceAllString(s, "_"))
+
+		for i, p := range cc.Ports {
+			port, proto := p, "tcp"
+			if parts := strings.SplitN(p, "/", 2); len(parts) == 2 {
+				port, proto = parts[0], parts[1]
+			}
+
+			url := fmt.Sprintf("%s://%s:%s", proto, s, port)
+			pp := fmt.Sprintf("%s_PORT_%s_%s", prefix, port, strings.ToUpper(proto))
+
+			if i == 0 {
+				env = append(env, prefix+"_PORT="+url)
+			}
+
+			env = append(env,
+				pp+"="+url,
+				pp+"_ADDR="+s,
+				pp+"_PORT="+port,
+				pp+"_PROTO="+proto,
+			)
+		}
+
+		for _, e := range cc.Env {
+			env = append(env, prefix+"_ENV_"+e)
+		}
 	}
+
+	sort.Strings(env)
+	return env
 }
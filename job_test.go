@@ -0,0 +1,187 @@
+package cion
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// runTestJob runs a job for local sources with a FakeExecutor.
+func runTestJob(t *testing.T, fe *FakeExecutor) (*Job, error) {
+	s := NewInMemoryJobStore()
+	j := NewJob("owner", "repo", "master", "", "")
+	j.LocalPath = t.TempDir()
+	if err := s.Save(j); err != nil {
+		t.Fatal(err)
+	}
+
+	r := JobRequest{Job: j, Executor: fe, Store: s}
+	return j, runJob(r, NewWriterLogger(ioutil.Discard), nil)
+}
+
+func TestRunJob(t *testing.T) {
+	const build = `
+build:
+  image: golang
+  cmd: [make, test]
+`
+	const services = build + `
+services:
+  db:
+    image: postgres
+`
+
+	tests := []struct {
+		name   string
+		config string
+		script func(fe *FakeExecutor)
+		err    string
+		check  func(t *testing.T, j *Job, fe *FakeExecutor)
+	}{
+		{
+			name:   "build",
+			config: build,
+			check: func(t *testing.T, j *Job, fe *FakeExecutor) {
+				runs := fe.Ran("golang")
+				if len(runs) != 1 {
+					t.Fatalf("build ran %d times, want 1", len(runs))
+				}
+
+				opts := runs[0].Opts
+				wd := fe.Containers()[0].ID
+				if strings.Join(opts.Cmd, " ") != "make test" || opts.WorkingDir != BuildDir ||
+					len(opts.VolumesFrom) != 1 || opts.VolumesFrom[0] != wd {
+					t.Errorf("build container = %v in %s with volumes from %v", opts.Cmd,
+						opts.WorkingDir, opts.VolumesFrom)
+				}
+
+				for n, ok := range fe.Networks() {
+					if ok {
+						t.Errorf("network %s wasn't removed", n)
+					}
+				}
+			},
+		},
+		{
+			name:   "no build image",
+			config: "retry: 1\n",
+			err:    "no build image specified",
+		},
+		{
+			name:   "invalid config",
+			config: "build: [golang]\n",
+			err:    "cannot unmarshal",
+		},
+		{
+			name:   "unreadable config",
+			config: build,
+			script: func(fe *FakeExecutor) {
+				fe.Script(GitImage, []string{"cat", ".cion.yml"}, FakeResult{ExitCode: 1})
+			},
+			err: "unable to read job config file",
+		},
+		{
+			name:   "services",
+			config: services,
+			script: func(fe *FakeExecutor) {
+				fe.Script("postgres", nil, FakeResult{Block: true})
+			},
+			check: func(t *testing.T, j *Job, fe *FakeExecutor) {
+				runs := fe.Ran("postgres")
+				if len(runs) != 1 {
+					t.Fatalf("service ran %d times, want 1", len(runs))
+				}
+
+				opts := runs[0].Opts
+				if opts.Network == "" || len(opts.NetworkAliases) != 1 ||
+					opts.NetworkAliases[0] != "db" {
+					t.Errorf("service on network %q with aliases %v", opts.Network,
+						opts.NetworkAliases)
+				}
+				if b := fe.Ran("golang"); len(b) != 1 || b[0].Opts.Network != opts.Network {
+					t.Errorf("build isn't on the service network")
+				}
+
+				if len(j.Services) != 1 || j.Services[0] != "db" {
+					t.Errorf("job services = %v", j.Services)
+				}
+			},
+		},
+		{
+			name:   "build failure",
+			config: services,
+			script: func(fe *FakeExecutor) {
+				fe.Script("postgres", nil, FakeResult{Block: true})
+				fe.Script("golang", nil, FakeResult{ExitCode: 2})
+			},
+			err: "non-zero exit status from container",
+		},
+		{
+			name:   "oom",
+			config: build,
+			script: func(fe *FakeExecutor) {
+				fe.Script("golang", nil, FakeResult{OOMKilled: true})
+			},
+			err: ErrOOMKilled.Error(),
+		},
+		{
+			name:   "retries",
+			config: build + "retry: 2\n",
+			script: func(fe *FakeExecutor) {
+				fe.Script("golang", nil, FakeResult{ExitCode: 1})
+			},
+			err: "non-zero exit status from container",
+			check: func(t *testing.T, j *Job, fe *FakeExecutor) {
+				if n := len(fe.Ran("golang")); n != 3 {
+					t.Errorf("build ran %d times, want 3", n)
+				}
+			},
+		},
+		{
+			name:   "empty release environment",
+			config: build + "release:\n  image: deployer\n  environment: $DEPLOY_ENV\n",
+			err:    `release environment "$DEPLOY_ENV" is empty`,
+			check: func(t *testing.T, j *Job, fe *FakeExecutor) {
+				if n := len(fe.Ran("deployer")); n != 0 {
+					t.Errorf("release ran %d times, want 0", n)
+				}
+			},
+		},
+		{
+			name:   "start failure",
+			config: build,
+			script: func(fe *FakeExecutor) {
+				fe.Script("golang", nil, FakeResult{Err: ErrNotSupported})
+			},
+			err: ErrNotSupported.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fe := NewFakeExecutor()
+			fe.Script(GitImage, []string{"cat", ".cion.yml"}, FakeResult{Stdout: tt.config})
+			if tt.script != nil {
+				tt.script(fe)
+			}
+
+			j, err := runTestJob(t, fe)
+			if tt.err == "" && err != nil {
+				t.Fatalf("runJob() = %v", err)
+			} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Fatalf("runJob() = %v, want %q", err, tt.err)
+			}
+
+			// whether the job succeeds or not, nothing is left running
+			for _, c := range fe.Containers() {
+				if !c.Killed {
+					t.Errorf("%s container %v wasn't killed", c.Opts.Image, c.Opts.Cmd)
+				}
+			}
+
+			if tt.check != nil {
+				tt.check(t, j, fe)
+			}
+		})
+	}
+}
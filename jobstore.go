@@ -13,8 +13,8 @@ type JobStore interface {
 	// ListRepos returns a list of all the repos for a given owner.
 	ListRepos(owner string) ([]string, error)
 
-	// List gets all the jobs for the given owner/repo.
-	List(owner, repo string) ([]*Job, error)
+	// List gets all the jobs for the given owner/repo that match the filter.
+	List(owner, repo string, f JobFilter) ([]*Job, error)
 
 	// Save persists a job to storage. If the job doesn't have a number yet, it is assigned the
 	// next incrementing job number for the repo.
@@ -22,6 +22,41 @@ type JobStore interface {
 
 	// GetLogger gets the JobLogger to write logs for a job.
 	GetLogger(j *Job) JobLogger
+
+	// SaveDeployment persists a record of a deployment to an environment.
+	SaveDeployment(d *Deployment) error
+
+	// ListDeployments gets the deployment history for the given owner/repo, newest first. If
+	// environment is empty, deployments to all environments are returned.
+	ListDeployments(owner, repo, environment string) ([]*Deployment, error)
+
+	// AcquireLock tries to acquire the named lock for a job, and returns the current state of
+	// the lock along with whether the job holds it. If the job can't acquire the lock, it is
+	// added to the lock's waiting list.
+	AcquireLock(name string, ref JobRef) (*Lock, bool, error)
+
+	// ReleaseLock releases the named lock if it is held by a job, and removes the job from the
+	// lock's waiting list.
+	ReleaseLock(name string, ref JobRef) error
+
+	// SaveCache persists a record of a cache for a repo, replacing any record with the same key.
+	SaveCache(c *CacheEntry) error
+
+	// ListCaches gets the caches for the given owner/repo, most recently used first.
+	ListCaches(owner, repo string) ([]*CacheEntry, error)
+
+	// DeleteCache deletes the record of a cache.
+	DeleteCache(owner, repo, key string) error
+
+	// SaveArtifacts persists a tar archive of a job's artifacts, replacing any that were saved
+	// before.
+	SaveArtifacts(j *Job, r io.Reader) error
+
+	// GetArtifacts writes the tar archive of a job's artifacts to a writer.
+	GetArtifacts(j *Job, w io.Writer) error
+
+	// DeleteArtifacts deletes a job's artifacts.
+	DeleteArtifacts(j *Job) error
 }
 
 // JobLogger provides an io.Writer interface for writing build logs for a job.
@@ -32,4 +67,8 @@ type JobLogger interface {
 	// WriteStep writes a transition to a new build step to the log. All subsequent writes are
 	// assumed to be part of the new build step, until another new step is written.
 	WriteStep(name string) error
+
+	// Stream gets a JobLogger for a separate named log stream for the job, such as the output
+	// of a service container.
+	Stream(name string) JobLogger
 }
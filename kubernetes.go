@@ -0,0 +1,860 @@
+//go:build kubernetes
+// +build kubernetes
+
+package cion
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/remotecommand"
+	utilexec "k8s.io/client-go/util/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// KubernetesPollInterval is how often the Kubernetes executor checks the status of a pod.
+var KubernetesPollInterval = time.Second
+
+const (
+	// DefaultKubernetesVolumeSize is the size of the persistent volume claims for container
+	// volumes if the executor doesn't specify one.
+	DefaultKubernetesVolumeSize = "10Gi"
+
+	// DefaultKubernetesStartTimeout is how long a pod can be pending if the executor doesn't
+	// specify a timeout.
+	DefaultKubernetesStartTimeout = 10 * time.Minute
+
+	// the name of the container in each pod
+	kubernetesContainer = "main"
+
+	// labels and annotations for the objects created by the Kubernetes executor
+	kubernetesPodLabel       = "cion/pod"
+	kubernetesNetworkLabel   = "cion/network"
+	kubernetesVolumesKey     = "cion/volumes"
+	kubernetesAliasesKey     = "cion/aliases"
+	kubernetesAuthSecretName = "-auth"
+)
+
+// KubernetesExecutor is an Executor that runs each container as a pod in a Kubernetes
+// namespace.
+//
+// Container volumes are persistent volume claims, so that other pods can mount them with
+// VolumesFrom. Unless the claims are ReadWriteMany, a pod that uses the volumes of another pod
+// is scheduled on the same node, since the claims can only be attached to one node. A
+// network is a label on the pods that are attached to it. Pods with network aliases get a
+// Service, and the other pods on the network are given host aliases for its cluster IP. Since
+// Kubernetes combines the stdout and stderr of a container, both are written to the stdout
+// writer by Attach.
+type KubernetesExecutor struct {
+	client    kubernetes.Interface
+	config    *rest.Config
+	namespace string
+
+	// Policy restricts which images can be pulled.
+	Policy *Policy
+
+	// DefaultPull specifies when to pull images for containers that don't have a pull policy.
+	DefaultPull PullPolicy
+
+	// StorageClass is the storage class for the persistent volume claims for container
+	// volumes. If it's empty, the cluster's default is used.
+	StorageClass string
+
+	// VolumeSize is the size of the persistent volume claims, like "10Gi".
+	VolumeSize string
+
+	// VolumeAccessMode is the access mode for the persistent volume claims. With ReadWriteMany,
+	// the pods for a job can run on any node, otherwise they run on the same node.
+	VolumeAccessMode corev1.PersistentVolumeAccessMode
+
+	// StartTimeout is how long a pod can be pending, waiting to be scheduled, for its volumes
+	// to be attached, or for its image to be pulled, before waiting for it fails. If it's
+	// zero, pods can be pending forever.
+	StartTimeout time.Duration
+}
+
+// NewKubernetesExecutor creates an executor for a namespace in the cluster described by a
+// kubeconfig file. If the path is empty, the in-cluster configuration is used.
+func NewKubernetesExecutor(kubeconfig, namespace string) (*KubernetesExecutor, error) {
+	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewKubernetesExecutorWithClient(client, config, namespace), nil
+}
+
+// configureKubernetes creates the Kubernetes executor for the server's options.
+func configureKubernetes(opts Options, p *Policy, defaultPull PullPolicy) (Executor, error) {
+	ke, err := NewKubernetesExecutor(opts.KubeConfig, opts.KubeNamespace)
+	if err != nil {
+		return nil, err
+	}
+
+	ke.Policy = p
+	ke.DefaultPull = defaultPull
+	ke.StorageClass = opts.KubeStorageClass
+	return ke, nil
+}
+
+// NewKubernetesExecutorWithClient creates an executor that uses an existing client, such as a
+// fake clientset. Exec and Import need a REST config to stream to pods, so they fail if the
+// config is nil.
+func NewKubernetesExecutorWithClient(client kubernetes.Interface, config *rest.Config,
+	namespace string) *KubernetesExecutor {
+
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	return &KubernetesExecutor{
+		client:           client,
+		config:           config,
+		namespace:        namespace,
+		VolumeSize:       DefaultKubernetesVolumeSize,
+		VolumeAccessMode: corev1.ReadWriteOnce,
+		StartTimeout:     DefaultKubernetesStartTimeout,
+	}
+}
+
+func (e KubernetesExecutor) Run(opts RunContainerOpts) (string, error) {
+	pod, err := e.podSpec(uuid.New(), opts)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := e.client.CoreV1().Pods(e.namespace).Create(context.Background(), pod,
+		metav1.CreateOptions{}); err != nil {
+		return "", err
+	}
+
+	if len(opts.NetworkAliases) > 0 {
+		if err := e.createService(pod.Name, opts); err != nil {
+			e.Kill(pod.Name)
+			return "", err
+		}
+	}
+
+	return pod.Name, nil
+}
+
+// podSpec builds the pod for a container, creating any persistent volume claims and registry
+// secrets that it needs.
+func (e KubernetesExecutor) podSpec(id string, opts RunContainerOpts) (*corev1.Pod, error) {
+	name := "cion-" + id
+
+	c := corev1.Container{
+		Name:       kubernetesContainer,
+		Image:      opts.Image,
+		Args:       opts.Cmd,
+		WorkingDir: opts.WorkingDir,
+	}
+
+	for _, env := range opts.Env {
+		kv := strings.SplitN(env, "=", 2)
+		if len(kv) == 1 {
+			kv = append(kv, "")
+		}
+
+		c.Env = append(c.Env, corev1.EnvVar{Name: kv[0], Value: kv[1]})
+	}
+
+	for _, p := range opts.Ports {
+		port, proto, err := kubernetesPort(p)
+		if err != nil {
+			return nil, err
+		}
+
+		c.Ports = append(c.Ports, corev1.ContainerPort{ContainerPort: port, Protocol: proto})
+	}
+
+	if opts.Privileged {
+		c.SecurityContext = &corev1.SecurityContext{Privileged: &opts.Privileged}
+	}
+
+	c.Resources.Limits = corev1.ResourceList{}
+	if opts.Resources.CPUs > 0 {
+		c.Resources.Limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(
+			int64(opts.Resources.CPUs*1000), resource.DecimalSI)
+	}
+	if opts.Resources.Memory > 0 {
+		c.Resources.Limits[corev1.ResourceMemory] = *resource.NewQuantity(
+			opts.Resources.Memory, resource.BinarySI)
+	}
+
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Labels:      map[string]string{kubernetesPodLabel: name},
+			Annotations: map[string]string{},
+		},
+		Spec: corev1.PodSpec{RestartPolicy: corev1.RestartPolicyNever},
+	}
+
+	if err := e.setImage(pod, &c, opts); err != nil {
+		return nil, err
+	}
+
+	if err := e.setVolumes(pod, &c, opts); err != nil {
+		return nil, err
+	}
+
+	if opts.Network != "" {
+		pod.Labels[kubernetesNetworkLabel] = opts.Network
+
+		aliases, err := e.hostAliases(opts.Network)
+		if err != nil {
+			return nil, err
+		}
+		pod.Spec.HostAliases = aliases
+	}
+
+	pod.Spec.Containers = []corev1.Container{c}
+	return pod, nil
+}
+
+// setImage sets the pull policy for the container, along with a secret for its registry
+// credentials.
+func (e KubernetesExecutor) setImage(pod *corev1.Pod, c *corev1.Container,
+	opts RunContainerOpts) error {
+
+	if opts.LocalImage {
+		// images can't be built locally for a cluster
+		return ErrNotSupported
+	} else if !opts.Internal && !e.Policy.AllowsImage(opts.Image) {
+		return fmt.Errorf("image %s is not allowed by policy", opts.Image)
+	}
+
+	policy := opts.Pull
+	if policy == "" {
+		policy = e.DefaultPull
+	}
+
+	switch policy {
+	case "", PullAlways:
+		c.ImagePullPolicy = corev1.PullAlways
+	case PullIfNotPresent:
+		c.ImagePullPolicy = corev1.PullIfNotPresent
+	case PullNever:
+		c.ImagePullPolicy = corev1.PullNever
+	default:
+		return fmt.Errorf("invalid pull policy %q", policy)
+	}
+
+	rc := opts.RegistryAuth.lookup(opts.Image)
+	if rc == nil {
+		return nil
+	}
+
+	auth := map[string]interface{}{
+		"auths": map[string]interface{}{
+			rc.serverAddress(): map[string]string{
+				"username": rc.Username,
+				"password": rc.Password,
+				"email":    rc.Email,
+				"auth": base64.StdEncoding.EncodeToString(
+					[]byte(rc.Username + ":" + rc.Password)),
+			},
+		},
+	}
+
+	b, err := json.Marshal(auth)
+	if err != nil {
+		return err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   pod.Name + kubernetesAuthSecretName,
+			Labels: map[string]string{kubernetesPodLabel: pod.Name},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{corev1.DockerConfigJsonKey: b},
+	}
+
+	if _, err := e.client.CoreV1().Secrets(e.namespace).Create(context.Background(), secret,
+		metav1.CreateOptions{}); err != nil {
+		return err
+	}
+
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: secret.Name}}
+	return nil
+}
+
+// setVolumes mounts the volumes for a container. New volumes and named volumes are persistent
+// volume claims, and the claims for all of the pod's volumes are recorded in an annotation so
+// that other pods can use them. The claims for new volumes are labeled with the pod, so that
+// they're deleted along with it.
+func (e KubernetesExecutor) setVolumes(pod *corev1.Pod, c *corev1.Container,
+	opts RunContainerOpts) error {
+
+	// the claim and read-only flag for each mounted path
+	claims := make(map[string]string)
+	readOnly := make(map[string]bool)
+
+	// the node that the pods with the volumes are on
+	var node string
+
+	for _, vf := range opts.VolumesFrom {
+		id, mode := vf, ""
+		if i := strings.LastIndex(vf, ":"); i >= 0 {
+			id, mode = vf[:i], vf[i+1:]
+		}
+
+		other, err := e.client.CoreV1().Pods(e.namespace).Get(context.Background(), id,
+			metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		var m map[string]string
+		if err := json.Unmarshal([]byte(other.Annotations[kubernetesVolumesKey]), &m); err != nil {
+			return fmt.Errorf("no volumes for pod %s: %v", id, err)
+		}
+
+		if other.Spec.NodeName == "" {
+			if other, err = e.waitForPod(id, func(p *corev1.Pod) bool {
+				return p.Spec.NodeName != ""
+			}); err != nil {
+				return err
+			}
+		}
+
+		if node != "" && other.Spec.NodeName != node {
+			return fmt.Errorf("volumes are on different nodes: %s and %s", node,
+				other.Spec.NodeName)
+		}
+		node = other.Spec.NodeName
+
+		for p, claim := range m {
+			claims[p] = claim
+			readOnly[p] = mode == "ro"
+		}
+	}
+
+	for i, p := range opts.Volumes {
+		claim := fmt.Sprintf("%s-%d", pod.Name, i)
+		if err := e.createClaim(claim, pod.Name); err != nil {
+			return err
+		}
+
+		claims[p] = claim
+		readOnly[p] = false
+	}
+
+	for _, b := range opts.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) < 2 {
+			return fmt.Errorf("invalid bind %q", b)
+		}
+
+		if err := e.createClaim(parts[0], ""); err != nil && !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+
+		claims[parts[1]] = parts[0]
+		readOnly[parts[1]] = len(parts) > 2 && parts[2] == "ro"
+	}
+
+	// pods can only mount each claim once, so paths that share a claim share a volume
+	volumes := make(map[string]string)
+	for p, claim := range claims {
+		v, ok := volumes[claim]
+		if !ok {
+			v = "v" + strconv.Itoa(len(volumes))
+			volumes[claim] = v
+
+			pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+				Name: v,
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: claim,
+					},
+				},
+			})
+		}
+
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{
+			Name:      v,
+			MountPath: p,
+			ReadOnly:  readOnly[p],
+		})
+	}
+
+	b, err := json.Marshal(claims)
+	if err != nil {
+		return err
+	}
+
+	pod.Annotations[kubernetesVolumesKey] = string(b)
+
+	// claims that aren't ReadWriteMany can only be attached to one node at a time
+	if node != "" && e.VolumeAccessMode != corev1.ReadWriteMany {
+		pod.Spec.Affinity = nodeAffinity(node)
+	}
+
+	return nil
+}
+
+// nodeAffinity returns an affinity that schedules a pod on a node.
+func nodeAffinity(node string) *corev1.Affinity {
+	return &corev1.Affinity{
+		NodeAffinity: &corev1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{
+				NodeSelectorTerms: []corev1.NodeSelectorTerm{{
+					MatchFields: []corev1.NodeSelectorRequirement{{
+						Key:      "metadata.name",
+						Operator: corev1.NodeSelectorOpIn,
+						Values:   []string{node},
+					}},
+				}},
+			},
+		},
+	}
+}
+
+// createClaim creates a persistent volume claim. If the claim belongs to a pod, it's labeled
+// with the pod so that it can be deleted when the pod is killed.
+func (e KubernetesExecutor) createClaim(name, pod string) error {
+	size, err := resource.ParseQuantity(e.VolumeSize)
+	if err != nil {
+		return fmt.Errorf("invalid volume size: %v", err)
+	}
+
+	pvc := &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			AccessModes: []corev1.PersistentVolumeAccessMode{e.VolumeAccessMode},
+			Resources: corev1.VolumeResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceStorage: size},
+			},
+		},
+	}
+	if e.StorageClass != "" {
+		pvc.Spec.StorageClassName = &e.StorageClass
+	}
+	if pod != "" {
+		pvc.Labels = map[string]string{kubernetesPodLabel: pod}
+	}
+
+	_, err = e.client.CoreV1().PersistentVolumeClaims(e.namespace).Create(context.Background(),
+		pvc, metav1.CreateOptions{})
+	return err
+}
+
+// createService creates a Service for a pod on a network, so that other pods on the network
+// can reach it by its aliases. A pod without any ports gets a headless Service, which other
+// pods reach at the pod's own IP, on any port.
+func (e KubernetesExecutor) createService(name string, opts RunContainerOpts) error {
+	svc := &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+			Labels: map[string]string{
+				kubernetesPodLabel:     name,
+				kubernetesNetworkLabel: opts.Network,
+			},
+			Annotations: map[string]string{
+				kubernetesAliasesKey: strings.Join(opts.NetworkAliases, ","),
+			},
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{kubernetesPodLabel: name},
+		},
+	}
+
+	if len(opts.Ports) == 0 {
+		svc.Spec.ClusterIP = corev1.ClusterIPNone
+	}
+
+	for _, p := range opts.Ports {
+		port, proto, err := kubernetesPort(p)
+		if err != nil {
+			return err
+		}
+
+		svc.Spec.Ports = append(svc.Spec.Ports, corev1.ServicePort{
+			Name:       fmt.Sprintf("%s-%d", strings.ToLower(string(proto)), port),
+			Port:       port,
+			Protocol:   proto,
+			TargetPort: intstr.FromInt32(port),
+		})
+	}
+
+	_, err := e.client.CoreV1().Services(e.namespace).Create(context.Background(), svc,
+		metav1.CreateOptions{})
+	return err
+}
+
+// hostAliases returns host aliases for the Services on a network. Headless Services are aliased
+// to the IPs of their pods, so pods that haven't been given an IP yet are left out.
+func (e KubernetesExecutor) hostAliases(network string) ([]corev1.HostAlias, error) {
+	ctx := context.Background()
+
+	l, err := e.client.CoreV1().Services(e.namespace).List(ctx,
+		metav1.ListOptions{LabelSelector: kubernetesNetworkLabel + "=" + network})
+	if err != nil {
+		return nil, err
+	}
+
+	var aliases []corev1.HostAlias
+	for _, svc := range l.Items {
+		ip := svc.Spec.ClusterIP
+		if ip == corev1.ClusterIPNone {
+			pod, err := e.client.CoreV1().Pods(e.namespace).Get(ctx,
+				svc.Spec.Selector[kubernetesPodLabel], metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			ip = pod.Status.PodIP
+		}
+
+		if ip == "" {
+			continue
+		}
+
+		aliases = append(aliases, corev1.HostAlias{
+			IP:        ip,
+			Hostnames: strings.Split(svc.Annotations[kubernetesAliasesKey], ","),
+		})
+	}
+
+	return aliases, nil
+}
+
+// kubernetesPort parses a port in the format <port>[/<tcp|udp>].
+func kubernetesPort(p string) (int32, corev1.Protocol, error) {
+	parts := strings.SplitN(p, "/", 2)
+
+	port, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid port %q", p)
+	}
+
+	proto := corev1.ProtocolTCP
+	if len(parts) == 2 {
+		proto = corev1.Protocol(strings.ToUpper(parts[1]))
+	}
+
+	return int32(port), proto, nil
+}
+
+// Attach streams the logs of a pod once it starts. Both stdout and stderr are written to the
+// stdout writer.
+func (e KubernetesExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) error {
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+
+	if _, err := e.waitForPod(id, func(p *corev1.Pod) bool {
+		return p.Status.Phase != corev1.PodPending
+	}); err != nil {
+		return err
+	}
+
+	logs, err := e.client.CoreV1().Pods(e.namespace).GetLogs(id,
+		&corev1.PodLogOptions{Container: kubernetesContainer, Follow: true}).Stream(
+		context.Background())
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	_, err = io.Copy(stdout, logs)
+	return err
+}
+
+// Wait waits for a pod to finish, and returns the exit code of its container.
+func (e KubernetesExecutor) Wait(id string) (int, error) {
+	p, err := e.waitForPod(id, func(p *corev1.Pod) bool {
+		return p.Status.Phase == corev1.PodSucceeded || p.Status.Phase == corev1.PodFailed
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, cs := range p.Status.ContainerStatuses {
+		if t := cs.State.Terminated; cs.Name == kubernetesContainer && t != nil {
+			if t.Reason == "OOMKilled" {
+				return int(t.ExitCode), ErrOOMKilled
+			}
+
+			return int(t.ExitCode), nil
+		}
+	}
+
+	if p.Status.Phase == corev1.PodSucceeded {
+		return 0, nil
+	}
+
+	return 0, fmt.Errorf("pod %s failed: %s", id, p.Status.Message)
+}
+
+// waitForPod polls a pod until a condition is true. It fails if the pod is deleted, if its
+// image can't be pulled, or if it's still pending after the start timeout.
+func (e KubernetesExecutor) waitForPod(id string, done func(*corev1.Pod) bool) (*corev1.Pod,
+	error) {
+
+	start := time.Now()
+	for {
+		p, err := e.client.CoreV1().Pods(e.namespace).Get(context.Background(), id,
+			metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil, fmt.Errorf("pod %s was deleted", id)
+		} else if err != nil {
+			return nil, err
+		}
+
+		if done(p) {
+			return p, nil
+		}
+
+		for _, cs := range p.Status.ContainerStatuses {
+			if w := cs.State.Waiting; w != nil &&
+				(w.Reason == "ErrImagePull" || w.Reason == "ImagePullBackOff" ||
+					w.Reason == "ErrImageNeverPull") {
+
+				return nil, fmt.Errorf("unable to pull image %s: %s", cs.Image, w.Message)
+			}
+		}
+
+		if p.Status.Phase == corev1.PodPending && e.StartTimeout > 0 &&
+			time.Since(start) > e.StartTimeout {
+
+			return nil, fmt.Errorf("pod %s is still pending after %v%s", id, e.StartTimeout,
+				pendingReason(p))
+		}
+
+		time.Sleep(KubernetesPollInterval)
+	}
+}
+
+// pendingReason returns why a pod hasn't been scheduled or started, if Kubernetes reports it.
+func pendingReason(p *corev1.Pod) string {
+	for _, c := range p.Status.Conditions {
+		if c.Type == corev1.PodScheduled && c.Status == corev1.ConditionFalse {
+			return ": " + c.Message
+		}
+	}
+
+	for _, cs := range p.Status.ContainerStatuses {
+		if w := cs.State.Waiting; w != nil && w.Message != "" {
+			return ": " + w.Message
+		}
+	}
+
+	return ""
+}
+
+// Kill deletes a pod, along with its Service, registry secret, and the claims for its volumes.
+// Named volumes aren't deleted.
+func (e KubernetesExecutor) Kill(id string) error {
+	ctx := context.Background()
+	grace := int64(0)
+
+	err := e.client.CoreV1().Pods(e.namespace).Delete(ctx, id,
+		metav1.DeleteOptions{GracePeriodSeconds: &grace})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	e.client.CoreV1().Services(e.namespace).Delete(ctx, id, metav1.DeleteOptions{})
+	e.client.CoreV1().Secrets(e.namespace).Delete(ctx, id+kubernetesAuthSecretName,
+		metav1.DeleteOptions{})
+
+	// claims are only removed once no pods use them, so other pods that use the volumes keep
+	// them until they're deleted too
+	l, err := e.client.CoreV1().PersistentVolumeClaims(e.namespace).List(ctx,
+		metav1.ListOptions{LabelSelector: kubernetesPodLabel + "=" + id})
+	if err != nil {
+		return err
+	}
+
+	for _, pvc := range l.Items {
+		err := e.client.CoreV1().PersistentVolumeClaims(e.namespace).Delete(ctx, pvc.Name,
+			metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e KubernetesExecutor) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	opts := &corev1.PodExecOptions{
+		Container: kubernetesContainer,
+		Command:   cmd,
+		Stdout:    true,
+		Stderr:    true,
+	}
+
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	err := e.stream(id, "exec", opts, remotecommand.StreamOptions{
+		Stdout: stdout,
+		Stderr: stderr,
+	})
+
+	var ee utilexec.ExitError
+	if errors.As(err, &ee) {
+		return ee.ExitStatus(), nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return 0, nil
+}
+
+// stream runs a streaming subresource request, like exec or attach, against a pod.
+func (e KubernetesExecutor) stream(id, subresource string, opts runtime.Object,
+	so remotecommand.StreamOptions) error {
+
+	if e.config == nil {
+		return errors.New("streaming to pods needs a REST config")
+	}
+
+	req := e.client.CoreV1().RESTClient().Post().
+		Namespace(e.namespace).
+		Resource("pods").
+		Name(id).
+		SubResource(subresource).
+		VersionedParams(opts, scheme.ParameterCodec)
+
+	ex, err := remotecommand.NewSPDYExecutor(e.config, "POST", req.URL())
+	if err != nil {
+		return err
+	}
+
+	return ex.StreamWithContext(context.Background(), so)
+}
+
+// Import runs a pod with the volumes of the container, and extracts the tar archive into the
+// path by attaching to its stdin.
+func (e KubernetesExecutor) Import(id, path string, input io.Reader) error {
+	ctx := context.Background()
+
+	pod, err := e.podSpec(uuid.New(), RunContainerOpts{
+		Image:       GitImage,
+		Cmd:         []string{"tar", "-x", "-C", path, "-f", "-"},
+		VolumesFrom: []string{id},
+		Pull:        PullIfNotPresent,
+		Internal:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	c := &pod.Spec.Containers[0]
+	c.Stdin = true
+	c.StdinOnce = true
+
+	if _, err := e.client.CoreV1().Pods(e.namespace).Create(ctx, pod,
+		metav1.CreateOptions{}); err != nil {
+		return err
+	}
+	defer e.Kill(pod.Name)
+
+	if _, err := e.waitForPod(pod.Name, func(p *corev1.Pod) bool {
+		return p.Status.Phase == corev1.PodRunning
+	}); err != nil {
+		return err
+	}
+
+	opts := &corev1.PodAttachOptions{Container: kubernetesContainer, Stdin: true}
+	if err := e.stream(pod.Name, "attach", opts, remotecommand.StreamOptions{
+		Stdin: input,
+	}); err != nil {
+		return err
+	}
+
+	if r, err := e.Wait(pod.Name); err != nil {
+		return err
+	} else if r != 0 {
+		return fmt.Errorf("exit status %d from import", r)
+	}
+
+	return nil
+}
+
+// Build isn't supported, since images can't be built in the cluster.
+func (e KubernetesExecutor) Build(opts BuildOpts) (string, error) {
+	return "", ErrNotSupported
+}
+
+// HasImage isn't supported, since images are pulled by each node.
+func (e KubernetesExecutor) HasImage(image string) (bool, error) {
+	return false, ErrNotSupported
+}
+
+func (e KubernetesExecutor) Tag(image, repository, tag string) error {
+	return ErrNotSupported
+}
+
+func (e KubernetesExecutor) Push(opts PushOpts) (string, error) {
+	return "", ErrNotSupported
+}
+
+// CreateNetwork doesn't create anything, since the network is just a label on the pods that
+// are attached to it.
+func (e KubernetesExecutor) CreateNetwork(name string) (string, error) {
+	return name, nil
+}
+
+// RemoveNetwork deletes the Services for the pods on a network.
+func (e KubernetesExecutor) RemoveNetwork(id string) error {
+	ctx := context.Background()
+
+	l, err := e.client.CoreV1().Services(e.namespace).List(ctx,
+		metav1.ListOptions{LabelSelector: kubernetesNetworkLabel + "=" + id})
+	if err != nil {
+		return err
+	}
+
+	for _, svc := range l.Items {
+		err := e.client.CoreV1().Services(e.namespace).Delete(ctx, svc.Name,
+			metav1.DeleteOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveVolume deletes the persistent volume claim for a named volume.
+func (e KubernetesExecutor) RemoveVolume(name string) error {
+	return e.client.CoreV1().PersistentVolumeClaims(e.namespace).Delete(context.Background(),
+		name, metav1.DeleteOptions{})
+}
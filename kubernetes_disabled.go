@@ -0,0 +1,16 @@
+//go:build !kubernetes
+// +build !kubernetes
+
+package cion
+
+import (
+	"errors"
+)
+
+// configureKubernetes fails, since the Kubernetes executor is only built with the kubernetes
+// build tag. It depends on k8s.io/client-go and k8s.io/apimachinery, which most builds of cion
+// don't need.
+func configureKubernetes(opts Options, p *Policy, defaultPull PullPolicy) (Executor, error) {
+	return nil, errors.New("cion was built without the kubernetes executor, " +
+		"build it with -tags kubernetes")
+}
@@ -0,0 +1,389 @@
+//go:build kubernetes
+// +build kubernetes
+
+package cion
+
+import (
+	"context"
+	"encoding/json"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestKubernetesExecutor() (*KubernetesExecutor, *fake.Clientset) {
+	KubernetesPollInterval = time.Millisecond
+
+	client := fake.NewClientset()
+	return NewKubernetesExecutorWithClient(client, nil, "cion"), client
+}
+
+func getPod(t *testing.T, client *fake.Clientset, id string) *corev1.Pod {
+	p, err := client.CoreV1().Pods("cion").Get(context.Background(), id, metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("getting pod %s: %v", id, err)
+	}
+
+	return p
+}
+
+// schedulePod sets the node and status of a pod, like the scheduler and kubelet would.
+func schedulePod(t *testing.T, client *fake.Clientset, id, node string,
+	status corev1.PodStatus) {
+
+	p := getPod(t, client, id)
+	p.Spec.NodeName = node
+	p.Status = status
+
+	if _, err := client.CoreV1().Pods("cion").Update(context.Background(), p,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatalf("updating pod %s: %v", id, err)
+	}
+}
+
+func terminated(code int32, reason string) corev1.PodStatus {
+	phase := corev1.PodSucceeded
+	if code != 0 {
+		phase = corev1.PodFailed
+	}
+
+	return corev1.PodStatus{
+		Phase: phase,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name: kubernetesContainer,
+			State: corev1.ContainerState{
+				Terminated: &corev1.ContainerStateTerminated{ExitCode: code, Reason: reason},
+			},
+		}},
+	}
+}
+
+func TestKubernetesPodSpec(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+
+	id, err := e.Run(RunContainerOpts{
+		Image:      "golang:1.5",
+		Cmd:        []string{"make", "test"},
+		Env:        []string{"FOO=bar", "EMPTY"},
+		Ports:      []string{"8080", "53/udp"},
+		Privileged: true,
+		WorkingDir: BuildDir,
+		Resources:  ResourceLimits{CPUs: 1.5, Memory: 512 << 20},
+		Pull:       PullIfNotPresent,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := getPod(t, client, id)
+	if p.Labels[kubernetesPodLabel] != id {
+		t.Errorf("pod label = %q, want %q", p.Labels[kubernetesPodLabel], id)
+	}
+	if p.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("restart policy = %s", p.Spec.RestartPolicy)
+	}
+
+	c := p.Spec.Containers[0]
+	if c.Image != "golang:1.5" || strings.Join(c.Args, " ") != "make test" ||
+		c.WorkingDir != BuildDir {
+		t.Errorf("container = %s %v in %s", c.Image, c.Args, c.WorkingDir)
+	}
+	if c.ImagePullPolicy != corev1.PullIfNotPresent {
+		t.Errorf("pull policy = %s", c.ImagePullPolicy)
+	}
+	if len(c.Env) != 2 || c.Env[0] != (corev1.EnvVar{Name: "FOO", Value: "bar"}) ||
+		c.Env[1] != (corev1.EnvVar{Name: "EMPTY"}) {
+		t.Errorf("env = %v", c.Env)
+	}
+	if len(c.Ports) != 2 || c.Ports[0].ContainerPort != 8080 ||
+		c.Ports[1].Protocol != corev1.ProtocolUDP {
+		t.Errorf("ports = %v", c.Ports)
+	}
+	if c.SecurityContext == nil || !*c.SecurityContext.Privileged {
+		t.Error("container isn't privileged")
+	}
+	if cpu := c.Resources.Limits[corev1.ResourceCPU]; cpu.MilliValue() != 1500 {
+		t.Errorf("cpu limit = %s", cpu.String())
+	}
+	if mem := c.Resources.Limits[corev1.ResourceMemory]; mem.Value() != 512<<20 {
+		t.Errorf("memory limit = %s", mem.String())
+	}
+}
+
+func TestKubernetesRegistrySecret(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+
+	id, err := e.Run(RunContainerOpts{
+		Image: "registry.example.com/app",
+		RegistryAuth: RegistryAuth{
+			{Registry: "registry.example.com", Username: "user", Password: "pass"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := getPod(t, client, id)
+	if len(p.Spec.ImagePullSecrets) != 1 ||
+		p.Spec.ImagePullSecrets[0].Name != id+kubernetesAuthSecretName {
+		t.Fatalf("pull secrets = %v", p.Spec.ImagePullSecrets)
+	}
+
+	if err := e.Kill(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.CoreV1().Secrets("cion").Get(context.Background(),
+		id+kubernetesAuthSecretName, metav1.GetOptions{}); err == nil {
+		t.Error("secret wasn't deleted with the pod")
+	}
+}
+
+func TestKubernetesLocalImage(t *testing.T) {
+	e, _ := newTestKubernetesExecutor()
+
+	_, err := e.Run(RunContainerOpts{Image: "built", LocalImage: true})
+	if err != ErrNotSupported {
+		t.Errorf("err = %v, want ErrNotSupported", err)
+	}
+}
+
+func TestKubernetesVolumes(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+	ctx := context.Background()
+
+	wd, err := e.Run(RunContainerOpts{
+		Image:   GitImage,
+		Volumes: []string{BuildDir, ArtifactsDir},
+		Binds:   []string{"shared:/shared"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulePod(t, client, wd, "node-1", terminated(0, ""))
+
+	var claims map[string]string
+	if err := json.Unmarshal([]byte(getPod(t, client, wd).Annotations[kubernetesVolumesKey]),
+		&claims); err != nil {
+		t.Fatal(err)
+	}
+	if len(claims) != 3 || claims["/shared"] != "shared" {
+		t.Fatalf("claims = %v", claims)
+	}
+
+	c, err := e.Run(RunContainerOpts{Image: "golang", VolumesFrom: []string{wd + ":ro"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := getPod(t, client, c)
+	if len(p.Spec.Volumes) != 3 {
+		t.Errorf("volumes = %v", p.Spec.Volumes)
+	}
+	for _, vm := range p.Spec.Containers[0].VolumeMounts {
+		if !vm.ReadOnly {
+			t.Errorf("%s isn't mounted read-only", vm.MountPath)
+		}
+	}
+
+	// the claims can only be attached to the node that the working directory is on
+	terms := p.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.
+		NodeSelectorTerms
+	if len(terms) != 1 || terms[0].MatchFields[0].Values[0] != "node-1" {
+		t.Errorf("node affinity = %v", terms)
+	}
+
+	if err := e.Kill(wd); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := client.CoreV1().PersistentVolumeClaims("cion").List(ctx, metav1.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// named volumes outlive the pods that use them
+	if len(l.Items) != 1 || l.Items[0].Name != "shared" {
+		t.Errorf("claims left after kill: %v", l.Items)
+	}
+}
+
+func TestKubernetesVolumesReadWriteMany(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+	e.VolumeAccessMode = corev1.ReadWriteMany
+
+	wd, err := e.Run(RunContainerOpts{Image: GitImage, Volumes: []string{BuildDir}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulePod(t, client, wd, "node-1", terminated(0, ""))
+
+	c, err := e.Run(RunContainerOpts{Image: "golang", VolumesFrom: []string{wd}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if a := getPod(t, client, c).Spec.Affinity; a != nil {
+		t.Errorf("affinity = %v, want none", a)
+	}
+}
+
+func TestKubernetesServices(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+	ctx := context.Background()
+
+	db, err := e.Run(RunContainerOpts{
+		Image:          "postgres",
+		Network:        "net",
+		NetworkAliases: []string{"db", "postgres"},
+		Ports:          []string{"5432"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err := client.CoreV1().Services("cion").Get(ctx, db, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.Selector[kubernetesPodLabel] != db || len(svc.Spec.Ports) != 1 ||
+		svc.Spec.Ports[0].Port != 5432 {
+		t.Errorf("service = %v", svc.Spec)
+	}
+
+	// the fake clientset doesn't allocate cluster IPs
+	svc.Spec.ClusterIP = "10.0.0.1"
+	if _, err := client.CoreV1().Services("cion").Update(ctx, svc,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := e.Run(RunContainerOpts{Image: "golang", Network: "net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliases := getPod(t, client, c).Spec.HostAliases
+	if len(aliases) != 1 || aliases[0].IP != "10.0.0.1" ||
+		strings.Join(aliases[0].Hostnames, ",") != "db,postgres" {
+		t.Errorf("host aliases = %v", aliases)
+	}
+
+	// a service without ports gets a headless service, which is reached at the pod's IP
+	cache, err := e.Run(RunContainerOpts{
+		Image:          "redis",
+		Network:        "net",
+		NetworkAliases: []string{"cache"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	svc, err = client.CoreV1().Services("cion").Get(ctx, cache, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if svc.Spec.ClusterIP != corev1.ClusterIPNone || len(svc.Spec.Ports) != 0 {
+		t.Errorf("service = %v, want a headless service", svc.Spec)
+	}
+
+	pod := getPod(t, client, cache)
+	pod.Status.PodIP = "10.1.0.5"
+	if _, err := client.CoreV1().Pods("cion").UpdateStatus(ctx, pod,
+		metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = e.Run(RunContainerOpts{Image: "golang", Network: "net"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, a := range getPod(t, client, c).Spec.HostAliases {
+		if a.IP == "10.1.0.5" && strings.Join(a.Hostnames, ",") == "cache" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("host aliases = %v, want cache at the pod's IP",
+			getPod(t, client, c).Spec.HostAliases)
+	}
+
+	if err := e.RemoveNetwork("net"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().Services("cion").Get(ctx, db, metav1.GetOptions{}); err == nil {
+		t.Error("service wasn't deleted with the network")
+	}
+}
+
+func TestKubernetesWait(t *testing.T) {
+	tests := []struct {
+		status corev1.PodStatus
+		code   int
+		err    error
+	}{
+		{status: terminated(0, "Completed"), code: 0},
+		{status: terminated(3, "Error"), code: 3},
+		{status: terminated(137, "OOMKilled"), code: 137, err: ErrOOMKilled},
+	}
+
+	for _, tt := range tests {
+		e, client := newTestKubernetesExecutor()
+
+		id, err := e.Run(RunContainerOpts{Image: "golang"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		schedulePod(t, client, id, "node-1", tt.status)
+
+		code, err := e.Wait(id)
+		if code != tt.code || err != tt.err {
+			t.Errorf("Wait() = %d, %v, want %d, %v", code, err, tt.code, tt.err)
+		}
+	}
+}
+
+func TestKubernetesWaitPending(t *testing.T) {
+	e, client := newTestKubernetesExecutor()
+	e.StartTimeout = 10 * time.Millisecond
+
+	id, err := e.Run(RunContainerOpts{Image: "golang"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schedulePod(t, client, id, "", corev1.PodStatus{
+		Phase: corev1.PodPending,
+		Conditions: []corev1.PodCondition{{
+			Type:    corev1.PodScheduled,
+			Status:  corev1.ConditionFalse,
+			Message: "0/3 nodes are available",
+		}},
+	})
+
+	_, err = e.Wait(id)
+	if err == nil || !strings.Contains(err.Error(), "0/3 nodes are available") {
+		t.Errorf("err = %v, want pending error", err)
+	}
+}
+
+func TestKubernetesWaitDeleted(t *testing.T) {
+	e, _ := newTestKubernetesExecutor()
+
+	id, err := e.Run(RunContainerOpts{Image: "golang"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := e.Kill(id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := e.Wait(id); err == nil {
+		t.Error("Wait() succeeded for a deleted pod")
+	}
+}
@@ -0,0 +1,813 @@
+package cion
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// localKillTimeout is how long a LocalExecutor waits for a killed container's process to exit
+// before it gives up on removing the container.
+const localKillTimeout = 10 * time.Second
+
+// LocalExecutor is an Executor that runs container commands directly as processes on the
+// host, without Docker. An image is the name of a toolchain that's installed on the host,
+// like "golang", and only the toolchains that the executor allows can be run.
+//
+// Container paths aren't available to host processes, so each volume is a directory on the
+// host, and any volume paths in a container's command, environment, and working directory are
+// rewritten to those directories. Services are reachable on localhost rather than by name.
+type LocalExecutor struct {
+	// Root is the directory that holds the volumes and images for containers.
+	Root string
+
+	// Toolchains are the images that can be run, each with a directory that's added to the
+	// front of the PATH, which can be empty. cion's own containers can always run GitImage,
+	// which is expected to be provided by the host's sh and git, but containers from job
+	// configs can only run it if it's one of the toolchains.
+	Toolchains map[string]string
+
+	// Isolate specifies whether processes run in their own namespaces, where the platform
+	// supports it. Processes aren't chrooted, so they can still see the host's filesystem.
+	Isolate bool
+
+	mu         sync.Mutex
+	containers map[string]*localContainer
+	images     map[string]*localImage
+}
+
+// localMount is a container path that's mapped to a directory on the host.
+type localMount struct {
+	path string
+	dir  string
+}
+
+// localImage is an image built by a LocalExecutor, whose files are in a directory on the
+// host.
+type localImage struct {
+	dir  string
+	base string
+}
+
+// localContainer is a process run by a LocalExecutor.
+type localContainer struct {
+	cmd    *exec.Cmd
+	image  *localImage
+	mounts []localMount
+	env    []string
+	dir    string
+
+	stdout *localOutput
+	stderr *localOutput
+
+	done     chan struct{}
+	exitCode int
+	err      error
+}
+
+// NewLocalExecutor returns a LocalExecutor that keeps volumes and images in a directory,
+// which is a new temporary directory if root is empty.
+func NewLocalExecutor(root string) (*LocalExecutor, error) {
+	var err error
+	if root == "" {
+		root, err = ioutil.TempDir("", "cion-local")
+	} else {
+		err = os.MkdirAll(root, 0755)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &LocalExecutor{
+		Root:       root,
+		Toolchains: make(map[string]string),
+		containers: make(map[string]*localContainer),
+		images:     make(map[string]*localImage),
+	}, nil
+}
+
+// ParseToolchains parses a list of toolchains in the form "name" or "name=/path/to/bin".
+func ParseToolchains(l []string) map[string]string {
+	m := make(map[string]string, len(l))
+	for _, t := range l {
+		parts := strings.SplitN(t, "=", 2)
+		if len(parts) == 2 {
+			m[parts[0]] = parts[1]
+		} else {
+			m[parts[0]] = ""
+		}
+	}
+
+	return m
+}
+
+// toolchain returns the directory for an image's toolchain, and whether the image can be run
+// by a container that's internal or not.
+func (e *LocalExecutor) toolchain(image string, internal bool) (string, bool) {
+	if internal && image == GitImage {
+		return "", true
+	}
+
+	dir, ok := e.Toolchains[image]
+	return dir, ok
+}
+
+// resolve returns the toolchain and the built image, if any, for an image that a container
+// runs.
+func (e *LocalExecutor) resolve(image string, internal bool) (string, *localImage, error) {
+	e.mu.Lock()
+	li := e.images[image]
+	e.mu.Unlock()
+
+	base := image
+	if li != nil {
+		base = li.base
+	}
+
+	dir, ok := e.toolchain(base, internal)
+	if !ok {
+		return "", nil, fmt.Errorf("image %s is not an allowed toolchain", base)
+	}
+
+	return dir, li, nil
+}
+
+// volumeDir returns the host directory for a named volume.
+func (e *LocalExecutor) volumeDir(name string) string {
+	return filepath.Join(e.Root, "volumes", name)
+}
+
+func (e *LocalExecutor) Run(opts RunContainerOpts) (string, error) {
+	if len(opts.Cmd) == 0 {
+		return "", errors.New("containers need a command to run with the local executor")
+	}
+
+	toolchain, li, err := e.resolve(opts.Image, opts.Internal)
+	if err != nil {
+		return "", err
+	}
+
+	id := "cion-" + uuid.New()
+	root := filepath.Join(e.Root, "containers", id)
+
+	var mounts []localMount
+	for _, vf := range opts.VolumesFrom {
+		c, err := e.container(containerName(vf))
+		if err != nil {
+			return "", err
+		}
+
+		mounts = append(mounts, c.mounts...)
+	}
+
+	for _, b := range opts.Binds {
+		parts := strings.Split(b, ":")
+		if len(parts) < 2 {
+			return "", fmt.Errorf("invalid volume %q", b)
+		}
+
+		mounts = append(mounts, localMount{path: parts[1], dir: e.volumeDir(parts[0])})
+	}
+
+	for i, v := range opts.Volumes {
+		mounts = append(mounts, localMount{
+			path: path.Clean(v),
+			dir:  filepath.Join(root, "volumes", fmt.Sprint(i)),
+		})
+	}
+
+	for _, m := range mounts {
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			return "", err
+		}
+	}
+
+	// mounts are rewritten longest first, so nested volumes take precedence
+	sort.Sort(mountsByLength(mounts))
+
+	home := filepath.Join(root, "home")
+	if err := os.MkdirAll(home, 0755); err != nil {
+		return "", err
+	}
+
+	c := &localContainer{
+		image:  li,
+		mounts: mounts,
+		dir:    home,
+		stdout: newLocalOutput(),
+		stderr: newLocalOutput(),
+		done:   make(chan struct{}),
+	}
+
+	pathEnv := os.Getenv("PATH")
+	if toolchain != "" {
+		pathEnv = toolchain + string(os.PathListSeparator) + pathEnv
+	}
+
+	c.env = []string{"PATH=" + pathEnv, "HOME=" + home}
+	for _, kv := range opts.Env {
+		c.env = append(c.env, c.rewrite(kv))
+	}
+
+	if opts.WorkingDir != "" {
+		c.dir = c.rewrite(opts.WorkingDir)
+	}
+
+	c.cmd = e.command(c, opts.Cmd)
+	c.cmd.Stdout = c.stdout
+	c.cmd.Stderr = c.stderr
+
+	if err := c.cmd.Start(); err != nil {
+		return "", err
+	}
+
+	go func() {
+		c.exitCode, c.err = exitCode(c.cmd.Wait())
+		c.stdout.Close()
+		c.stderr.Close()
+		close(c.done)
+	}()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.containers[id] = c
+
+	return id, nil
+}
+
+// command returns the command for a process in a container.
+func (e *LocalExecutor) command(c *localContainer, args []string) *exec.Cmd {
+	rewritten := make([]string, len(args))
+	for i, a := range args {
+		rewritten[i] = c.rewrite(a)
+	}
+
+	// look the command up in the container's PATH rather than ours
+	name := rewritten[0]
+	if !strings.Contains(name, "/") {
+		for _, kv := range c.env {
+			if strings.HasPrefix(kv, "PATH=") {
+				name = lookPath(name, strings.TrimPrefix(kv, "PATH="))
+			}
+		}
+	}
+
+	cmd := &exec.Cmd{
+		Path:        name,
+		Args:        rewritten,
+		Env:         c.env,
+		Dir:         c.dir,
+		SysProcAttr: sysProcAttr(e.Isolate),
+	}
+
+	return cmd
+}
+
+// rewrite replaces the container paths in a command argument or environment variable with
+// the host directories that they're mapped to. A value that's an absolute path to a file in
+// the container's image is replaced with the path to the file in the image directory.
+func (c *localContainer) rewrite(s string) string {
+	for _, m := range c.mounts {
+		s = m.regexp().ReplaceAllString(s, "${1}"+strings.Replace(m.dir, "$", "$$", -1)+"${2}")
+	}
+
+	if c.image == nil {
+		return s
+	}
+
+	// environment variables are rewritten by value
+	prefix, value := "", s
+	if i := strings.Index(s, "="); i >= 0 && !strings.HasPrefix(s, "/") {
+		prefix, value = s[:i+1], s[i+1:]
+	}
+
+	if path.IsAbs(value) {
+		p := filepath.Join(c.image.dir, filepath.FromSlash(value))
+		if _, err := os.Stat(p); err == nil {
+			return prefix + p
+		}
+	}
+
+	return s
+}
+
+// regexp returns a regexp that matches the mount's path wherever it appears as a whole path
+// or a path prefix.
+func (m localMount) regexp() *regexp.Regexp {
+	return regexp.MustCompile(`(^|[\s"'=:;(])` + regexp.QuoteMeta(m.path) + `(/|$|[\s"':;)])`)
+}
+
+func (e *LocalExecutor) container(id string) (*localContainer, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	c, ok := e.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+
+	return c, nil
+}
+
+func (e *LocalExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	if stdout == nil {
+		stdout = ioutil.Discard
+	}
+	if stderr == nil {
+		stderr = ioutil.Discard
+	}
+
+	errs := make(chan error, 2)
+	go func() { errs <- c.stdout.copyTo(stdout) }()
+	go func() { errs <- c.stderr.copyTo(stderr) }()
+
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *LocalExecutor) Wait(id string) (int, error) {
+	c, err := e.container(id)
+	if err != nil {
+		return 0, err
+	}
+
+	<-c.done
+	return c.exitCode, c.err
+}
+
+// Kill kills a container's process, and once it has exited, removes the container along with
+// its home directory and the volumes that it created, like the working directory of a job.
+func (e *LocalExecutor) Kill(id string) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-c.done:
+	default:
+		if err := killProcess(c.cmd.Process); err != nil {
+			return err
+		}
+
+		// a process that left children behind with its output can keep it open
+		select {
+		case <-c.done:
+		case <-time.After(localKillTimeout):
+			return fmt.Errorf("container %s didn't exit after it was killed", id)
+		}
+	}
+
+	e.mu.Lock()
+	delete(e.containers, id)
+	e.mu.Unlock()
+
+	return os.RemoveAll(filepath.Join(e.Root, "containers", id))
+}
+
+func (e *LocalExecutor) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	c, err := e.container(id)
+	if err != nil {
+		return 0, err
+	} else if len(cmd) == 0 {
+		return 0, errors.New("no command to exec")
+	}
+
+	p := e.command(c, cmd)
+	p.Stdout = stdout
+	p.Stderr = stderr
+
+	return exitCode(p.Run())
+}
+
+// Build extracts the build context into a directory that containers for the image can read
+// files from. Only the FROM, COPY, and ADD instructions of the Dockerfile are supported, and
+// the FROM image must be an allowed toolchain.
+func (e *LocalExecutor) Build(opts BuildOpts) (string, error) {
+	name := opts.Name
+	if name == "" {
+		name = "cion-" + uuid.New()
+	}
+
+	dockerfile := opts.Dockerfile
+	if dockerfile == "" {
+		dockerfile = "Dockerfile"
+	}
+
+	tmp, err := ioutil.TempDir(e.Root, "build")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp)
+
+	context := filepath.Join(tmp, "context")
+	if err := extractTar(context, opts.Input); err != nil {
+		return "", err
+	}
+
+	f, err := os.Open(filepath.Join(context, filepath.FromSlash(dockerfile)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	imageDir := nonAlphanumericRegexp.ReplaceAllString(name, "-")
+	li := &localImage{dir: filepath.Join(e.Root, "images", imageDir)}
+	if err := os.RemoveAll(li.dir); err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(li.dir, 0755); err != nil {
+		return "", err
+	}
+
+	output := opts.Output
+	if output == nil {
+		output = ioutil.Discard
+	}
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fmt.Fprintln(output, line)
+		fields := strings.Fields(line)
+
+		switch instr := strings.ToUpper(fields[0]); {
+		case instr == "FROM" && len(fields) >= 2:
+			li.base = fields[1]
+		case (instr == "COPY" || instr == "ADD") && len(fields) >= 3:
+			if err := copyToImage(context, li.dir, fields[1:len(fields)-1],
+				fields[len(fields)-1]); err != nil {
+				return "", err
+			}
+		default:
+			return "", fmt.Errorf("%s instructions aren't supported by the local executor",
+				instr)
+		}
+	}
+	if err := s.Err(); err != nil {
+		return "", err
+	}
+
+	if _, ok := e.toolchain(li.base, opts.Internal); !ok {
+		return "", fmt.Errorf("image %s is not an allowed toolchain", li.base)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.images[name] = li
+
+	return name, nil
+}
+
+// HasImage returns whether an image was built, or is an allowed toolchain. Toolchains are
+// never pulled, and GitImage is always provided by the host.
+func (e *LocalExecutor) HasImage(image string) (bool, error) {
+	if _, ok := e.toolchain(image, true); ok {
+		return true, nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok := e.images[image]
+	return ok, nil
+}
+
+func (e *LocalExecutor) Tag(image, repository, tag string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	li, ok := e.images[image]
+	if !ok {
+		return fmt.Errorf("no such image: %s", image)
+	}
+
+	e.images[repository+":"+tag] = li
+	return nil
+}
+
+func (e *LocalExecutor) Push(opts PushOpts) (string, error) {
+	return "", ErrNotSupported
+}
+
+// CreateNetwork doesn't create anything, since processes share the host's network.
+func (e *LocalExecutor) CreateNetwork(name string) (string, error) {
+	return name, nil
+}
+
+func (e *LocalExecutor) RemoveNetwork(id string) error {
+	return nil
+}
+
+func (e *LocalExecutor) Import(id, p string, input io.Reader) error {
+	c, err := e.container(id)
+	if err != nil {
+		return err
+	}
+
+	dir := c.rewrite(p)
+	if dir == p {
+		return fmt.Errorf("%s isn't in a volume of container %s", p, id)
+	}
+
+	return extractTar(dir, input)
+}
+
+func (e *LocalExecutor) RemoveVolume(name string) error {
+	return os.RemoveAll(e.volumeDir(name))
+}
+
+// localOutput is the output of a process, which can be copied to several writers while the
+// process runs.
+type localOutput struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newLocalOutput() *localOutput {
+	o := &localOutput{}
+	o.cond = sync.NewCond(&o.mu)
+
+	return o
+}
+
+func (o *localOutput) Write(p []byte) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.buf.Write(p)
+	o.cond.Broadcast()
+
+	return len(p), nil
+}
+
+// Close marks the end of the output.
+func (o *localOutput) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	o.cond.Broadcast()
+
+	return nil
+}
+
+// copyTo copies all of the output to a writer, and returns once the output ends.
+func (o *localOutput) copyTo(w io.Writer) error {
+	offset := 0
+	for {
+		o.mu.Lock()
+		for o.buf.Len() == offset && !o.closed {
+			o.cond.Wait()
+		}
+
+		b := append([]byte{}, o.buf.Bytes()[offset:]...)
+		closed := o.closed
+		o.mu.Unlock()
+
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+
+		offset += len(b)
+		if closed {
+			return nil
+		}
+	}
+}
+
+// exitCode returns the exit code of a process from the error returned when waiting for it.
+func exitCode(err error) (int, error) {
+	if err == nil {
+		return 0, nil
+	}
+
+	if ee, ok := err.(*exec.ExitError); ok {
+		if ws, ok := ee.Sys().(syscall.WaitStatus); ok {
+			if ws.Signaled() {
+				return 128 + int(ws.Signal()), nil
+			}
+
+			return ws.ExitStatus(), nil
+		}
+	}
+
+	return 0, err
+}
+
+// lookPath finds an executable in a PATH, or returns the name if it isn't found.
+func lookPath(name, pathEnv string) string {
+	for _, dir := range filepath.SplitList(pathEnv) {
+		p := filepath.Join(dir, name)
+		if fi, err := os.Stat(p); err == nil && !fi.IsDir() && fi.Mode()&0111 != 0 {
+			return p
+		}
+	}
+
+	return name
+}
+
+// extractTar extracts a tar archive into a directory. Symlinks can only point to paths in the
+// directory, and entries can't be written through symlinks that lead out of it.
+func extractTar(dir string, r io.Reader) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		p := filepath.Join(root, filepath.FromSlash(path.Clean("/"+hdr.Name)))
+		mode := os.FileMode(hdr.Mode).Perm()
+
+		// symlinks are replaced, so it's the directory that they're in that has to be inside
+		target := p
+		if hdr.Typeflag == tar.TypeSymlink {
+			target = filepath.Dir(p)
+		}
+
+		if err := checkInside(root, target); err != nil {
+			return fmt.Errorf("can't extract %s: %v", hdr.Name, err)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(p, mode|0700)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeFile(p, tr, mode)
+		case tar.TypeSymlink:
+			link := filepath.FromSlash(hdr.Linkname)
+			if filepath.IsAbs(link) || !isInside(root, filepath.Join(filepath.Dir(p), link)) {
+				return fmt.Errorf("can't extract %s: symlink to %s leads out of %s", hdr.Name,
+					hdr.Linkname, dir)
+			}
+
+			if err = os.MkdirAll(filepath.Dir(p), 0755); err == nil {
+				os.Remove(p)
+				err = os.Symlink(hdr.Linkname, p)
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// checkInside returns an error if a path resolves to somewhere outside of a directory once any
+// symlinks in it are followed. The directory must already have its symlinks resolved.
+func checkInside(root, p string) error {
+	// find the part of the path that exists, since the rest can't have any symlinks in it
+	existing, rest := p, ""
+	for {
+		resolved, err := filepath.EvalSymlinks(existing)
+		if err == nil {
+			p = filepath.Join(resolved, rest)
+			break
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// a symlink that doesn't lead anywhere yet would be followed when it's written to
+		if _, err := os.Lstat(existing); err == nil {
+			return fmt.Errorf("%s is a broken symlink", existing)
+		}
+
+		rest = filepath.Join(filepath.Base(existing), rest)
+		existing = filepath.Dir(existing)
+	}
+
+	if !isInside(root, p) {
+		return fmt.Errorf("%s is outside of %s", p, root)
+	}
+
+	return nil
+}
+
+// isInside returns whether a path is a directory or inside of it, without following symlinks.
+func isInside(dir, p string) bool {
+	rel, err := filepath.Rel(dir, p)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// copyToImage copies files from a build context into an image directory, like the COPY
+// instruction of a Dockerfile.
+func copyToImage(context, image string, srcs []string, dest string) error {
+	destDir := strings.HasSuffix(dest, "/") || len(srcs) > 1
+
+	for _, src := range srcs {
+		from := filepath.Join(context, filepath.FromSlash(path.Clean("/"+src)))
+		to := filepath.Join(image, filepath.FromSlash(path.Clean("/"+dest)))
+
+		fi, err := os.Stat(from)
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() && destDir {
+			to = filepath.Join(to, filepath.Base(from))
+		}
+
+		err = filepath.Walk(from, func(p string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+
+			rel, err := filepath.Rel(from, p)
+			if err != nil {
+				return err
+			}
+			target := filepath.Join(to, rel)
+
+			if fi.IsDir() {
+				return os.MkdirAll(target, fi.Mode().Perm()|0700)
+			}
+
+			f, err := os.Open(p)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			return writeFile(target, f, fi.Mode().Perm())
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeFile writes a file from a reader, creating its directory if needed.
+func writeFile(p string, r io.Reader, mode os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// mountsByLength sorts mounts from the longest path to the shortest.
+type mountsByLength []localMount
+
+func (l mountsByLength) Len() int           { return len(l) }
+func (l mountsByLength) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l mountsByLength) Less(i, j int) bool { return len(l[i].path) > len(l[j].path) }
@@ -0,0 +1,28 @@
+package cion
+
+import (
+	"os"
+	"syscall"
+)
+
+// sysProcAttr returns the attributes for a process run by a LocalExecutor. Each process gets
+// its own process group, so that it can be killed along with its children. Isolated
+// processes also get their own user, mount, PID, UTS, and IPC namespaces, and run as root in
+// their user namespace.
+func sysProcAttr(isolate bool) *syscall.SysProcAttr {
+	attr := &syscall.SysProcAttr{Setpgid: true}
+
+	if isolate {
+		attr.Cloneflags = syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWUTS | syscall.CLONE_NEWIPC
+		attr.UidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getuid(), Size: 1}}
+		attr.GidMappings = []syscall.SysProcIDMap{{ContainerID: 0, HostID: os.Getgid(), Size: 1}}
+	}
+
+	return attr
+}
+
+// killProcess kills a process and the rest of its process group.
+func killProcess(p *os.Process) error {
+	return syscall.Kill(-p.Pid, syscall.SIGKILL)
+}
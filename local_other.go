@@ -0,0 +1,25 @@
+//go:build !linux
+// +build !linux
+
+package cion
+
+import (
+	"log"
+	"os"
+	"syscall"
+)
+
+// sysProcAttr returns the attributes for a process run by a LocalExecutor. Namespaces are
+// only available on Linux, so processes can't be isolated.
+func sysProcAttr(isolate bool) *syscall.SysProcAttr {
+	if isolate {
+		log.Println("processes can only be isolated on linux")
+	}
+
+	return nil
+}
+
+// killProcess kills a process.
+func killProcess(p *os.Process) error {
+	return p.Kill()
+}
@@ -0,0 +1,352 @@
+package cion
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tarEntry is a file, directory, or symlink for a test tar archive.
+type tarEntry struct {
+	name     string
+	typeflag byte
+	body     string
+	link     string
+	mode     int64
+}
+
+func testTar(t *testing.T, entries ...tarEntry) *bytes.Buffer {
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+		}
+
+		hdr := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.link,
+			Mode:     mode,
+			Size:     int64(len(e.body)),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return &b
+}
+
+// listFiles returns the paths of the files and symlinks in a directory, relative to it.
+func listFiles(t *testing.T, dir string) []string {
+	var l []string
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !fi.IsDir() {
+			rel, _ := filepath.Rel(dir, p)
+			l = append(l, filepath.ToSlash(rel))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sort.Strings(l)
+	return l
+}
+
+func TestLocalRewrite(t *testing.T) {
+	image := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(image, "run.sh"), nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	mounts := []localMount{
+		{path: BuildDir, dir: "/host/build"},
+		{path: BuildDir + "/cache", dir: "/host/cache"},
+		{path: ArtifactsDir, dir: "/host/$1/artifacts"},
+	}
+	sort.Sort(mountsByLength(mounts))
+
+	c := &localContainer{mounts: mounts, image: &localImage{dir: image}}
+
+	tests := []struct {
+		in, out string
+	}{
+		{BuildDir, "/host/build"},
+		{BuildDir + "/src/main.go", "/host/build/src/main.go"},
+		{"BUILD_DIR=" + BuildDir, "BUILD_DIR=/host/build"},
+		{"cd " + BuildDir + " && make", "cd /host/build && make"},
+		{`tar -C "` + BuildDir + `" -x`, `tar -C "/host/build" -x`},
+		{"PATHS=" + BuildDir + ":" + ArtifactsDir, "PATHS=/host/build:/host/$1/artifacts"},
+		{BuildDir + "/cache/go", "/host/cache/go"},
+		{BuildDir + "x", BuildDir + "x"},
+		{"/other" + BuildDir, "/other" + BuildDir},
+		{"/run.sh", filepath.Join(image, "run.sh")},
+		{"SCRIPT=/run.sh", "SCRIPT=" + filepath.Join(image, "run.sh")},
+		{"/missing.sh", "/missing.sh"},
+		{"make", "make"},
+	}
+
+	for _, tt := range tests {
+		if out := c.rewrite(tt.in); out != tt.out {
+			t.Errorf("rewrite(%q) = %q, want %q", tt.in, out, tt.out)
+		}
+	}
+}
+
+func TestCopyToImage(t *testing.T) {
+	context := t.TempDir()
+	for p, mode := range map[string]os.FileMode{
+		"Dockerfile":      0644,
+		"run.sh":          0755,
+		"src/main.go":     0644,
+		"src/lib/util.go": 0644,
+	} {
+		p = filepath.Join(context, filepath.FromSlash(p))
+		if err := writeFile(p, strings.NewReader(p), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		srcs  []string
+		dest  string
+		files []string
+		err   bool
+	}{
+		{srcs: []string{"run.sh"}, dest: "/app/", files: []string{"app/run.sh"}},
+		{srcs: []string{"run.sh"}, dest: "/bin/start", files: []string{"bin/start"}},
+		{srcs: []string{"src"}, dest: "/app", files: []string{"app/lib/util.go", "app/main.go"}},
+		{srcs: []string{"./src/lib"}, dest: "app", files: []string{"app/util.go"}},
+		{
+			srcs:  []string{"run.sh", "Dockerfile"},
+			dest:  "/app",
+			files: []string{"app/Dockerfile", "app/run.sh"},
+		},
+		{srcs: []string{"../../run.sh"}, dest: "/", files: []string{"run.sh"}},
+		{srcs: []string{"missing"}, dest: "/app", err: true},
+	}
+
+	for _, tt := range tests {
+		image := t.TempDir()
+
+		err := copyToImage(context, image, tt.srcs, tt.dest)
+		if tt.err {
+			if err == nil {
+				t.Errorf("copying %v to %s succeeded", tt.srcs, tt.dest)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("copying %v to %s: %v", tt.srcs, tt.dest, err)
+			continue
+		}
+
+		if files := listFiles(t, image); strings.Join(files, ",") !=
+			strings.Join(tt.files, ",") {
+			t.Errorf("copying %v to %s made %v, want %v", tt.srcs, tt.dest, files, tt.files)
+		}
+	}
+
+	// files keep their modes, like they would with Docker
+	image := t.TempDir()
+	if err := copyToImage(context, image, []string{"run.sh"}, "/"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Stat(filepath.Join(image, "run.sh")); err != nil ||
+		fi.Mode().Perm() != 0755 {
+		t.Errorf("run.sh = %v, %v, want mode 0755", fi, err)
+	}
+}
+
+func TestExtractTar(t *testing.T) {
+	dir := t.TempDir()
+
+	err := extractTar(dir, testTar(t,
+		tarEntry{name: "src/", typeflag: tar.TypeDir, mode: 0755},
+		tarEntry{name: "src/main.go", typeflag: tar.TypeReg, body: "package main"},
+		tarEntry{name: "main.go", typeflag: tar.TypeSymlink, link: "src/main.go"},
+		tarEntry{name: "src/self", typeflag: tar.TypeSymlink, link: "../src"},
+		tarEntry{name: "../../escape", typeflag: tar.TypeReg, body: "inside"},
+	))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "escape,main.go,src/main.go,src/self"
+	if files := listFiles(t, dir); strings.Join(files, ",") != want {
+		t.Errorf("files = %v, want %s", files, want)
+	}
+
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "main.go")); err != nil ||
+		string(b) != "package main" {
+		t.Errorf("main.go = %q, %v", b, err)
+	}
+}
+
+func TestExtractTarOutside(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []tarEntry
+	}{
+		{
+			name: "absolute symlink",
+			entries: []tarEntry{
+				{name: "etc", typeflag: tar.TypeSymlink, link: "/etc"},
+			},
+		},
+		{
+			name: "relative symlink",
+			entries: []tarEntry{
+				{name: "src/up", typeflag: tar.TypeSymlink, link: "../../out"},
+			},
+		},
+		{
+			name: "file through symlinks",
+			entries: []tarEntry{
+				{name: "self", typeflag: tar.TypeSymlink, link: "."},
+				{name: "out", typeflag: tar.TypeSymlink, link: "self/../out"},
+				{name: "out/file", typeflag: tar.TypeReg, body: "outside"},
+			},
+		},
+		{
+			name: "file replacing symlink",
+			entries: []tarEntry{
+				{name: "self", typeflag: tar.TypeSymlink, link: "."},
+				{name: "victim", typeflag: tar.TypeSymlink, link: "self/../victim"},
+				{name: "victim", typeflag: tar.TypeReg, body: "outside"},
+			},
+		},
+		{
+			name: "broken symlink",
+			entries: []tarEntry{
+				{name: "self", typeflag: tar.TypeSymlink, link: "."},
+				{name: "gone", typeflag: tar.TypeSymlink, link: "self/../gone"},
+				{name: "gone/file", typeflag: tar.TypeReg, body: "outside"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		base := t.TempDir()
+		if err := os.Mkdir(filepath.Join(base, "out"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(base, "victim"), []byte("ok"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(base, "dir")
+		if err := extractTar(dir, testTar(t, tt.entries...)); err == nil {
+			t.Errorf("%s: extracting succeeded", tt.name)
+		}
+
+		if files := listFiles(t, filepath.Join(base, "out")); len(files) != 0 {
+			t.Errorf("%s: wrote %v outside of the directory", tt.name, files)
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(base, "victim")); string(b) != "ok" {
+			t.Errorf("%s: overwrote a file outside of the directory", tt.name)
+		}
+	}
+}
+
+func TestLocalGitImage(t *testing.T) {
+	e, err := NewLocalExecutor(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only cion's own containers can use the host's shell as GitImage
+	_, err = e.Run(RunContainerOpts{Image: GitImage, Cmd: []string{"true"}})
+	if err == nil || !strings.Contains(err.Error(), "not an allowed toolchain") {
+		t.Errorf("err = %v, want a toolchain error", err)
+	}
+
+	id, err := e.Run(RunContainerOpts{Image: GitImage, Cmd: []string{"true"}, Internal: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, err := e.Wait(id); code != 0 || err != nil {
+		t.Errorf("Wait() = %d, %v", code, err)
+	}
+
+	input := func() *bytes.Buffer {
+		return testTar(t, tarEntry{
+			name:     "Dockerfile",
+			typeflag: tar.TypeReg,
+			body:     "FROM " + GitImage + "\n",
+		})
+	}
+
+	if _, err := e.Build(BuildOpts{Input: input()}); err == nil {
+		t.Error("built an image from GitImage for a job")
+	}
+	if _, err := e.Build(BuildOpts{Input: input(), Internal: true}); err != nil {
+		t.Error(err)
+	}
+
+	// GitImage can run for jobs when it's given as a toolchain
+	e.Toolchains[GitImage] = ""
+	if _, err := e.Run(RunContainerOpts{Image: GitImage, Cmd: []string{"true"}}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLocalKill(t *testing.T) {
+	e, err := NewLocalExecutor(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range [][]string{{"sleep", "60"}, {"true"}} {
+		id, err := e.Run(RunContainerOpts{
+			Image:    GitImage,
+			Cmd:      cmd,
+			Volumes:  []string{BuildDir},
+			Internal: true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dir := filepath.Join(e.Root, "containers", id)
+		if _, err := os.Stat(dir); err != nil {
+			t.Fatal(err)
+		}
+
+		if cmd[0] == "true" {
+			e.Wait(id)
+		}
+
+		// killed containers are removed along with their volumes, whether or not they exited
+		if err := e.Kill(id); err != nil {
+			t.Errorf("%v: %v", cmd, err)
+		}
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("%v: container directory wasn't removed: %v", cmd, err)
+		}
+		if _, err := e.Wait(id); err == nil {
+			t.Errorf("%v: container still exists", cmd)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package cion
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// LockPollInterval is how often a job waiting for a concurrency group lock checks whether it
+// can acquire the lock.
+var LockPollInterval = 5 * time.Second
+
+// JobRef is a reference to a job by its owner/repo and number.
+type JobRef struct {
+	Owner  string
+	Repo   string
+	Number uint64
+}
+
+func refOf(j *Job) JobRef {
+	return JobRef{Owner: j.Owner, Repo: j.Repo, Number: j.Number}
+}
+
+// Lock is a lock for a concurrency group, which is held by at most one job at a time. Jobs
+// waiting for the lock acquire it in the order that they started waiting.
+type Lock struct {
+	Name    string
+	Holder  *JobRef
+	Waiting []JobRef
+}
+
+// acquire tries to acquire the lock for a job, and adds the job to the waiting list if it
+// can't. Jobs that have ended are removed from the lock first, which releases locks held by
+// jobs that were interrupted. If it can't be determined whether a job has ended, the lock is
+// left as is and the error is returned.
+func (l *Lock) acquire(ref JobRef, ended func(JobRef) (bool, error)) (bool, error) {
+	if l.Holder != nil && *l.Holder != ref {
+		if e, err := ended(*l.Holder); err != nil {
+			return false, err
+		} else if e {
+			l.Holder = nil
+		}
+	}
+
+	var waiting []JobRef
+	for _, w := range l.Waiting {
+		if w == ref {
+			waiting = append(waiting, w)
+		} else if e, err := ended(w); err != nil {
+			return false, err
+		} else if !e {
+			waiting = append(waiting, w)
+		}
+	}
+	l.Waiting = waiting
+
+	if l.Holder != nil && *l.Holder == ref {
+		return true, nil
+	}
+
+	if l.Holder == nil && (len(l.Waiting) == 0 || l.Waiting[0] == ref) {
+		l.release(ref)
+		l.Holder = &ref
+		return true, nil
+	}
+
+	for _, w := range l.Waiting {
+		if w == ref {
+			return false, nil
+		}
+	}
+
+	l.Waiting = append(l.Waiting, ref)
+	return false, nil
+}
+
+// release releases the lock if it is held by the job, and removes the job from the waiting
+// list.
+func (l *Lock) release(ref JobRef) {
+	if l.Holder != nil && *l.Holder == ref {
+		l.Holder = nil
+	}
+
+	waiting := l.Waiting[:0]
+	for _, w := range l.Waiting {
+		if w != ref {
+			waiting = append(waiting, w)
+		}
+	}
+	l.Waiting = waiting
+}
+
+// newerWaiter returns a job waiting for the lock that is newer than the given job, if any.
+func (l *Lock) newerWaiter(ref JobRef) *JobRef {
+	for _, w := range l.Waiting {
+		if w.Owner == ref.Owner && w.Repo == ref.Repo && w.Number > ref.Number {
+			return &w
+		}
+	}
+
+	return nil
+}
+
+// errSuperseded is returned when a job stops waiting for a lock because a newer job is
+// waiting for it.
+var errSuperseded = errors.New("superseded by a newer job")
+
+// lockGroup waits until a job acquires the lock for a stage's concurrency group, and returns a
+// function that releases the lock. If the stage supersedes older jobs, a job gives up waiting
+// as soon as a newer job starts waiting for the lock.
+func lockGroup(r JobRequest, stage string, cc ContainerConfig, jl JobLogger) (func(), error) {
+	j := r.Job
+	ref := refOf(j)
+	name := fmt.Sprintf("%s/%s/%s", j.Owner, j.Repo, cc.Concurrency)
+
+	release := func() {
+		if err := r.Store.ReleaseLock(name, ref); err != nil {
+			fmt.Fprintf(jl, "ERROR: couldn't release concurrency group %s: %v\n",
+				cc.Concurrency, err)
+		}
+	}
+
+	for waiting := false; ; waiting = true {
+		l, ok, err := r.Store.AcquireLock(name, ref)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			if waiting {
+				j.Status = JobRunning
+				if err := r.Store.Save(j); err != nil {
+					release()
+					return nil, err
+				}
+			}
+
+			return release, nil
+		}
+
+		if newer := l.newerWaiter(ref); cc.Supersede && newer != nil {
+			release()
+
+			j.Status = JobSuperseded
+			j.SupersededBy = newer.Number
+			return nil, errSuperseded
+		}
+
+		if !waiting {
+			j.Status = JobWaiting
+			if err := r.Store.Save(j); err != nil {
+				release()
+				return nil, err
+			}
+
+			holder := "another job"
+			if l.Holder != nil {
+				holder = fmt.Sprintf("job #%d", l.Holder.Number)
+			}
+
+			jl.WriteStep(fmt.Sprintf("waiting for %s to leave concurrency group %s before %s",
+				holder, cc.Concurrency, stage))
+		}
+
+		var cancelled <-chan struct{}
+		if r.Tracker != nil {
+			cancelled = r.Tracker.cancelled(j)
+		}
+
+		select {
+		case <-cancelled:
+			release()
+			return nil, errCancelled
+		case <-time.After(LockPollInterval):
+		}
+	}
+}
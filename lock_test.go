@@ -0,0 +1,94 @@
+package cion
+
+import (
+	"testing"
+)
+
+func TestLockOrder(t *testing.T) {
+	refs := []JobRef{
+		{Owner: "rohan", Repo: "cion", Number: 1},
+		{Owner: "rohan", Repo: "cion", Number: 2},
+		{Owner: "rohan", Repo: "cion", Number: 3},
+		{Owner: "rohan", Repo: "cion", Number: 4},
+	}
+
+	ended := map[JobRef]bool{}
+	isEnded := func(ref JobRef) (bool, error) { return ended[ref], nil }
+
+	l := &Lock{Name: "rohan/cion/production"}
+	acquire := func(ref JobRef) bool {
+		ok, err := l.acquire(ref, isEnded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !acquire(refs[0]) {
+		t.Fatal("first job didn't acquire the lock")
+	}
+
+	// jobs queue up in the order that they start waiting, however often they poll
+	for _, i := range []int{2, 1, 3, 2, 1} {
+		if acquire(refs[i]) {
+			t.Fatalf("job %d acquired a held lock", refs[i].Number)
+		}
+	}
+	if want := []JobRef{refs[2], refs[1], refs[3]}; !equalRefs(l.Waiting, want) {
+		t.Fatalf("waiting = %v, want %v", l.Waiting, want)
+	}
+
+	tests := []struct {
+		release JobRef
+		end     bool
+		holder  JobRef
+	}{
+		// only the job at the front of the queue acquires a released lock
+		{release: refs[0], holder: refs[2]},
+
+		// a job that ends without releasing the lock loses it
+		{release: refs[2], end: true, holder: refs[1]},
+		{release: refs[1], holder: refs[3]},
+	}
+
+	done := map[JobRef]bool{}
+	for _, tt := range tests {
+		if tt.end {
+			ended[tt.release] = true
+		} else {
+			l.release(tt.release)
+		}
+		done[tt.release] = true
+
+		for _, ref := range refs {
+			if done[ref] {
+				continue
+			}
+
+			if ok := acquire(ref); ok != (ref == tt.holder) {
+				t.Errorf("after job %d, job %d acquired the lock = %v", tt.release.Number,
+					ref.Number, ok)
+			}
+		}
+
+		if l.Holder == nil || *l.Holder != tt.holder {
+			t.Errorf("after job %d, holder = %v, want job %d", tt.release.Number, l.Holder,
+				tt.holder.Number)
+		}
+	}
+}
+
+// equalRefs returns true if two lists of job refs are the same.
+func equalRefs(a, b []JobRef) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
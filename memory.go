@@ -1,9 +1,13 @@
 package cion
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
+	"sort"
+	"sync"
 )
 
 // InMemoryJobStore is a mock JobStore that only stores jobs in memory and writes logs directly
@@ -12,6 +16,17 @@ type InMemoryJobStore struct {
 	jobCounter       uint64
 	jobCounterByRepo map[string]uint64
 	jobs             map[uint64]*Job
+	deployments      []*Deployment
+
+	// locks are used by concurrent jobs, so they're guarded by a mutex
+	locksMu sync.Mutex
+	locks   map[string]*Lock
+
+	cachesMu sync.Mutex
+	caches   []*CacheEntry
+
+	artifactsMu sync.Mutex
+	artifacts   map[string][]byte
 }
 
 func NewInMemoryJobStore() *InMemoryJobStore {
@@ -19,11 +34,13 @@ func NewInMemoryJobStore() *InMemoryJobStore {
 		jobCounter:       0,
 		jobCounterByRepo: make(map[string]uint64),
 		jobs:             make(map[uint64]*Job),
+		locks:            make(map[string]*Lock),
+		artifacts:        make(map[string][]byte),
 	}
 }
 
 func (s *InMemoryJobStore) GetByNumber(owner, repo string, number uint64) (*Job, error) {
-	jobs, err := s.List(owner, repo)
+	jobs, err := s.List(owner, repo, JobFilter{})
 	if err != nil {
 		return nil, err
 	}
@@ -69,11 +86,11 @@ func (s *InMemoryJobStore) ListRepos(owner string) ([]string, error) {
 	return l, nil
 }
 
-func (s *InMemoryJobStore) List(owner, repo string) ([]*Job, error) {
+func (s *InMemoryJobStore) List(owner, repo string, f JobFilter) ([]*Job, error) {
 	var l []*Job
 
 	for _, j := range s.jobs {
-		if j.Owner == owner && j.Repo == repo {
+		if j.Owner == owner && j.Repo == repo && f.Match(j) {
 			l = append(l, j)
 		}
 	}
@@ -102,10 +119,148 @@ func (s *InMemoryJobStore) Save(j *Job) error {
 	return nil
 }
 
+func (s *InMemoryJobStore) SaveDeployment(d *Deployment) error {
+	s.deployments = append(s.deployments, d)
+	return nil
+}
+
+func (s *InMemoryJobStore) ListDeployments(owner, repo, environment string) ([]*Deployment,
+	error) {
+	var l []*Deployment
+
+	for i := len(s.deployments) - 1; i >= 0; i-- {
+		d := s.deployments[i]
+		if d.Owner == owner && d.Repo == repo &&
+			(environment == "" || d.Environment == environment) {
+			l = append(l, d)
+		}
+	}
+
+	return l, nil
+}
+
+func (s *InMemoryJobStore) AcquireLock(name string, ref JobRef) (*Lock, bool, error) {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+
+	l, ok := s.locks[name]
+	if !ok {
+		l = &Lock{Name: name}
+		s.locks[name] = l
+	}
+
+	acquired, err := l.acquire(ref, func(r JobRef) (bool, error) {
+		j, err := s.GetByNumber(r.Owner, r.Repo, r.Number)
+		if err != nil {
+			return false, err
+		}
+
+		return j == nil || j.EndedAt != nil, nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	c := *l
+	c.Waiting = append([]JobRef(nil), l.Waiting...)
+	return &c, acquired, nil
+}
+
+func (s *InMemoryJobStore) ReleaseLock(name string, ref JobRef) error {
+	s.locksMu.Lock()
+	defer s.locksMu.Unlock()
+
+	if l, ok := s.locks[name]; ok {
+		l.release(ref)
+	}
+
+	return nil
+}
+
+func (s *InMemoryJobStore) SaveCache(c *CacheEntry) error {
+	s.cachesMu.Lock()
+	defer s.cachesMu.Unlock()
+
+	for i, e := range s.caches {
+		if e.Owner == c.Owner && e.Repo == c.Repo && e.Key == c.Key {
+			s.caches[i] = c
+			return nil
+		}
+	}
+
+	s.caches = append(s.caches, c)
+	return nil
+}
+
+func (s *InMemoryJobStore) ListCaches(owner, repo string) ([]*CacheEntry, error) {
+	s.cachesMu.Lock()
+	defer s.cachesMu.Unlock()
+
+	var l []*CacheEntry
+	for _, c := range s.caches {
+		if c.Owner == owner && c.Repo == repo {
+			l = append(l, c)
+		}
+	}
+
+	sort.Sort(cachesByUse(l))
+	return l, nil
+}
+
+func (s *InMemoryJobStore) DeleteCache(owner, repo, key string) error {
+	s.cachesMu.Lock()
+	defer s.cachesMu.Unlock()
+
+	for i, c := range s.caches {
+		if c.Owner == owner && c.Repo == repo && c.Key == key {
+			s.caches = append(s.caches[:i], s.caches[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+func (s *InMemoryJobStore) SaveArtifacts(j *Job, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	s.artifactsMu.Lock()
+	defer s.artifactsMu.Unlock()
+
+	s.artifacts[trackerKey(j.Owner, j.Repo, j.Number)] = b
+	return nil
+}
+
+func (s *InMemoryJobStore) GetArtifacts(j *Job, w io.Writer) error {
+	s.artifactsMu.Lock()
+	b, ok := s.artifacts[trackerKey(j.Owner, j.Repo, j.Number)]
+	s.artifactsMu.Unlock()
+
+	if !ok {
+		return errors.New("no artifacts saved for job")
+	}
+
+	_, err := w.Write(b)
+	return err
+}
+
+func (s *InMemoryJobStore) DeleteArtifacts(j *Job) error {
+	s.artifactsMu.Lock()
+	defer s.artifactsMu.Unlock()
+
+	delete(s.artifacts, trackerKey(j.Owner, j.Repo, j.Number))
+	return nil
+}
+
 func (s *InMemoryJobStore) GetLogger(j *Job) JobLogger {
 	return NewWriterLogger(os.Stdout)
 }
 
+// WriterLogger is a JobLogger that writes directly to an io.Writer. Named log streams are
+// written to the same writer, with each line prefixed by the stream name.
 type WriterLogger struct {
 	w io.Writer
 }
@@ -114,6 +269,35 @@ func NewWriterLogger(w io.Writer) WriterLogger {
 	return WriterLogger{w: w}
 }
 
+func (wl WriterLogger) Stream(name string) JobLogger {
+	return NewWriterLogger(&prefixWriter{w: wl.w, prefix: []byte(name + " | ")})
+}
+
+// prefixWriter writes a prefix at the start of every line.
+type prefixWriter struct {
+	w       io.Writer
+	prefix  []byte
+	midLine bool
+}
+
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	var b []byte
+	for _, c := range p {
+		if !pw.midLine {
+			b = append(b, pw.prefix...)
+		}
+
+		b = append(b, c)
+		pw.midLine = c != '\n'
+	}
+
+	if _, err := pw.w.Write(b); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
 func (wl WriterLogger) Write(p []byte) (int, error) {
 	return wl.w.Write(p)
 }
@@ -0,0 +1,122 @@
+package cion
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Parameter types that can be declared in .cion.yml.
+const (
+	ParameterString = "string"
+	ParameterBool   = "bool"
+	ParameterNumber = "number"
+)
+
+var parameterNameRegexp = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// reservedParameters are names that can't be used for parameters, since they would clobber
+// environment variables that cion sets itself.
+var reservedParameters = map[string]bool{
+	"BUILD_DIR":          true,
+	"ARTIFACTS_DIR":      true,
+	"DEPLOY_ENVIRONMENT": true,
+	"DEPENDENCIES_DIR":   true,
+}
+
+// ParameterConfig is the declaration of a job parameter in .cion.yml.
+type ParameterConfig struct {
+	// Type is one of "string", "bool", or "number". Defaults to "string".
+	Type string
+
+	// Default is the value used if the parameter isn't provided. Parameters without a default
+	// are required.
+	Default *string
+
+	// Values is an optional list of allowed values for the parameter.
+	Values []string
+}
+
+// resolveParameters validates the parameters provided for a job against the parameters
+// declared in the job config, and returns the full set of parameters including defaults.
+func resolveParameters(decl map[string]ParameterConfig, given map[string]string) (
+	map[string]string, error) {
+
+	for k := range given {
+		if _, ok := decl[k]; !ok {
+			return nil, fmt.Errorf("parameter %q is not declared in job config", k)
+		}
+	}
+
+	resolved := make(map[string]string, len(decl))
+	for k, pc := range decl {
+		if !parameterNameRegexp.MatchString(k) || reservedParameters[k] {
+			return nil, fmt.Errorf("invalid parameter name %q", k)
+		}
+
+		v, ok := given[k]
+		if !ok {
+			if pc.Default == nil {
+				return nil, fmt.Errorf("missing required parameter %q", k)
+			}
+
+			v = *pc.Default
+		}
+
+		if err := pc.validate(v); err != nil {
+			return nil, fmt.Errorf("invalid value for parameter %q: %v", k, err)
+		}
+
+		resolved[k] = v
+	}
+
+	return resolved, nil
+}
+
+func (pc ParameterConfig) validate(v string) error {
+	var err error
+
+	switch pc.Type {
+	case "", ParameterString:
+	case ParameterBool:
+		_, err = strconv.ParseBool(v)
+	case ParameterNumber:
+		var f float64
+		f, err = strconv.ParseFloat(v, 64)
+
+		// NaN and Inf parse as floats, but aren't numbers that a job can use
+		if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+			err = strconv.ErrSyntax
+		}
+	default:
+		return fmt.Errorf("unknown parameter type %q", pc.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a %s", v, pc.Type)
+	}
+
+	if len(pc.Values) == 0 {
+		return nil
+	}
+
+	for _, a := range pc.Values {
+		if v == a {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not one of %v", v, pc.Values)
+}
+
+// parameterEnv returns parameters as a list of environment variables, in the form "KEY=value".
+func parameterEnv(params map[string]string) []string {
+	env := make([]string, 0, len(params))
+	for k, v := range params {
+		env = append(env, k+"="+v)
+	}
+
+	sort.Strings(env)
+	return env
+}
@@ -0,0 +1,66 @@
+package cion
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveParameters(t *testing.T) {
+	def := func(s string) *string { return &s }
+
+	decl := map[string]ParameterConfig{
+		"TARGET":  {Values: []string{"staging", "production"}, Default: def("staging")},
+		"DRY_RUN": {Type: ParameterBool, Default: def("false")},
+		"WORKERS": {Type: ParameterNumber, Default: def("4")},
+		"VERSION": {},
+	}
+
+	tests := []struct {
+		decl     map[string]ParameterConfig
+		given    map[string]string
+		resolved map[string]string
+		err      bool
+	}{
+		{
+			decl:  decl,
+			given: map[string]string{"VERSION": "1.0"},
+			resolved: map[string]string{"TARGET": "staging", "DRY_RUN": "false",
+				"WORKERS": "4", "VERSION": "1.0"},
+		},
+		{
+			decl: decl,
+			given: map[string]string{"VERSION": "", "TARGET": "production", "DRY_RUN": "true",
+				"WORKERS": "2.5"},
+			resolved: map[string]string{"TARGET": "production", "DRY_RUN": "true",
+				"WORKERS": "2.5", "VERSION": ""},
+		},
+		{decl: decl, given: map[string]string{}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "OTHER": "x"}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "TARGET": "dev"}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "DRY_RUN": "maybe"}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "WORKERS": "NaN"}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "WORKERS": "Inf"}, err: true},
+		{decl: decl, given: map[string]string{"VERSION": "1.0", "WORKERS": "four"}, err: true},
+		{decl: map[string]ParameterConfig{"BUILD_DIR": {Default: def("/")}}, err: true},
+		{decl: map[string]ParameterConfig{"1ST": {Default: def("x")}}, err: true},
+		{decl: map[string]ParameterConfig{"A-B": {Default: def("x")}}, err: true},
+		{decl: map[string]ParameterConfig{"X": {Type: "list", Default: def("x")}}, err: true},
+		{decl: map[string]ParameterConfig{"X": {Values: []string{"a"}, Default: def("b")}},
+			err: true},
+		{decl: nil, given: nil, resolved: map[string]string{}},
+		{decl: nil, given: map[string]string{"X": "1"}, err: true},
+	}
+
+	for _, tt := range tests {
+		resolved, err := resolveParameters(tt.decl, tt.given)
+		if tt.err {
+			if err == nil {
+				t.Errorf("resolveParameters(%v, %v) = %v, want an error", tt.decl, tt.given,
+					resolved)
+			}
+		} else if err != nil || !reflect.DeepEqual(resolved, tt.resolved) {
+			t.Errorf("resolveParameters(%v, %v) = %v, %v, want %v", tt.decl, tt.given,
+				resolved, err, tt.resolved)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package cion
+
+import (
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// Policy restricts which container options repos can use in .cion.yml. Repos are matched by
+// patterns like "owner/repo", "owner/*", or "*". Options that aren't listed in the policy
+// can't be used by any repo, so "*" has to be listed to allow everyone.
+type Policy struct {
+	// Privileged is a list of repos that can run privileged containers.
+	Privileged []string
+
+	// Ports lists the container ports that repos can expose. A repo can't expose any port that
+	// isn't listed for it.
+	Ports []PortRule
+
+	// Env lists the environment variables that repos can set for containers, including the
+	// ones for job parameters. A repo can't set any variable that isn't listed for it.
+	Env []EnvRule
+
+	// Images is a list of images that can be pulled, which are registries like
+	// "registry.example.com", namespaces like "rohan/" or "registry.example.com/team", or
+	// repositories like "golang" or "rohan/cion". Each one allows any image in it, and "*"
+	// allows any image. cion's own containers can always use the image for the working
+	// directory, but job configs can only use it if it's allowed here.
+	Images []string
+
+	// Push lists the images that repos can push from the images in their configs. Images are
+	// matched like Images, and a repo can't push any image that isn't listed for it.
+	Push []PushRule
+
+	// Dependencies lists the repos whose artifacts repos can use as dependencies. A repo can't
+	// depend on any repo that isn't listed for it.
+	Dependencies []DependencyRule
+
+	// Triggers lists the repos that repos can start downstream jobs for. A repo can't trigger
+	// any repo that isn't listed for it.
+	Triggers []TriggerRule
+}
+
+// PortRule allows the repos that match any of its patterns to expose any of its ports, like
+// "8080" or "53/udp". Ports without a protocol are TCP ports, and "*" allows any port.
+type PortRule struct {
+	Repos []string
+	Ports []string
+}
+
+// EnvRule allows the repos that match any of its patterns to set the environment variables
+// with names that match any of its Names, which are patterns like "GOFLAGS" or "NPM_*".
+type EnvRule struct {
+	Repos []string
+	Names []string
+}
+
+// PushRule allows the repos that match any of its patterns to push any of its images.
+type PushRule struct {
+	Repos  []string
+	Images []string
+}
+
+// DependencyRule allows the repos that match any of its patterns to use the artifacts of the
+// repos that match any of its Dependencies.
+type DependencyRule struct {
+	Repos        []string
+	Dependencies []string
+}
+
+// TriggerRule allows the repos that match any of its patterns to trigger jobs for the repos
+// that match any of its Targets.
+type TriggerRule struct {
+	Repos   []string
+	Targets []string
+}
+
+// LoadPolicy reads a Policy from a YAML file.
+func LoadPolicy(filename string) (*Policy, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policy{}
+	if err := yaml.Unmarshal(b, p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Check returns an error describing the first violation of the policy by a job config for the
+// given owner/repo, if any.
+func (p *Policy) Check(owner, repo string, jc *JobConfig) error {
+	if p == nil {
+		return nil
+	}
+
+	for name, cc := range jc.containers() {
+		if err := p.checkContainer(owner, repo, cc); err != nil {
+			return fmt.Errorf("%s container violates policy: %v", name, err)
+		}
+	}
+
+	for _, ic := range jc.Images {
+		if !p.allowsPush(owner, repo, ic.Name) {
+			return fmt.Errorf("pushing image %s is not allowed for %s/%s", ic.Name, owner,
+				repo)
+		}
+	}
+
+	for _, dc := range jc.Dependencies {
+		if !p.allowsDependency(owner, repo, dc) {
+			return fmt.Errorf("depending on %s is not allowed for %s/%s", dc.Repo, owner, repo)
+		}
+	}
+
+	for _, t := range jc.Triggers {
+		if !p.allowsTrigger(owner, repo, t) {
+			return fmt.Errorf("triggering %s is not allowed for %s/%s", t, owner, repo)
+		}
+	}
+
+	return nil
+}
+
+func (p *Policy) checkContainer(owner, repo string, cc ContainerConfig) error {
+	if cc.Image != "" && !p.AllowsImage(cc.Image) {
+		return fmt.Errorf("image %s is not allowed", cc.Image)
+	}
+
+	if cc.Privileged && !matchRepo(p.Privileged, owner, repo) {
+		return fmt.Errorf("privileged containers are not allowed for %s/%s", owner, repo)
+	}
+
+	for _, port := range cc.Ports {
+		if !p.allowsPort(owner, repo, port) {
+			return fmt.Errorf("exposing port %s is not allowed for %s/%s", port, owner, repo)
+		}
+	}
+
+	return p.checkEnv(owner, repo, cc.Env)
+}
+
+// checkEnv returns an error if the owner/repo can't set any of a list of environment
+// variables, in the form "KEY=value", under the policy.
+func (p *Policy) checkEnv(owner, repo string, env []string) error {
+	if p == nil {
+		return nil
+	}
+
+	for _, kv := range env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		if !p.allowsEnv(owner, repo, name) {
+			return fmt.Errorf("environment variable %s is not allowed for %s/%s", name, owner,
+				repo)
+		}
+	}
+
+	return nil
+}
+
+// AllowsImage returns true if an image can be pulled under the policy. Images are compared by
+// their full repository names, so "golang" is the same as "docker.io/library/golang", and an
+// entry only matches whole components of the name.
+func (p *Policy) AllowsImage(image string) bool {
+	if p == nil {
+		return true
+	}
+
+	return matchImage(p.Images, image)
+}
+
+// allowsPort returns true if the owner/repo can expose a container port under the policy.
+func (p *Policy) allowsPort(owner, repo, port string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Ports {
+		if !matchRepo(rule.Repos, owner, repo) {
+			continue
+		}
+
+		for _, allowed := range rule.Ports {
+			if allowed == "*" || portProtocol(allowed) == portProtocol(port) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// portProtocol returns a container port with its protocol, which is TCP if it doesn't have one.
+func portProtocol(port string) string {
+	port = strings.ToLower(port)
+	if !strings.Contains(port, "/") {
+		port += "/tcp"
+	}
+
+	return port
+}
+
+// allowsEnv returns true if the owner/repo can set an environment variable with a name under
+// the policy.
+func (p *Policy) allowsEnv(owner, repo, name string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Env {
+		if !matchRepo(rule.Repos, owner, repo) {
+			continue
+		}
+
+		for _, pattern := range rule.Names {
+			if ok, _ := path.Match(pattern, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// allowsPush returns true if the owner/repo can push an image under the policy.
+func (p *Policy) allowsPush(owner, repo, image string) bool {
+	if p == nil {
+		return true
+	}
+
+	for _, rule := range p.Push {
+		if matchRepo(rule.Repos, owner, repo) && matchImage(rule.Images, image) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsDependency returns true if the owner/repo can use the artifacts of a dependency under
+// the policy.
+func (p *Policy) allowsDependency(owner, repo string, dc DependencyConfig) bool {
+	if p == nil {
+		return true
+	}
+
+	depOwner, depRepo, err := dc.split()
+	if err != nil {
+		return false
+	}
+
+	for _, rule := range p.Dependencies {
+		if matchRepo(rule.Repos, owner, repo) && matchRepo(rule.Dependencies, depOwner, depRepo) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsTrigger returns true if the owner/repo can start jobs for a downstream target under the
+// policy.
+func (p *Policy) allowsTrigger(owner, repo, target string) bool {
+	if p == nil {
+		return true
+	}
+
+	tOwner, tRepo, _, err := parseTriggerTarget(target)
+	if err != nil {
+		return false
+	}
+
+	for _, rule := range p.Triggers {
+		if matchRepo(rule.Repos, owner, repo) && matchRepo(rule.Targets, tOwner, tRepo) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchImage returns true if an image is in any of the registries, namespaces, or repositories
+// in a policy's list of images.
+func matchImage(entries []string, image string) bool {
+	name := imageRepository(image)
+	for _, entry := range entries {
+		if entry == "*" {
+			return true
+		}
+
+		prefix := policyImagePrefix(entry)
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// policyImagePrefix returns the full repository name for an entry in a policy's images. A
+// registry hostname is left as is, and an entry ending in "/" is a namespace on Docker Hub if
+// it doesn't have a registry.
+func policyImagePrefix(entry string) string {
+	trimmed := strings.TrimSuffix(entry, "/")
+
+	if !strings.Contains(trimmed, "/") {
+		if isRegistryHost(trimmed) {
+			return registryHostname(trimmed)
+		} else if trimmed != entry {
+			return DockerHubRegistry + "/" + trimmed
+		}
+	}
+
+	return imageRepository(trimmed)
+}
+
+// matchRepo returns true if the owner/repo matches any of the patterns.
+func matchRepo(patterns []string, owner, repo string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, owner+"/"+repo); ok || pattern == "*" {
+			return true
+		}
+	}
+
+	return false
+}
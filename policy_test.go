@@ -0,0 +1,92 @@
+package cion
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPolicyPortsAndEnv(t *testing.T) {
+	p := &Policy{
+		Images: []string{"*"},
+		Ports: []PortRule{
+			{Repos: []string{"spotify/*"}, Ports: []string{"8080", "53/udp"}},
+			{Repos: []string{"rohan/cion"}, Ports: []string{"*"}},
+		},
+		Env: []EnvRule{
+			{Repos: []string{"*"}, Names: []string{"GOFLAGS", "NPM_*"}},
+			{Repos: []string{"rohan/*"}, Names: []string{"*"}},
+		},
+	}
+
+	tests := []struct {
+		repo  string
+		ports []string
+		env   []string
+		err   bool
+	}{
+		{repo: "spotify/app", ports: []string{"8080", "8080/tcp", "53/UDP"}},
+		{repo: "spotify/app", ports: []string{"53"}, err: true},
+		{repo: "spotify/app", ports: []string{"8081"}, err: true},
+		{repo: "rohan/cion", ports: []string{"1/udp", "65535"}},
+		{repo: "other/app", ports: []string{"8080"}, err: true},
+		{repo: "other/app", env: []string{"GOFLAGS=-v", "NPM_TOKEN=x", "NPM_CONFIG"}},
+		{repo: "other/app", env: []string{"GOFLAGS=-v", "LD_PRELOAD=/x.so"}, err: true},
+		{repo: "other/app", env: []string{"GOFLAGSX=1"}, err: true},
+		{repo: "rohan/app", env: []string{"LD_PRELOAD=/x.so"}},
+	}
+
+	for _, tt := range tests {
+		parts := strings.Split(tt.repo, "/")
+		owner, repo := parts[0], parts[1]
+		cc := ContainerConfig{Image: "golang", Ports: tt.ports, Env: tt.env}
+
+		err := p.Check(owner, repo, &JobConfig{Build: cc})
+		if tt.err && err == nil {
+			t.Errorf("%s with ports %v and env %v is allowed", tt.repo, tt.ports, tt.env)
+		} else if !tt.err && err != nil {
+			t.Errorf("%s with ports %v and env %v: %v", tt.repo, tt.ports, tt.env, err)
+		}
+	}
+
+	// parameters are set as environment variables too
+	if err := p.checkEnv("other", "app", parameterEnv(map[string]string{"PATH": "/x"})); err == nil {
+		t.Error("parameter PATH is allowed")
+	}
+}
+
+func TestPolicyAllowsImage(t *testing.T) {
+	p := &Policy{Images: []string{"registry.example.com", "rohan/", "golang",
+		"other.example.com/team"}}
+
+	tests := []struct {
+		image   string
+		allowed bool
+	}{
+		{"registry.example.com/any/app:1.0", true},
+		{"registry.example.com.evil/app", false},
+		{"rohan/cion", true},
+		{"docker.io/rohan/cion:latest", true},
+		{"rohanx/cion", false},
+		{"golang:1.5", true},
+		{"docker.io/library/golang", true},
+		{"golangx", false},
+		{"evil.example.com/golang", false},
+		{"other.example.com/team/app", true},
+		{"other.example.com/teams/app", false},
+		{"other.example.com/app", false},
+		{"alpine", false},
+	}
+
+	for _, tt := range tests {
+		if allowed := p.AllowsImage(tt.image); allowed != tt.allowed {
+			t.Errorf("AllowsImage(%q) = %v, want %v", tt.image, allowed, tt.allowed)
+		}
+	}
+
+	if !(&Policy{Images: []string{"*"}}).AllowsImage("evil.example.com/x") {
+		t.Error("* doesn't allow every image")
+	}
+	if !(*Policy)(nil).AllowsImage("evil.example.com/x") {
+		t.Error("no policy doesn't allow every image")
+	}
+}
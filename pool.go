@@ -0,0 +1,719 @@
+package cion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/fsouza/go-dockerclient"
+	"gopkg.in/yaml.v2"
+	"io"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// DefaultHostCapacity is the capacity of a Docker host that doesn't configure one.
+	DefaultHostCapacity = 10
+
+	// PoolHealthInterval is how often the hosts in a PoolExecutor are health-checked.
+	PoolHealthInterval = 30 * time.Second
+
+	// PoolPlacementTimeout is how long a job waits for a healthy host with spare capacity
+	// before it fails.
+	PoolPlacementTimeout = 30 * time.Minute
+)
+
+// PoolHostConfig configures a Docker host for a PoolExecutor.
+type PoolHostConfig struct {
+	// Name identifies the host in logs. It defaults to the endpoint.
+	Name string
+
+	// Endpoint is the Docker endpoint of the host, and CertPath is the path to a directory with
+	// TLS certificates for it.
+	Endpoint string
+	CertPath string `yaml:"cert_path"`
+
+	// Capacity is the number of containers and jobs that can be running on the host at once.
+	// It defaults to DefaultHostCapacity.
+	Capacity int
+
+	// Labels describe the host, like "arch: arm64", so that jobs can require them.
+	Labels map[string]string
+}
+
+// LoadPoolHosts reads a list of Docker host configs from a YAML file.
+func LoadPoolHosts(filename string) ([]PoolHostConfig, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var l []PoolHostConfig
+	if err := yaml.Unmarshal(b, &l); err != nil {
+		return nil, err
+	}
+
+	if len(l) == 0 {
+		return nil, errors.New("no docker hosts configured")
+	}
+
+	for i, hc := range l {
+		if hc.Endpoint == "" {
+			return nil, errors.New("docker hosts need an endpoint")
+		}
+
+		if hc.Name == "" {
+			l[i].Name = hc.Endpoint
+		}
+	}
+
+	return l, nil
+}
+
+// PoolHost is a Docker host in a PoolExecutor.
+type PoolHost struct {
+	PoolHostConfig
+
+	// Docker is the executor for the host, which is used to check its health.
+	Docker *DockerExecutor
+
+	// Executor runs containers on the host. It wraps Docker, e.g. to limit the resources of
+	// containers, and defaults to Docker if it's nil.
+	Executor Executor
+
+	healthy bool
+
+	// jobs is the number of jobs placed on the host, and running is the set of containers
+	// that are running on it.
+	jobs    int
+	running map[string]bool
+}
+
+// load returns the fraction of the host's capacity that's in use.
+func (h *PoolHost) load() float64 {
+	return float64(h.jobs+len(h.running)) / float64(h.capacity())
+}
+
+func (h *PoolHost) capacity() int {
+	if h.Capacity <= 0 {
+		return DefaultHostCapacity
+	}
+
+	return h.Capacity
+}
+
+// hasLabels returns whether the host has all of the given labels.
+func (h *PoolHost) hasLabels(labels map[string]string) bool {
+	for k, v := range labels {
+		if h.Labels[k] != v {
+			return false
+		}
+	}
+
+	return true
+}
+
+// PoolExecutor is an Executor that runs containers on several Docker hosts. Each job is placed
+// on the least loaded healthy host, and all of its containers, networks, and images stay on
+// that host so that they can share volumes and links. Hosts are health-checked periodically,
+// and unhealthy hosts are drained: their running jobs continue, but no new jobs are placed on
+// them until they recover.
+type PoolExecutor struct {
+	hosts []*PoolHost
+
+	mu sync.Mutex
+
+	// placed is the host that each container and network was created on.
+	placed map[string]*PoolHost
+}
+
+// NewPoolExecutor returns a PoolExecutor for the given hosts, and starts checking their
+// health.
+func NewPoolExecutor(hosts []*PoolHost) *PoolExecutor {
+	for _, h := range hosts {
+		if h.Executor == nil {
+			h.Executor = h.Docker
+		}
+
+		h.healthy = true
+		h.running = make(map[string]bool)
+	}
+
+	p := &PoolExecutor{hosts: hosts, placed: make(map[string]*PoolHost)}
+	p.checkHealth()
+	go p.monitor()
+
+	return p
+}
+
+// monitor checks the health of the hosts every PoolHealthInterval.
+func (p *PoolExecutor) monitor() {
+	for range time.Tick(PoolHealthInterval) {
+		p.checkHealth()
+	}
+}
+
+// checkHealth pings each host, and drains any that don't respond.
+func (p *PoolExecutor) checkHealth() {
+	for _, h := range p.hosts {
+		err := h.Docker.Ping()
+
+		p.mu.Lock()
+		if err != nil && h.healthy {
+			log.Printf("docker host %s is unhealthy, draining: %v", h.Name, err)
+		} else if err == nil && !h.healthy {
+			log.Printf("docker host %s is healthy again", h.Name)
+		}
+
+		h.healthy = err == nil
+		p.mu.Unlock()
+	}
+}
+
+// place chooses the least loaded healthy host with spare capacity and the given labels for a
+// job, waiting for one to become available if they're all busy.
+func (p *PoolExecutor) place(labels map[string]string) (*PoolHost, error) {
+	deadline := time.Now().Add(PoolPlacementTimeout)
+
+	for {
+		p.mu.Lock()
+
+		var candidates []*PoolHost
+		for _, h := range p.hosts {
+			if h.hasLabels(labels) {
+				candidates = append(candidates, h)
+			}
+		}
+
+		if len(candidates) == 0 {
+			p.mu.Unlock()
+			return nil, fmt.Errorf("no docker host has the labels %s", formatLabels(labels))
+		}
+
+		var best *PoolHost
+		for _, h := range candidates {
+			if h.healthy && h.load() < 1 && (best == nil || h.load() < best.load()) {
+				best = h
+			}
+		}
+
+		if best != nil {
+			best.jobs++
+			p.mu.Unlock()
+			return best, nil
+		}
+
+		p.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return nil, errors.New("timed out waiting for an available docker host")
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// reserve takes a place on a host for a job that already has containers on it, waiting for
+// the host to have spare capacity. Unlike place, the host doesn't need to be healthy, since
+// the jobs that are already on a drained host keep running.
+func (p *PoolExecutor) reserve(h *PoolHost) error {
+	deadline := time.Now().Add(PoolPlacementTimeout)
+
+	for {
+		p.mu.Lock()
+		if h.load() < 1 {
+			h.jobs++
+			p.mu.Unlock()
+			return nil
+		}
+		p.mu.Unlock()
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for docker host %s to be available", h.Name)
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// unplace releases a job's place on a host.
+func (p *PoolExecutor) unplace(h *PoolHost) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h.jobs--
+}
+
+// lookup returns the host that a container or network was created on.
+func (p *PoolExecutor) lookup(id string) (*PoolHost, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	h, ok := p.placed[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown container or network %s", id)
+	}
+
+	return h, nil
+}
+
+// run runs a container on a host and records it.
+func (p *PoolExecutor) run(h *PoolHost, opts RunContainerOpts) (string, error) {
+	id, err := h.Executor.Run(opts)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.placed[id] = h
+	h.running[id] = true
+
+	return id, nil
+}
+
+// stopped records that a container is no longer running.
+func (p *PoolExecutor) stopped(h *PoolHost, id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(h.running, id)
+}
+
+// createNetwork creates a network on a host and records it.
+func (p *PoolExecutor) createNetwork(h *PoolHost, name string) (string, error) {
+	id, err := h.Executor.CreateNetwork(name)
+	if err != nil {
+		return "", err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.placed[id] = h
+
+	return id, nil
+}
+
+// removeNetwork removes a network and forgets it.
+func (p *PoolExecutor) removeNetwork(id string) error {
+	h, err := p.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	if err := h.Executor.RemoveNetwork(id); err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	delete(p.placed, id)
+
+	return nil
+}
+
+// forget forgets containers and networks that are no longer used.
+func (p *PoolExecutor) forget(ids []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for _, id := range ids {
+		if h, ok := p.placed[id]; ok {
+			delete(h.running, id)
+			delete(p.placed, id)
+		}
+	}
+}
+
+// findImage returns a healthy host that has an image.
+func (p *PoolExecutor) findImage(image string) (*PoolHost, error) {
+	for _, h := range p.hosts {
+		p.mu.Lock()
+		healthy := h.healthy
+		p.mu.Unlock()
+
+		if !healthy {
+			continue
+		}
+
+		if ok, err := h.Executor.HasImage(image); err == nil && ok {
+			return h, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no healthy docker host has the image %s", image)
+}
+
+// pin returns an Executor for a single job, which places the job on a host when it first
+// needs one and keeps all of its containers there. It must be released when the job is done.
+func (p *PoolExecutor) pin() *poolJob {
+	return &poolJob{pool: p}
+}
+
+// Run places the container on its own host. Jobs are pinned to a host instead, so that all
+// of their containers run on the same host.
+func (p *PoolExecutor) Run(opts RunContainerOpts) (string, error) {
+	h, err := p.place(nil)
+	if err != nil {
+		return "", err
+	}
+	defer p.unplace(h)
+
+	return p.run(h, opts)
+}
+
+func (p *PoolExecutor) Attach(id string, stdout io.Writer, stderr io.Writer) error {
+	h, err := p.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	return h.Executor.Attach(id, stdout, stderr)
+}
+
+func (p *PoolExecutor) Wait(id string) (int, error) {
+	h, err := p.lookup(id)
+	if err != nil {
+		return 0, err
+	}
+
+	defer p.stopped(h, id)
+	return h.Executor.Wait(id)
+}
+
+func (p *PoolExecutor) Kill(id string) error {
+	h, err := p.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	defer p.stopped(h, id)
+	return h.Executor.Kill(id)
+}
+
+func (p *PoolExecutor) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	h, err := p.lookup(id)
+	if err != nil {
+		return 0, err
+	}
+
+	return h.Executor.Exec(id, cmd, stdout, stderr)
+}
+
+func (p *PoolExecutor) Build(opts BuildOpts) (string, error) {
+	h, err := p.place(nil)
+	if err != nil {
+		return "", err
+	}
+	defer p.unplace(h)
+
+	return h.Executor.Build(opts)
+}
+
+// HasImage returns whether any host has an image.
+func (p *PoolExecutor) HasImage(image string) (bool, error) {
+	_, err := p.findImage(image)
+	return err == nil, nil
+}
+
+func (p *PoolExecutor) Tag(image, repository, tag string) error {
+	h, err := p.findImage(image)
+	if err != nil {
+		return err
+	}
+
+	return h.Executor.Tag(image, repository, tag)
+}
+
+func (p *PoolExecutor) Push(opts PushOpts) (string, error) {
+	h, err := p.findImage(opts.Repository + ":" + opts.Tag)
+	if err != nil {
+		return "", err
+	}
+
+	return h.Executor.Push(opts)
+}
+
+func (p *PoolExecutor) CreateNetwork(name string) (string, error) {
+	h, err := p.place(nil)
+	if err != nil {
+		return "", err
+	}
+	defer p.unplace(h)
+
+	return p.createNetwork(h, name)
+}
+
+func (p *PoolExecutor) RemoveNetwork(id string) error {
+	return p.removeNetwork(id)
+}
+
+func (p *PoolExecutor) Import(id, path string, input io.Reader) error {
+	h, err := p.lookup(id)
+	if err != nil {
+		return err
+	}
+
+	return h.Executor.Import(id, path, input)
+}
+
+// RemoveVolume removes a volume from every healthy host that has it.
+func (p *PoolExecutor) RemoveVolume(name string) error {
+	for _, h := range p.hosts {
+		p.mu.Lock()
+		healthy := h.healthy
+		p.mu.Unlock()
+
+		if !healthy {
+			continue
+		}
+
+		if err := h.Executor.RemoveVolume(name); err != nil && err != docker.ErrNoSuchVolume {
+			return fmt.Errorf("unable to remove volume from docker host %s: %v", h.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// poolJob is an Executor that runs all of a job's containers on the same host in a pool.
+type poolJob struct {
+	pool *PoolExecutor
+
+	mu   sync.Mutex
+	host *PoolHost
+
+	// suspended is whether the job has given up its place on its host while it waits.
+	suspended bool
+
+	// created are the containers and networks that the job created, which the pool forgets
+	// when the job is released.
+	created []string
+}
+
+// current returns the job's host, placing the job if it doesn't have one yet.
+func (j *poolJob) current() (*PoolHost, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host == nil {
+		h, err := j.pool.place(nil)
+		if err != nil {
+			return nil, err
+		}
+
+		j.host = h
+	}
+
+	return j.host, nil
+}
+
+// require ensures that the job is on a host with the given labels, moving it to another host
+// if its current host doesn't have them. It returns whether the job was moved, in which case
+// anything that the job created on its previous host isn't available anymore.
+func (j *poolJob) require(labels map[string]string) (bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host != nil && j.host.hasLabels(labels) {
+		return false, nil
+	}
+
+	h, err := j.pool.place(labels)
+	if err != nil {
+		return false, err
+	}
+
+	moved := j.host != nil
+	if moved {
+		j.pool.unplace(j.host)
+	}
+
+	j.host = h
+	return moved, nil
+}
+
+// hostName returns the name of the job's host.
+func (j *poolJob) hostName() string {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host == nil {
+		return ""
+	}
+
+	return j.host.Name
+}
+
+// release releases the job's place on its host, and forgets the containers and networks
+// that it created.
+func (j *poolJob) release() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host != nil && !j.suspended {
+		j.pool.unplace(j.host)
+	}
+	j.host = nil
+	j.suspended = false
+
+	j.pool.forget(j.created)
+	j.created = nil
+}
+
+// suspend gives up the job's place on its host while it waits, e.g. for approval, so that
+// other jobs can be placed there in the meantime. The job stays on the host, since its
+// containers are there.
+func (j *poolJob) suspend() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host != nil && !j.suspended {
+		j.pool.unplace(j.host)
+		j.suspended = true
+	}
+}
+
+// resume takes back the place on its host that a suspended job gave up, waiting for the host
+// to have spare capacity.
+func (j *poolJob) resume() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.host == nil || !j.suspended {
+		return nil
+	}
+
+	if err := j.pool.reserve(j.host); err != nil {
+		return err
+	}
+
+	j.suspended = false
+	return nil
+}
+
+// record records a container or network that the job created.
+func (j *poolJob) record(id string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.created = append(j.created, id)
+}
+
+func (j *poolJob) Run(opts RunContainerOpts) (string, error) {
+	h, err := j.current()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := j.pool.run(h, opts)
+	if err != nil {
+		return "", err
+	}
+
+	j.record(id)
+	return id, nil
+}
+
+// Containers and networks are looked up in the pool rather than on the job's host, since the
+// job may have moved since they were created.
+
+func (j *poolJob) Attach(id string, stdout io.Writer, stderr io.Writer) error {
+	return j.pool.Attach(id, stdout, stderr)
+}
+
+func (j *poolJob) Wait(id string) (int, error) {
+	return j.pool.Wait(id)
+}
+
+func (j *poolJob) Kill(id string) error {
+	return j.pool.Kill(id)
+}
+
+func (j *poolJob) Exec(id string, cmd []string, stdout io.Writer,
+	stderr io.Writer) (int, error) {
+
+	return j.pool.Exec(id, cmd, stdout, stderr)
+}
+
+func (j *poolJob) Build(opts BuildOpts) (string, error) {
+	h, err := j.current()
+	if err != nil {
+		return "", err
+	}
+
+	return h.Executor.Build(opts)
+}
+
+func (j *poolJob) HasImage(image string) (bool, error) {
+	h, err := j.current()
+	if err != nil {
+		return false, err
+	}
+
+	return h.Executor.HasImage(image)
+}
+
+func (j *poolJob) Tag(image, repository, tag string) error {
+	h, err := j.current()
+	if err != nil {
+		return err
+	}
+
+	return h.Executor.Tag(image, repository, tag)
+}
+
+func (j *poolJob) Push(opts PushOpts) (string, error) {
+	h, err := j.current()
+	if err != nil {
+		return "", err
+	}
+
+	return h.Executor.Push(opts)
+}
+
+func (j *poolJob) CreateNetwork(name string) (string, error) {
+	h, err := j.current()
+	if err != nil {
+		return "", err
+	}
+
+	id, err := j.pool.createNetwork(h, name)
+	if err != nil {
+		return "", err
+	}
+
+	j.record(id)
+	return id, nil
+}
+
+func (j *poolJob) RemoveNetwork(id string) error {
+	return j.pool.removeNetwork(id)
+}
+
+func (j *poolJob) Import(id, path string, input io.Reader) error {
+	return j.pool.Import(id, path, input)
+}
+
+func (j *poolJob) RemoveVolume(name string) error {
+	return j.pool.RemoveVolume(name)
+}
+
+// formatLabels returns labels in the form "k1=v1,k2=v2", sorted by key.
+func formatLabels(labels map[string]string) string {
+	var l []string
+	for k, v := range labels {
+		l = append(l, k+"="+v)
+	}
+
+	sort.Strings(l)
+	return strings.Join(l, ",")
+}
@@ -0,0 +1,170 @@
+package cion
+
+import (
+	"strings"
+	"testing"
+)
+
+// newTestPool returns a pool of hosts that run containers with FakeExecutors, without the
+// health checks that need a Docker host.
+func newTestPool(configs ...PoolHostConfig) (*PoolExecutor, []*FakeExecutor) {
+	var hosts []*PoolHost
+	var fakes []*FakeExecutor
+
+	for _, hc := range configs {
+		fe := NewFakeExecutor()
+		fakes = append(fakes, fe)
+
+		hosts = append(hosts, &PoolHost{
+			PoolHostConfig: hc,
+			Executor:       fe,
+			healthy:        true,
+			running:        make(map[string]bool),
+		})
+	}
+
+	return &PoolExecutor{hosts: hosts, placed: make(map[string]*PoolHost)}, fakes
+}
+
+func TestPoolPlacesLeastLoaded(t *testing.T) {
+	p, fakes := newTestPool(
+		PoolHostConfig{Name: "a", Capacity: 4},
+		PoolHostConfig{Name: "b", Capacity: 2},
+	)
+
+	j1 := p.pin()
+	if _, err := j1.Run(RunContainerOpts{Image: "golang"}); err != nil {
+		t.Fatal(err)
+	}
+	if j1.hostName() != "a" {
+		t.Errorf("first job placed on %s, want a", j1.hostName())
+	}
+
+	// a has 2 of 4 in use, and b is empty
+	j2 := p.pin()
+	if _, err := j2.Run(RunContainerOpts{Image: "golang"}); err != nil {
+		t.Fatal(err)
+	}
+	if j2.hostName() != "b" {
+		t.Errorf("second job placed on %s, want b", j2.hostName())
+	}
+
+	if len(fakes[0].Containers()) != 1 || len(fakes[1].Containers()) != 1 {
+		t.Errorf("containers = %d and %d, want 1 and 1", len(fakes[0].Containers()),
+			len(fakes[1].Containers()))
+	}
+
+	j1.release()
+	j2.release()
+
+	for _, h := range p.hosts {
+		if h.jobs != 0 {
+			t.Errorf("host %s still has %d jobs after release", h.Name, h.jobs)
+		}
+	}
+}
+
+func TestPoolDrainsUnhealthyHosts(t *testing.T) {
+	p, _ := newTestPool(PoolHostConfig{Name: "a"}, PoolHostConfig{Name: "b"})
+	p.hosts[0].healthy = false
+
+	for i := 0; i < 3; i++ {
+		h, err := p.place(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Name != "b" {
+			t.Errorf("job placed on drained host %s", h.Name)
+		}
+	}
+}
+
+func TestPoolRequireLabels(t *testing.T) {
+	p, _ := newTestPool(
+		PoolHostConfig{Name: "amd64", Labels: map[string]string{"arch": "amd64"}},
+		PoolHostConfig{Name: "arm64", Labels: map[string]string{"arch": "arm64"}},
+	)
+
+	j := p.pin()
+	if _, err := j.current(); err != nil {
+		t.Fatal(err)
+	}
+	if j.hostName() != "amd64" {
+		t.Fatalf("job placed on %s, want amd64", j.hostName())
+	}
+
+	moved, err := j.require(map[string]string{"arch": "amd64"})
+	if err != nil || moved {
+		t.Errorf("require() = %v, %v for the current host", moved, err)
+	}
+
+	moved, err = j.require(map[string]string{"arch": "arm64"})
+	if err != nil || !moved {
+		t.Errorf("require() = %v, %v, want a move", moved, err)
+	}
+	if j.hostName() != "arm64" || p.hosts[0].jobs != 0 || p.hosts[1].jobs != 1 {
+		t.Errorf("job on %s, host jobs = %d and %d", j.hostName(), p.hosts[0].jobs,
+			p.hosts[1].jobs)
+	}
+
+	_, err = j.require(map[string]string{"arch": "riscv"})
+	if err == nil || !strings.Contains(err.Error(), "arch=riscv") {
+		t.Errorf("err = %v, want missing labels", err)
+	}
+}
+
+func TestPoolSuspend(t *testing.T) {
+	p, _ := newTestPool(PoolHostConfig{Name: "a", Capacity: 1})
+
+	waiting := p.pin()
+	if _, err := waiting.current(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the host has room for another job while the first one waits
+	waiting.suspend()
+
+	other := p.pin()
+	if _, err := other.current(); err != nil {
+		t.Fatal(err)
+	}
+	if p.hosts[0].jobs != 1 {
+		t.Fatalf("host jobs = %d, want 1", p.hosts[0].jobs)
+	}
+
+	other.release()
+	if err := waiting.resume(); err != nil {
+		t.Fatal(err)
+	}
+	if p.hosts[0].jobs != 1 {
+		t.Errorf("host jobs = %d after resume, want 1", p.hosts[0].jobs)
+	}
+
+	// releasing a suspended job doesn't give up a place that it doesn't have
+	waiting.suspend()
+	waiting.release()
+	if p.hosts[0].jobs != 0 {
+		t.Errorf("host jobs = %d after release, want 0", p.hosts[0].jobs)
+	}
+}
+
+func TestPoolFindImage(t *testing.T) {
+	p, fakes := newTestPool(PoolHostConfig{Name: "a"}, PoolHostConfig{Name: "b"})
+	fakes[0].AddImage("app:1")
+	fakes[1].AddImage("app:1")
+
+	h, err := p.findImage("app:1")
+	if err != nil || h.Name != "a" {
+		t.Fatalf("findImage() = %v, %v", h, err)
+	}
+
+	p.hosts[0].healthy = false
+	if h, err := p.findImage("app:1"); err != nil || h.Name != "b" {
+		t.Errorf("findImage() = %v, %v, want healthy host b", h, err)
+	}
+
+	p.hosts[1].healthy = false
+	if _, err := p.findImage("app:1"); err == nil {
+		t.Error("findImage() found an image on a drained host")
+	}
+}
@@ -149,12 +149,28 @@ var JobDetail = React.createClass({
   },
 
   render: function() {
-    var logUrl = "/api/" + this.props.owner + "/" + this.props.repo + "/" + this.props.number + "/log";
+    var jobUrl = "/api/" + this.props.owner + "/" + this.props.repo + "/" + this.props.number;
+    var logUrl = jobUrl + "/log";
+
+    var services = (this.state.job && this.state.job.Services) || [];
+    var serviceLogNodes = services.map(function(s) {
+      return (
+        <div key={s}>
+          <h3>{s}</h3>
+          <pre>
+            <iframe className="log" src={jobUrl + "/services/" + s + "/log"}></iframe>
+          </pre>
+        </div>
+      );
+    });
+
     return (
         <mui.Paper className="jobDetail">
           <pre>
             <iframe className="log" src={logUrl}></iframe>
           </pre>
+
+          {serviceLogNodes}
         </mui.Paper>
     );
   },
@@ -221,7 +237,9 @@ JobTable.Row = React.createClass({
     ended = (ended) ? moment(ended).from(this.props.job.StartedAt, true) : "-";
 
     var statusClassName;
-    if (!this.props.job.EndedAt) {
+    if (this.props.job.Status == "awaiting_approval") {
+      statusClassName = "awaiting";
+    } else if (!this.props.job.EndedAt) {
       statusClassName = "running";
     } else if (this.props.job.Success) {
       statusClassName = "success";
@@ -232,7 +250,7 @@ JobTable.Row = React.createClass({
     return (
       <tr key={this.props.job.Number} className={statusClassName} onClick={this.props.onClick}>
         <td>{this.props.job.Number}</td>
-        <td>{this.props.job.SHA.substring(0, 6)} ({this.props.job.Branch})</td>
+        <td>{this.props.job.SHA.substring(0, 6)} ({this.props.job.Branch || this.props.job.Tag})</td>
         <td>{started}</td>
         <td>{ended}</td>
       </tr>
@@ -0,0 +1,81 @@
+package cion
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// PullPolicy specifies when an Executor pulls the image for a container.
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image every time a container is run.
+	PullAlways PullPolicy = "always"
+
+	// PullIfNotPresent only pulls the image if it isn't already on the Docker host.
+	PullIfNotPresent PullPolicy = "if-not-present"
+
+	// PullNever never pulls the image, so it has to already be on the Docker host.
+	PullNever PullPolicy = "never"
+)
+
+// ParsePullPolicy parses a pull policy, returning an error if it isn't valid. An empty string is
+// the zero PullPolicy, which means that the Executor's default is used.
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	switch p := PullPolicy(s); p {
+	case "", PullAlways, PullIfNotPresent, PullNever:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid pull policy %q", s)
+	}
+}
+
+// pullGroup deduplicates concurrent pulls of the same image with the same credentials, so that
+// jobs that need the same image at the same time share a single pull. Pulls with different
+// credentials aren't shared, since a job without access to a private image must not succeed
+// by waiting on the pull of a job that has access. That only holds for images that are pulled:
+// an image that's already on the host is run without a pull, which is why authExecutor always
+// pulls images from registries with credentials that a job's repo can't use.
+type pullGroup struct {
+	mu    sync.Mutex
+	pulls map[string]*pullCall
+}
+
+type pullCall struct {
+	done chan struct{}
+	err  error
+}
+
+func newPullGroup() *pullGroup {
+	return &pullGroup{pulls: make(map[string]*pullCall)}
+}
+
+// do runs the pull function for an image, unless a pull of the image with the same credentials
+// is already in progress, in which case it waits for that pull to finish and returns its
+// result. The credentials are identified by a key, which is empty for anonymous pulls.
+func (g *pullGroup) do(image, credentials string, output io.Writer, pull func() error) error {
+	key := image + "\x00" + credentials
+
+	g.mu.Lock()
+	if pc, ok := g.pulls[key]; ok {
+		g.mu.Unlock()
+
+		fmt.Fprintf(output, "CION: waiting for another job to finish pulling %s\n", image)
+		<-pc.done
+		return pc.err
+	}
+
+	pc := &pullCall{done: make(chan struct{})}
+	g.pulls[key] = pc
+	g.mu.Unlock()
+
+	pc.err = pull()
+	close(pc.done)
+
+	g.mu.Lock()
+	delete(g.pulls, key)
+	g.mu.Unlock()
+
+	return pc.err
+}
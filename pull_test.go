@@ -0,0 +1,92 @@
+package cion
+
+import (
+	"errors"
+	"sync"
+	"testing"
+)
+
+// signalWriter sends on a channel for each write.
+type signalWriter chan struct{}
+
+func (w signalWriter) Write(p []byte) (int, error) {
+	w <- struct{}{}
+	return len(p), nil
+}
+
+func TestPullGroup(t *testing.T) {
+	errPull := errors.New("pull failed")
+
+	tests := []struct {
+		name        string
+		credentials []string
+		pulls       int
+		err         error
+	}{
+		{name: "same credentials", credentials: []string{"a", "a", "a"}, pulls: 1},
+		{name: "anonymous", credentials: []string{"", "", ""}, pulls: 1},
+		{name: "different credentials", credentials: []string{"a", "b", ""}, pulls: 3},
+		{name: "some shared", credentials: []string{"a", "b", "a"}, pulls: 2},
+		{name: "failure", credentials: []string{"a", "a"}, pulls: 1, err: errPull},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newPullGroup()
+
+			// every job either starts a pull or writes that it's waiting for one
+			started := make(signalWriter, len(tt.credentials))
+			finish := make(chan struct{})
+
+			var mu sync.Mutex
+			pulls := 0
+			pull := func() error {
+				mu.Lock()
+				pulls++
+				mu.Unlock()
+
+				started <- struct{}{}
+				<-finish
+				return tt.err
+			}
+
+			var wg sync.WaitGroup
+			errs := make([]error, len(tt.credentials))
+			for i, c := range tt.credentials {
+				wg.Add(1)
+				go func(i int, c string) {
+					defer wg.Done()
+					errs[i] = g.do("golang", c, started, pull)
+				}(i, c)
+			}
+
+			for range tt.credentials {
+				<-started
+			}
+			close(finish)
+			wg.Wait()
+
+			if pulls != tt.pulls {
+				t.Errorf("pulled %d times, want %d", pulls, tt.pulls)
+			}
+			for i, err := range errs {
+				if err != tt.err {
+					t.Errorf("pull with credentials %q = %v, want %v", tt.credentials[i], err,
+						tt.err)
+				}
+			}
+			if len(g.pulls) != 0 {
+				t.Errorf("%d pulls still in progress", len(g.pulls))
+			}
+
+			// once a pull finishes, the next one for the image pulls again
+			if err := g.do("golang", tt.credentials[0], started, func() error {
+				pulls++
+				return nil
+			}); err != nil || pulls != tt.pulls+1 {
+				t.Errorf("pull after the others = %v with %d pulls, want %d", err, pulls,
+					tt.pulls+1)
+			}
+		})
+	}
+}
@@ -0,0 +1,257 @@
+package cion
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strings"
+)
+
+// DockerHubRegistry is the hostname used for images that don't specify a registry.
+const DockerHubRegistry = "docker.io"
+
+// RegistryCredentials are the credentials used to pull images from a Docker registry.
+type RegistryCredentials struct {
+	// Registry is the hostname of the registry, e.g. "registry.example.com:5000". Docker Hub is
+	// "docker.io".
+	Registry string
+
+	Username string
+	Password string
+	Email    string
+
+	// Repos is a list of repos that can use the credentials, with patterns like "owner/repo" or
+	// "owner/*". If it's empty, any repo can use the credentials.
+	Repos []string
+}
+
+// RegistryAuth is a list of credentials for Docker registries. When several credentials match
+// a registry, the first one is used.
+type RegistryAuth []RegistryCredentials
+
+// LoadRegistryAuth reads a list of registry credentials from a YAML file.
+func LoadRegistryAuth(filename string) (RegistryAuth, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var ra RegistryAuth
+	if err := yaml.Unmarshal(b, &ra); err != nil {
+		return nil, err
+	}
+
+	for i, rc := range ra {
+		if rc.Registry == "" {
+			return nil, errors.New("registry credentials need a registry hostname")
+		}
+
+		ra[i].Registry = registryHostname(rc.Registry)
+	}
+
+	return ra, nil
+}
+
+// LoadDockerConfig reads registry credentials from a Docker client config.json file, as
+// written by `docker login`. Credential helpers aren't supported.
+func LoadDockerConfig(filename string) (RegistryAuth, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg struct {
+		Auths map[string]struct {
+			Auth     string `json:"auth"`
+			Username string `json:"username"`
+			Password string `json:"password"`
+			Email    string `json:"email"`
+		} `json:"auths"`
+	}
+	if err := json.Unmarshal(b, &cfg); err != nil {
+		return nil, err
+	}
+
+	var ra RegistryAuth
+	for server, a := range cfg.Auths {
+		rc := RegistryCredentials{
+			Registry: registryHostname(server),
+			Username: a.Username,
+			Password: a.Password,
+			Email:    a.Email,
+		}
+
+		if a.Auth != "" {
+			userpass, err := base64.StdEncoding.DecodeString(a.Auth)
+			if err != nil {
+				return nil, err
+			}
+
+			parts := strings.SplitN(string(userpass), ":", 2)
+			if len(parts) != 2 {
+				return nil, errors.New("invalid auth for registry " + server)
+			}
+
+			rc.Username, rc.Password = parts[0], parts[1]
+		}
+
+		ra = append(ra, rc)
+	}
+
+	return ra, nil
+}
+
+// forRepo returns the credentials that a repo can use. Credentials that are specific to the
+// repo come before credentials that any repo can use.
+func (ra RegistryAuth) forRepo(owner, repo string) RegistryAuth {
+	var specific, shared RegistryAuth
+
+	for _, rc := range ra {
+		if len(rc.Repos) == 0 {
+			shared = append(shared, rc)
+		} else if matchRepo(rc.Repos, owner, repo) {
+			specific = append(specific, rc)
+		}
+	}
+
+	return append(specific, shared...)
+}
+
+// forPush returns the credentials that a repo can push images with, which are only the ones
+// that are limited to the repo. Credentials that any repo can use aren't used for pushes, so
+// that a repo can't push over the images of other repos with them.
+func (ra RegistryAuth) forPush(owner, repo string) RegistryAuth {
+	specific := RegistryAuth{}
+
+	for _, rc := range ra {
+		if len(rc.Repos) > 0 && matchRepo(rc.Repos, owner, repo) {
+			specific = append(specific, rc)
+		}
+	}
+
+	return specific
+}
+
+// restricted returns the registries that have credentials which a repo can't use, so that the
+// images in them might be private to other repos.
+func (ra RegistryAuth) restricted(owner, repo string) map[string]bool {
+	registries := map[string]bool{}
+
+	for _, rc := range ra {
+		if len(rc.Repos) > 0 && !matchRepo(rc.Repos, owner, repo) {
+			registries[rc.Registry] = true
+		}
+	}
+
+	return registries
+}
+
+// lookup returns the credentials for the registry that an image is pulled from, or nil if
+// there aren't any.
+func (ra RegistryAuth) lookup(image string) *RegistryCredentials {
+	host := imageRegistry(image)
+
+	for i := range ra {
+		if ra[i].Registry == host {
+			return &ra[i]
+		}
+	}
+
+	return nil
+}
+
+// imageRegistry returns the hostname of the registry that an image is pulled from.
+func imageRegistry(image string) string {
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && isRegistryHost(parts[0]) {
+		return registryHostname(parts[0])
+	}
+
+	return DockerHubRegistry
+}
+
+// isRegistryHost returns true if the first component of an image name is the hostname of a
+// registry, rather than a Docker Hub user or organization.
+func isRegistryHost(s string) bool {
+	return strings.ContainsAny(s, ".:") || s == "localhost"
+}
+
+// imageRepository returns the full name of the repository that an image is in, including its
+// registry but not its tag or digest, e.g. "docker.io/library/golang" for "golang:1.5".
+func imageRepository(image string) string {
+	name := strings.SplitN(image, "@", 2)[0]
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name = name[:i]
+	}
+
+	host, path := DockerHubRegistry, name
+	if parts := strings.SplitN(name, "/", 2); len(parts) == 2 && isRegistryHost(parts[0]) {
+		host, path = registryHostname(parts[0]), parts[1]
+	}
+
+	// official images on Docker Hub are in the library namespace
+	if host == DockerHubRegistry && !strings.Contains(path, "/") {
+		path = "library/" + path
+	}
+
+	return host + "/" + path
+}
+
+// registryHostname normalizes a registry address like "https://index.docker.io/v1/" to its
+// hostname.
+func registryHostname(server string) string {
+	if i := strings.Index(server, "://"); i >= 0 {
+		server = server[i+3:]
+	}
+	server = strings.SplitN(server, "/", 2)[0]
+
+	switch server {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return DockerHubRegistry
+	}
+
+	return server
+}
+
+// authExecutor is an Executor that provides registry credentials for the images that it runs,
+// builds, and pushes.
+type authExecutor struct {
+	Executor
+
+	auth RegistryAuth
+
+	// restricted are the registries with credentials that the job's repo can't use. Images
+	// from them are always pulled, even if they're already on the host, so that the registry
+	// checks that the repo's own credentials can pull them.
+	restricted map[string]bool
+}
+
+func (e authExecutor) Run(opts RunContainerOpts) (string, error) {
+	if opts.RegistryAuth == nil {
+		opts.RegistryAuth = e.auth
+	}
+
+	if !opts.LocalImage && !opts.Internal && e.restricted[imageRegistry(opts.Image)] {
+		opts.Pull = PullAlways
+	}
+
+	return e.Executor.Run(opts)
+}
+
+func (e authExecutor) Build(opts BuildOpts) (string, error) {
+	if opts.RegistryAuth == nil {
+		opts.RegistryAuth = e.auth
+	}
+
+	return e.Executor.Build(opts)
+}
+
+func (e authExecutor) Push(opts PushOpts) (string, error) {
+	if opts.RegistryAuth == nil {
+		opts.RegistryAuth = e.auth
+	}
+
+	return e.Executor.Push(opts)
+}
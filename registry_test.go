@@ -0,0 +1,69 @@
+package cion
+
+import (
+	"testing"
+)
+
+func TestAuthExecutorRestricted(t *testing.T) {
+	ra := RegistryAuth{
+		{Registry: "private.example.com", Username: "a", Repos: []string{"rohan/*"}},
+		{Registry: "shared.example.com", Username: "b"},
+	}
+
+	tests := []struct {
+		owner, repo string
+		image       string
+		internal    bool
+		pull        PullPolicy
+	}{
+		// other repos might have already pulled private images onto the host
+		{"spotify", "app", "private.example.com/rohan/app", false, PullAlways},
+		{"spotify", "app", "private.example.com/rohan/app:1.0", false, PullAlways},
+		{"spotify", "app", "shared.example.com/app", false, PullNever},
+		{"spotify", "app", "golang", false, PullNever},
+		{"spotify", "app", "private.example.com/rohan/app", true, PullNever},
+		{"rohan", "cion", "private.example.com/rohan/app", false, PullNever},
+	}
+
+	for _, tt := range tests {
+		fe := NewFakeExecutor()
+		e := authExecutor{
+			Executor:   fe,
+			auth:       ra.forRepo(tt.owner, tt.repo),
+			restricted: ra.restricted(tt.owner, tt.repo),
+		}
+
+		if _, err := e.Run(RunContainerOpts{Image: tt.image, Pull: PullNever,
+			Internal: tt.internal}); err != nil {
+			t.Fatal(err)
+		}
+
+		if pull := fe.Ran(tt.image)[0].Opts.Pull; pull != tt.pull {
+			t.Errorf("%s/%s running %s (internal %v): pull = %q, want %q", tt.owner, tt.repo,
+				tt.image, tt.internal, pull, tt.pull)
+		}
+	}
+}
+
+func TestImageRepository(t *testing.T) {
+	tests := []struct {
+		image, repository string
+	}{
+		{"golang", "docker.io/library/golang"},
+		{"golang:1.5", "docker.io/library/golang"},
+		{"golang@sha256:abc", "docker.io/library/golang"},
+		{"rohan/cion:latest", "docker.io/rohan/cion"},
+		{"docker.io/golang", "docker.io/library/golang"},
+		{"index.docker.io/rohan/cion", "docker.io/rohan/cion"},
+		{"registry.example.com/team/app:1.0", "registry.example.com/team/app"},
+		{"registry.example.com:5000/app", "registry.example.com:5000/app"},
+		{"localhost/app", "localhost/app"},
+		{"localhost:5000/app:1.0@sha256:abc", "localhost:5000/app"},
+	}
+
+	for _, tt := range tests {
+		if repository := imageRepository(tt.image); repository != tt.repository {
+			t.Errorf("imageRepository(%q) = %q, want %q", tt.image, repository, tt.repository)
+		}
+	}
+}
@@ -0,0 +1,546 @@
+package cion
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// RemoteLogBufferSize is the number of bytes that are buffered for a log stream of a job that
+	// an agent is running, before they're sent to the server.
+	RemoteLogBufferSize = 32 * 1024
+
+	// RemoteLogInterval is the longest time that writes to a job's logs are buffered by an
+	// agent before they're sent to the server.
+	RemoteLogInterval = time.Second
+)
+
+// storeRequest holds the arguments for a JobStore method that an agent calls on the server.
+type storeRequest struct {
+	Owner       string      `json:",omitempty"`
+	Repo        string      `json:",omitempty"`
+	Number      uint64      `json:",omitempty"`
+	Environment string      `json:",omitempty"`
+	Name        string      `json:",omitempty"`
+	Key         string      `json:",omitempty"`
+	Filter      *JobFilter  `json:",omitempty"`
+	Job         *Job        `json:",omitempty"`
+	Ref         *JobRef     `json:",omitempty"`
+	Deployment  *Deployment `json:",omitempty"`
+	Cache       *CacheEntry `json:",omitempty"`
+}
+
+// storeResponse holds the results of a JobStore method that an agent called on the server.
+type storeResponse struct {
+	Job         *Job          `json:",omitempty"`
+	Jobs        []*Job        `json:",omitempty"`
+	Names       []string      `json:",omitempty"`
+	Deployments []*Deployment `json:",omitempty"`
+	Lock        *Lock         `json:",omitempty"`
+	Acquired    bool          `json:",omitempty"`
+	Caches      []*CacheEntry `json:",omitempty"`
+}
+
+// RemoteJobStore is a JobStore that reads and writes jobs through the API of a cion server,
+// which is how agents report on the jobs that they run. The server only accepts requests for
+// jobs that are running on the agent, so each job is run with a store for that job, which is
+// returned by forJob.
+type RemoteJobStore struct {
+	server string
+	token  string
+	client *http.Client
+
+	// agent is shared by the stores for each job, since the agent's ID changes if it has to
+	// register again.
+	agent *remoteAgent
+
+	// job is the job that the store makes requests for, or nil if it isn't for a job.
+	job *JobRef
+
+	// logs holds the buffered writes to the job's logs.
+	logs *remoteLogs
+}
+
+// remoteAgent is the ID that an agent is registered with.
+type remoteAgent struct {
+	mu sync.Mutex
+	id string
+}
+
+// errNoJob is returned by a RemoteJobStore that isn't for a job.
+var errNoJob = errors.New("remote job store is not for a job")
+
+// NewRemoteJobStore returns a RemoteJobStore for the cion server at a base URL, which
+// authenticates with a token if it's not empty.
+func NewRemoteJobStore(server, token string) *RemoteJobStore {
+	return &RemoteJobStore{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		client: &http.Client{},
+		agent:  &remoteAgent{},
+	}
+}
+
+// forJob returns a store that makes requests for a job that the agent is running. The server
+// only lets the store change the job itself, along with the records for the job's repo.
+func (s *RemoteJobStore) forJob(j *Job) *RemoteJobStore {
+	ref := refOf(j)
+
+	js := *s
+	js.job = &ref
+	js.logs = &remoteLogs{buffers: map[string]*remoteLogBuffer{}}
+	return &js
+}
+
+// setAgent sets the ID of the agent that the store is used by.
+func (s *RemoteJobStore) setAgent(id string) {
+	s.agent.mu.Lock()
+	defer s.agent.mu.Unlock()
+
+	s.agent.id = id
+}
+
+// agentPath returns the path of an API endpoint for the store's agent.
+func (s *RemoteJobStore) agentPath(p string) string {
+	s.agent.mu.Lock()
+	defer s.agent.mu.Unlock()
+
+	return "/api/agents/" + s.agent.id + p
+}
+
+// jobPath returns the path of an agent API endpoint for the store's job.
+func (s *RemoteJobStore) jobPath(p string) string {
+	return s.agentPath(fmt.Sprintf("/jobs/%s/%s/%d/%s", url.QueryEscape(s.job.Owner),
+		url.QueryEscape(s.job.Repo), s.job.Number, p))
+}
+
+// do makes a request to the server, and returns the response if it succeeded.
+func (s *RemoteJobStore) do(method, p string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, s.server+p, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		b, _ := ioutil.ReadAll(resp.Body)
+		msg := strings.TrimSpace(string(b))
+
+		if resp.StatusCode == http.StatusNotFound && msg == errUnknownAgent.Error() {
+			return nil, errUnknownAgent
+		}
+
+		return nil, fmt.Errorf("%s %s: %s: %s", method, p, resp.Status, msg)
+	}
+
+	return resp, nil
+}
+
+// doJSON makes a request to the server with a JSON body, and decodes the JSON response into
+// out. If the server doesn't return any content, out is left as is.
+func (s *RemoteJobStore) doJSON(method, p string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(b)
+	}
+
+	resp, err := s.do(method, p, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// call calls a JobStore method on the server for the store's job.
+func (s *RemoteJobStore) call(method string, req storeRequest) (*storeResponse, error) {
+	if s.job == nil {
+		return nil, errNoJob
+	}
+
+	var resp storeResponse
+	if err := s.doJSON("POST", s.jobPath("store/"+method), req, &resp); err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+// artifactsPath returns the path of the artifacts endpoint for a job's artifacts, which may be
+// the artifacts of another job than the store's, like a dependency.
+func (s *RemoteJobStore) artifactsPath(j *Job) (string, error) {
+	if s.job == nil {
+		return "", errNoJob
+	}
+
+	q := url.Values{
+		"owner":  {j.Owner},
+		"repo":   {j.Repo},
+		"number": {strconv.FormatUint(j.Number, 10)},
+	}
+
+	return s.jobPath("artifacts") + "?" + q.Encode(), nil
+}
+
+func (s *RemoteJobStore) GetByNumber(owner, repo string, number uint64) (*Job, error) {
+	resp, err := s.call("get", storeRequest{Owner: owner, Repo: repo, Number: number})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Job, nil
+}
+
+func (s *RemoteJobStore) ListOwners() ([]string, error) {
+	resp, err := s.call("list_owners", storeRequest{})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Names, nil
+}
+
+func (s *RemoteJobStore) ListRepos(owner string) ([]string, error) {
+	resp, err := s.call("list_repos", storeRequest{Owner: owner})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Names, nil
+}
+
+func (s *RemoteJobStore) List(owner, repo string, f JobFilter) ([]*Job, error) {
+	resp, err := s.call("list", storeRequest{Owner: owner, Repo: repo, Filter: &f})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Jobs, nil
+}
+
+// Save saves a job on the server, and sets the job's number if it didn't have one. The store's
+// buffered logs are sent first, since the server doesn't accept them once the job has ended.
+func (s *RemoteJobStore) Save(j *Job) error {
+	if s.job != nil && *s.job == refOf(j) {
+		if err := s.logs.flushAll(s); err != nil {
+			log.Println("error writing job logs:", err)
+		}
+	}
+
+	resp, err := s.call("save", storeRequest{Job: j})
+	if err != nil {
+		return err
+	}
+
+	if resp.Job != nil {
+		j.Number = resp.Job.Number
+	}
+
+	return nil
+}
+
+// GetLogger returns a logger for a job, which the server only accepts if the job is running on
+// the agent.
+func (s *RemoteJobStore) GetLogger(j *Job) JobLogger {
+	// the loggers for the store's job share its buffers, so that writes stay in order
+	if s.job != nil && *s.job == refOf(j) {
+		return remoteLogger{store: s}
+	}
+
+	return remoteLogger{store: s.forJob(j)}
+}
+
+func (s *RemoteJobStore) SaveDeployment(d *Deployment) error {
+	_, err := s.call("save_deployment", storeRequest{Deployment: d})
+	return err
+}
+
+func (s *RemoteJobStore) ListDeployments(owner, repo, environment string) ([]*Deployment,
+	error) {
+
+	resp, err := s.call("list_deployments", storeRequest{
+		Owner:       owner,
+		Repo:        repo,
+		Environment: environment,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Deployments, nil
+}
+
+func (s *RemoteJobStore) AcquireLock(name string, ref JobRef) (*Lock, bool, error) {
+	resp, err := s.call("acquire_lock", storeRequest{Name: name, Ref: &ref})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return resp.Lock, resp.Acquired, nil
+}
+
+func (s *RemoteJobStore) ReleaseLock(name string, ref JobRef) error {
+	_, err := s.call("release_lock", storeRequest{Name: name, Ref: &ref})
+	return err
+}
+
+func (s *RemoteJobStore) SaveCache(c *CacheEntry) error {
+	_, err := s.call("save_cache", storeRequest{Cache: c})
+	return err
+}
+
+func (s *RemoteJobStore) ListCaches(owner, repo string) ([]*CacheEntry, error) {
+	resp, err := s.call("list_caches", storeRequest{Owner: owner, Repo: repo})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp.Caches, nil
+}
+
+func (s *RemoteJobStore) DeleteCache(owner, repo, key string) error {
+	_, err := s.call("delete_cache", storeRequest{Owner: owner, Repo: repo, Key: key})
+	return err
+}
+
+func (s *RemoteJobStore) SaveArtifacts(j *Job, r io.Reader) error {
+	p, err := s.artifactsPath(j)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("PUT", p, r)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (s *RemoteJobStore) GetArtifacts(j *Job, w io.Writer) error {
+	p, err := s.artifactsPath(j)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("GET", p, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (s *RemoteJobStore) DeleteArtifacts(j *Job) error {
+	p, err := s.artifactsPath(j)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.do("DELETE", p, nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// trigger asks the server to start the downstream jobs of the store's job, and returns them.
+// The server reads the targets from the job's config itself.
+func (s *RemoteJobStore) trigger() ([]JobRef, error) {
+	if s.job == nil {
+		return nil, errNoJob
+	}
+
+	// the server writes the downstream jobs to the job's log after what the agent wrote
+	if err := s.logs.flushAll(s); err != nil {
+		return nil, err
+	}
+
+	var refs []JobRef
+	if err := s.doJSON("POST", s.jobPath("trigger"), nil, &refs); err != nil {
+		return nil, err
+	}
+
+	return refs, nil
+}
+
+// remoteLogs buffers the writes to a job's log streams, so that an agent doesn't make a request
+// to the server for every write. A stream's writes are sent when its buffer is full, before a
+// step is written to it or it's read, and otherwise every RemoteLogInterval.
+type remoteLogs struct {
+	mu      sync.Mutex
+	buffers map[string]*remoteLogBuffer
+	timer   *time.Timer
+}
+
+// remoteLogBuffer holds the writes to a log stream that haven't been sent yet.
+type remoteLogBuffer struct {
+	streams []string
+	bytes.Buffer
+}
+
+// write buffers a write to a log stream, and sends the stream's writes if its buffer is full.
+func (ls *remoteLogs) write(s *RemoteJobStore, streams []string, p []byte) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	key := strings.Join(streams, "\x00")
+	b, ok := ls.buffers[key]
+	if !ok {
+		b = &remoteLogBuffer{streams: streams}
+		ls.buffers[key] = b
+	}
+	b.Write(p)
+
+	if b.Len() >= RemoteLogBufferSize {
+		return ls.flush(s, key)
+	}
+
+	if ls.timer == nil {
+		ls.timer = time.AfterFunc(RemoteLogInterval, func() {
+			if err := ls.flushAll(s); err != nil {
+				log.Println("error writing job logs:", err)
+			}
+		})
+	}
+
+	return nil
+}
+
+// flushStream sends the buffered writes to a log stream.
+func (ls *remoteLogs) flushStream(s *RemoteJobStore, streams []string) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	return ls.flush(s, strings.Join(streams, "\x00"))
+}
+
+// flushAll sends the buffered writes to all of the log streams.
+func (ls *remoteLogs) flushAll(s *RemoteJobStore) error {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if ls.timer != nil {
+		ls.timer.Stop()
+		ls.timer = nil
+	}
+
+	var err error
+	for key := range ls.buffers {
+		if ferr := ls.flush(s, key); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+
+	return err
+}
+
+// flush sends the buffered writes to the log stream with a key. The lock has to be held, so
+// that writes to the stream are sent in order.
+func (ls *remoteLogs) flush(s *RemoteJobStore, key string) error {
+	b, ok := ls.buffers[key]
+	if !ok {
+		return nil
+	}
+	delete(ls.buffers, key)
+
+	resp, err := s.do("POST", s.logPath(b.streams, url.Values{}), &b.Buffer)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+// logPath returns the path of the log endpoint for the store's job, with the names of nested
+// log streams and any other query parameters.
+func (s *RemoteJobStore) logPath(streams []string, q url.Values) string {
+	for _, name := range streams {
+		q.Add("stream", name)
+	}
+
+	return s.jobPath("log") + "?" + q.Encode()
+}
+
+// remoteLogger is a JobLogger that writes a job's logs to the server, with a store for the
+// job. Writes are buffered by the store.
+type remoteLogger struct {
+	store *RemoteJobStore
+
+	// streams are the names of the nested log streams that the logger writes to.
+	streams []string
+}
+
+func (l remoteLogger) Write(p []byte) (int, error) {
+	if err := l.store.logs.write(l.store, l.streams, p); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (l remoteLogger) WriteStep(name string) error {
+	if err := l.store.logs.flushStream(l.store, l.streams); err != nil {
+		return err
+	}
+
+	resp, err := l.store.do("POST", l.store.logPath(l.streams, url.Values{"step": {name}}), nil)
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (l remoteLogger) WriteTo(w io.Writer) (int64, error) {
+	if err := l.store.logs.flushStream(l.store, l.streams); err != nil {
+		return 0, err
+	}
+
+	resp, err := l.store.do("GET", l.store.logPath(l.streams, url.Values{}), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	return io.Copy(w, resp.Body)
+}
+
+func (l remoteLogger) Stream(name string) JobLogger {
+	streams := append(append([]string{}, l.streams...), name)
+	return remoteLogger{store: l.store, streams: streams}
+}
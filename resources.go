@@ -0,0 +1,139 @@
+package cion
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ErrOOMKilled is returned by an Executor when a container was killed because it ran out of
+// memory.
+var ErrOOMKilled = errors.New("container was killed because it ran out of memory")
+
+// UnlimitedSwap is the MemorySwap limit for a container that can use as much swap as it wants.
+const UnlimitedSwap = -1
+
+// ResourceLimits are limits on the resources that a container can use. Zero values mean that
+// the resource is unlimited.
+type ResourceLimits struct {
+	// CPUs is the number of CPUs that the container can use, e.g. 1.5.
+	CPUs float64
+
+	// Memory is the maximum amount of memory for the container, in bytes.
+	Memory int64
+
+	// MemorySwap is the maximum amount of memory plus swap for the container, in bytes, or
+	// UnlimitedSwap. It only applies if there's a memory limit.
+	MemorySwap int64
+
+	// PidsLimit is the maximum number of processes in the container.
+	PidsLimit int64
+}
+
+// limitingExecutor is an Executor that clamps the resource limits of every container that it
+// runs to a set of maximums.
+type limitingExecutor struct {
+	Executor
+
+	max ResourceLimits
+}
+
+func (e limitingExecutor) Run(opts RunContainerOpts) (string, error) {
+	opts.Resources = opts.Resources.clamp(e.max)
+	return e.Executor.Run(opts)
+}
+
+// clamp returns the resource limits, reduced to be within the given maximums. Unlimited
+// resources are set to the maximum.
+func (rl ResourceLimits) clamp(max ResourceLimits) ResourceLimits {
+	if max.CPUs > 0 && (rl.CPUs <= 0 || rl.CPUs > max.CPUs) {
+		rl.CPUs = max.CPUs
+	}
+
+	rl.Memory = clampInt(rl.Memory, max.Memory)
+	rl.MemorySwap = clampInt(rl.MemorySwap, max.MemorySwap)
+	rl.PidsLimit = clampInt(rl.PidsLimit, max.PidsLimit)
+
+	return rl.withValidSwap()
+}
+
+// withValidSwap returns the resource limits with a swap limit that Docker accepts. Swap can't be
+// limited without limiting memory, and memory plus swap can't be less than memory.
+func (rl ResourceLimits) withValidSwap() ResourceLimits {
+	if rl.Memory <= 0 {
+		rl.MemorySwap = 0
+	} else if rl.MemorySwap > 0 && rl.MemorySwap < rl.Memory {
+		rl.MemorySwap = rl.Memory
+	}
+
+	return rl
+}
+
+func clampInt(x, max int64) int64 {
+	if max > 0 && (x <= 0 || x > max) {
+		return max
+	}
+
+	return x
+}
+
+// resources returns the resource limits requested by a container config.
+func (cc ContainerConfig) resources() (ResourceLimits, error) {
+	rl := ResourceLimits{
+		CPUs:      cc.CPU,
+		PidsLimit: cc.PidsLimit,
+	}
+	var err error
+
+	if rl.Memory, err = ParseBytes(cc.Memory); err != nil {
+		return rl, fmt.Errorf("invalid memory limit: %v", err)
+	}
+
+	if cc.MemorySwap == "-1" {
+		rl.MemorySwap = UnlimitedSwap
+	} else if rl.MemorySwap, err = ParseBytes(cc.MemorySwap); err != nil {
+		return rl, fmt.Errorf("invalid memory_swap limit: %v", err)
+	}
+
+	return rl.withValidSwap(), nil
+}
+
+// ParseBytes parses an amount of memory like "512m" or "2g" into bytes. An empty string is
+// zero bytes.
+func ParseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+
+	s = strings.TrimSuffix(strings.ToLower(s), "b")
+	if s == "" {
+		return 0, errors.New("missing amount of memory")
+	}
+
+	mult := int64(1)
+
+	switch s[len(s)-1] {
+	case 'k':
+		mult = 1 << 10
+	case 'm':
+		mult = 1 << 20
+	case 'g':
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	} else if n < 0 {
+		return 0, errors.New("amount of memory can't be negative")
+	} else if n > math.MaxInt64/mult {
+		return 0, errors.New("amount of memory is too large")
+	}
+
+	return n * mult, nil
+}
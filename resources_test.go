@@ -0,0 +1,44 @@
+package cion
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseBytes(t *testing.T) {
+	tests := []struct {
+		s   string
+		n   int64
+		err bool
+	}{
+		{s: "", n: 0},
+		{s: "0", n: 0},
+		{s: "1024", n: 1024},
+		{s: "512b", n: 512},
+		{s: "64k", n: 64 << 10},
+		{s: "512m", n: 512 << 20},
+		{s: "512MB", n: 512 << 20},
+		{s: "2g", n: 2 << 30},
+		{s: "9223372036854775807", n: math.MaxInt64},
+		{s: "8589934591g", n: 8589934591 << 30},
+		{s: "8589934592g", err: true},
+		{s: "9007199254740992m", err: true},
+		{s: "9223372036854775808", err: true},
+		{s: "-1m", err: true},
+		{s: "b", err: true},
+		{s: "1.5g", err: true},
+		{s: "g", err: true},
+		{s: "1t", err: true},
+	}
+
+	for _, tt := range tests {
+		n, err := ParseBytes(tt.s)
+		if tt.err {
+			if err == nil {
+				t.Errorf("ParseBytes(%q) = %d, want an error", tt.s, n)
+			}
+		} else if err != nil || n != tt.n {
+			t.Errorf("ParseBytes(%q) = %d, %v, want %d", tt.s, n, err, tt.n)
+		}
+	}
+}
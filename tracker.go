@@ -0,0 +1,205 @@
+package cion
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// JobTracker keeps track of the jobs that are running in this process, so that they can be
+// controlled through the API while they run.
+type JobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*trackedJob
+}
+
+// trackedJob is the in-process state of a running job.
+type trackedJob struct {
+	// approval receives the decision for a job that is waiting for approval. It is nil when
+	// the job isn't waiting.
+	approval chan Approval
+
+	// containers are the containers that have been started for the job.
+	containers []string
+
+	// cancel is closed when the job is superseded by a newer job.
+	cancel       chan struct{}
+	supersededBy uint64
+}
+
+func NewJobTracker() *JobTracker {
+	return &JobTracker{jobs: make(map[string]*trackedJob)}
+}
+
+func trackerKey(owner, repo string, number uint64) string {
+	return fmt.Sprintf("%s/%s/%d", owner, repo, number)
+}
+
+// add starts tracking a job.
+func (t *JobTracker) add(j *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.jobs[trackerKey(j.Owner, j.Repo, j.Number)] = &trackedJob{cancel: make(chan struct{})}
+}
+
+// executor wraps an Executor to record the containers that are started for a job.
+func (t *JobTracker) executor(j *Job, e Executor) Executor {
+	return trackingExecutor{
+		Executor: e,
+		tracker:  t,
+		key:      trackerKey(j.Owner, j.Repo, j.Number),
+	}
+}
+
+// cancelled returns a channel that is closed if the job is superseded, or nil if the job
+// isn't tracked.
+func (t *JobTracker) cancelled(j *Job) <-chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tj, ok := t.jobs[trackerKey(j.Owner, j.Repo, j.Number)]; ok {
+		return tj.cancel
+	}
+
+	return nil
+}
+
+// supersededBy returns the number of the job that superseded a job, or zero if it hasn't been
+// superseded.
+func (t *JobTracker) supersededBy(j *Job) uint64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tj, ok := t.jobs[trackerKey(j.Owner, j.Repo, j.Number)]; ok {
+		return tj.supersededBy
+	}
+
+	return 0
+}
+
+// Supersede cancels a running job because it was superseded by a newer job. Any containers
+// started for the job are killed. It returns false if the job isn't running in this process.
+func (t *JobTracker) Supersede(ref JobRef, by uint64, e Executor) bool {
+	t.mu.Lock()
+
+	tj, ok := t.jobs[trackerKey(ref.Owner, ref.Repo, ref.Number)]
+	if !ok {
+		t.mu.Unlock()
+		return false
+	}
+
+	var containers []string
+	if tj.supersededBy == 0 {
+		tj.supersededBy = by
+		close(tj.cancel)
+
+		containers = append(containers, tj.containers...)
+	}
+
+	// killing containers can be slow, so it's done without holding up the rest of the tracker
+	t.mu.Unlock()
+
+	for _, c := range containers {
+		// containers that have already exited can't be killed, which is fine
+		e.Kill(c)
+	}
+
+	return true
+}
+
+// remove stops tracking a job once it has finished.
+func (t *JobTracker) remove(j *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.jobs, trackerKey(j.Owner, j.Repo, j.Number))
+}
+
+// awaitApproval registers a job as waiting for approval, and returns a channel that receives
+// the decision.
+func (t *JobTracker) awaitApproval(j *Job) (<-chan Approval, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tj, ok := t.jobs[trackerKey(j.Owner, j.Repo, j.Number)]
+	if !ok {
+		return nil, fmt.Errorf("job %d is not running", j.Number)
+	}
+
+	tj.approval = make(chan Approval, 1)
+	return tj.approval, nil
+}
+
+// stopAwaitingApproval unregisters a job that is no longer waiting for approval.
+func (t *JobTracker) stopAwaitingApproval(j *Job) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if tj, ok := t.jobs[trackerKey(j.Owner, j.Repo, j.Number)]; ok {
+		tj.approval = nil
+	}
+}
+
+// Decide approves or rejects a job that is waiting for approval. It returns false if the job
+// isn't waiting for approval.
+func (t *JobTracker) Decide(owner, repo string, number uint64, a Approval) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tj, ok := t.jobs[trackerKey(owner, repo, number)]
+	if !ok || tj.approval == nil {
+		return false
+	}
+
+	tj.approval <- a
+	tj.approval = nil
+	return true
+}
+
+// trackingExecutor is an Executor that records the containers started for a tracked job, so
+// that they can be killed if the job is cancelled.
+type trackingExecutor struct {
+	Executor
+
+	tracker *JobTracker
+	key     string
+}
+
+// errCancelled is returned when a job is cancelled because it was superseded by a newer job.
+var errCancelled = errors.New("job was cancelled")
+
+func (e trackingExecutor) Run(opts RunContainerOpts) (string, error) {
+	if e.isCancelled() {
+		return "", errCancelled
+	}
+
+	c, err := e.Executor.Run(opts)
+	if err != nil {
+		return "", err
+	}
+
+	e.tracker.mu.Lock()
+
+	tj, ok := e.tracker.jobs[e.key]
+	if ok && tj.supersededBy != 0 {
+		e.tracker.mu.Unlock()
+
+		// the job was cancelled while the container was starting
+		e.Executor.Kill(c)
+		return "", errCancelled
+	} else if ok {
+		tj.containers = append(tj.containers, c)
+	}
+
+	e.tracker.mu.Unlock()
+	return c, nil
+}
+
+func (e trackingExecutor) isCancelled() bool {
+	e.tracker.mu.Lock()
+	defer e.tracker.mu.Unlock()
+
+	tj, ok := e.tracker.jobs[e.key]
+	return ok && tj.supersededBy != 0
+}
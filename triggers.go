@@ -0,0 +1,157 @@
+package cion
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/go-github/github"
+	"io"
+	"log"
+	"path"
+	"strings"
+)
+
+// parseTriggerTarget parses a downstream target in the form owner/repo[@branch]. If no branch is
+// given, the downstream job is for the master branch.
+func parseTriggerTarget(target string) (owner, repo, branch string, err error) {
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		target, branch = target[:i], target[i+1:]
+	}
+
+	parts := strings.Split(target, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", "", fmt.Errorf("trigger %q must be in the form owner/repo[@branch]",
+			target)
+	}
+
+	return parts[0], parts[1], branch, nil
+}
+
+// triggerDownstream starts a job for each of the downstream targets of a successful job. Jobs
+// run by an agent have their downstream jobs started by the server instead, which queues them
+// for any agent.
+func triggerDownstream(r JobRequest, targets []string, jl io.Writer) error {
+	j := r.Job
+
+	if r.Server != nil {
+		refs, err := r.Server.trigger()
+		if err != nil {
+			return err
+		}
+
+		j.Downstream = append(j.Downstream, refs...)
+	} else {
+		jobs, err := downstreamJobs(j, targets, jl)
+		if err != nil {
+			return err
+		}
+
+		for _, dj := range jobs {
+			if err := r.Store.Save(dj); err != nil {
+				return err
+			}
+
+			fmt.Fprintf(jl, "CION: triggered %s/%s job #%d\n", dj.Owner, dj.Repo, dj.Number)
+			j.Downstream = append(j.Downstream, refOf(dj))
+
+			// the downstream job gets its own executor wrappers when it runs
+			dr := r
+			dr.Job = dj
+			dr.Executor = r.baseExecutor
+			go dr.Run()
+		}
+	}
+
+	if err := r.Store.Save(j); err != nil {
+		log.Println("error saving job:", err)
+	}
+
+	return nil
+}
+
+// downstreamJobs returns new, unsaved jobs for the downstream targets of a job. Targets for
+// repos that are already upstream of the job are skipped, so that cycles of triggers don't run
+// forever.
+func downstreamJobs(j *Job, targets []string, jl io.Writer) ([]*Job, error) {
+	// the chain of upstream jobs for downstream jobs includes this one
+	chain := append(append([]JobRef(nil), j.UpstreamChain...), refOf(j))
+
+	var jobs []*Job
+	for _, t := range targets {
+		owner, repo, branch, err := parseTriggerTarget(t)
+		if err != nil {
+			return nil, err
+		}
+
+		if inChain(chain, owner, repo) {
+			fmt.Fprintf(jl, "CION: not triggering %s, since it's already upstream of this job\n",
+				t)
+			continue
+		}
+
+		dj := NewJob(owner, repo, branch, "", "")
+		dj.Trigger = TriggerUpstream
+		dj.TriggeredBy = fmt.Sprintf("%s/%s#%d", j.Owner, j.Repo, j.Number)
+		up := refOf(j)
+		dj.Upstream = &up
+		dj.UpstreamChain = chain
+
+		jobs = append(jobs, dj)
+	}
+
+	return jobs, nil
+}
+
+// fetchJobConfig reads the .cion.yml of a job's commit from GitHub, and checks it against the
+// server's policy. This lets the server check the requests of an agent that runs the job
+// without trusting the config that the agent parsed.
+func fetchJobConfig(j *Job, gh *github.Client, p *Policy) (*JobConfig, error) {
+	if j.SHA == "" {
+		return nil, errors.New("job has no commit to read the config from")
+	}
+
+	fc, _, _, err := gh.Repositories.GetContents(j.Owner, j.Repo, ".cion.yml",
+		&github.RepositoryContentGetOptions{Ref: j.SHA})
+	if err != nil {
+		return nil, err
+	} else if fc == nil {
+		return nil, errors.New(".cion.yml is not a file")
+	}
+
+	b, err := fc.Decode()
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeJobConfig(j, b, p)
+}
+
+// triggersBranch returns true if jobs for a branch start the job config's triggers.
+func (jc JobConfig) triggersBranch(branch string) bool {
+	if branch == "" {
+		return false
+	}
+
+	patterns := jc.TriggerBranches
+	if len(patterns) == 0 {
+		patterns = []string{"master"}
+	}
+
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, branch); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// inChain returns true if any job in the chain is for the owner/repo.
+func inChain(chain []JobRef, owner, repo string) bool {
+	for _, ref := range chain {
+		if ref.Owner == owner && ref.Repo == repo {
+			return true
+		}
+	}
+
+	return false
+}
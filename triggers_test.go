@@ -0,0 +1,63 @@
+package cion
+
+import (
+	"testing"
+)
+
+func TestParseTriggerTarget(t *testing.T) {
+	tests := []struct {
+		target              string
+		owner, repo, branch string
+		err                 bool
+	}{
+		{target: "rohan/cion", owner: "rohan", repo: "cion"},
+		{target: "rohan/cion@release", owner: "rohan", repo: "cion", branch: "release"},
+		{target: "rohan/cion@", owner: "rohan", repo: "cion"},
+		{target: "rohan", err: true},
+		{target: "rohan/", err: true},
+		{target: "/cion", err: true},
+		{target: "rohan/cion/extra", err: true},
+		{target: "@master", err: true},
+		{target: "", err: true},
+	}
+
+	for _, tt := range tests {
+		owner, repo, branch, err := parseTriggerTarget(tt.target)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseTriggerTarget(%q) = %s, %s, %s, want an error", tt.target,
+					owner, repo, branch)
+			}
+		} else if err != nil || owner != tt.owner || repo != tt.repo || branch != tt.branch {
+			t.Errorf("parseTriggerTarget(%q) = %s, %s, %s, %v", tt.target, owner, repo,
+				branch, err)
+		}
+	}
+}
+
+func TestInChain(t *testing.T) {
+	chain := []JobRef{
+		{Owner: "rohan", Repo: "lib", Number: 3},
+		{Owner: "rohan", Repo: "app", Number: 7},
+	}
+
+	tests := []struct {
+		chain       []JobRef
+		owner, repo string
+		in          bool
+	}{
+		{chain, "rohan", "lib", true},
+		{chain, "rohan", "app", true},
+		{chain, "rohan", "cion", false},
+		{chain, "spotify", "lib", false},
+		{chain, "rohan/lib", "", false},
+		{nil, "rohan", "lib", false},
+	}
+
+	for _, tt := range tests {
+		if in := inChain(tt.chain, tt.owner, tt.repo); in != tt.in {
+			t.Errorf("inChain(%v, %s, %s) = %v, want %v", tt.chain, tt.owner, tt.repo, in,
+				tt.in)
+		}
+	}
+}
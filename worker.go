@@ -1 +1,687 @@
 package cion
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"errors"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	// AgentPollTimeout is how long a poll for a job waits before the agent polls again.
+	AgentPollTimeout = 30 * time.Second
+
+	// AgentHeartbeatInterval is how often agents tell the server that they're still running,
+	// and AgentTimeout is how long the server waits to hear from an agent before it fails the
+	// agent's jobs.
+	AgentHeartbeatInterval = 15 * time.Second
+	AgentTimeout           = 2 * time.Minute
+
+	// AgentLeaseTimeout is how long an agent has to acknowledge a job that it polled before
+	// the job is queued again, e.g. because the response to the poll was lost.
+	AgentLeaseTimeout = time.Minute
+)
+
+var (
+	// errUnknownAgent is returned when an agent isn't registered with the server, e.g. because
+	// the server restarted.
+	errUnknownAgent = errors.New("unknown agent")
+
+	// errNotAgentJob is returned when an agent makes a request for a job that it isn't
+	// running.
+	errNotAgentJob = errors.New("job is not running on the agent")
+)
+
+// AgentInfo describes an agent that is registered with the server.
+type AgentInfo struct {
+	ID       string
+	Name     string
+	LastSeen *time.Time
+
+	// Jobs are the unfinished jobs that the agent is running.
+	Jobs []JobRef
+}
+
+// JobQueue holds the jobs that are waiting to be run by remote agents, and keeps track of the
+// agents and the jobs that they're running. A job that an agent polls is leased to it until
+// the agent acknowledges it, and is queued again if the lease expires. Jobs run by an agent
+// that stops responding fail.
+type JobQueue struct {
+	store JobStore
+
+	mu     sync.Mutex
+	jobs   []*Job
+	agents map[string]*agentState
+
+	// leases are the jobs that have been polled by agents but not acknowledged yet.
+	leases map[JobRef]*jobLease
+
+	// ready is closed and replaced whenever a job is added to the queue.
+	ready chan struct{}
+}
+
+// jobLease is a job that was given to an agent, which is queued again if the agent doesn't
+// acknowledge it before it expires.
+type jobLease struct {
+	agent   string
+	job     *Job
+	expires time.Time
+}
+
+// agentState is the server's record of a registered agent.
+type agentState struct {
+	name     string
+	lastSeen time.Time
+	jobs     map[JobRef]bool
+
+	// commands are the commands that the agent hasn't received yet, and sent is closed and
+	// replaced whenever one is added.
+	commands []agentCommand
+	sent     chan struct{}
+}
+
+// agentCommand asks an agent to approve, reject, or supersede one of the jobs that it's
+// running, which the agent does with its JobTracker like the server would for its own jobs.
+type agentCommand struct {
+	Job JobRef
+
+	// Approval is the decision for a job that is waiting for approval, if any.
+	Approval *Approval `json:",omitempty"`
+
+	// SupersededBy is the number of the newer job that supersedes the job, if any.
+	SupersededBy uint64 `json:",omitempty"`
+}
+
+// command queues a command for the agent, and wakes it up if it's waiting for one.
+func (a *agentState) command(cmd agentCommand) {
+	a.commands = append(a.commands, cmd)
+	close(a.sent)
+	a.sent = make(chan struct{})
+}
+
+// NewJobQueue returns a JobQueue for jobs in the given store, and starts checking for agents
+// that stop responding. Jobs that are still queued in the store, e.g. because the server
+// restarted before an agent started them, are queued again.
+func NewJobQueue(s JobStore) *JobQueue {
+	q := &JobQueue{
+		store:  s,
+		jobs:   queuedJobs(s),
+		agents: make(map[string]*agentState),
+		leases: make(map[JobRef]*jobLease),
+		ready:  make(chan struct{}),
+	}
+
+	go q.monitor()
+
+	return q
+}
+
+// queuedJobs returns the queued jobs in a store, oldest first.
+func queuedJobs(s JobStore) []*Job {
+	owners, err := s.ListOwners()
+	if err != nil {
+		// there are no jobs yet
+		return nil
+	}
+
+	var l []*Job
+	for _, o := range owners {
+		repos, err := s.ListRepos(o)
+		if err != nil {
+			log.Println("error getting repos list:", err)
+			continue
+		}
+
+		for _, r := range repos {
+			jobs, err := s.List(o, r, JobFilter{Status: JobQueued})
+			if err != nil {
+				log.Println("error getting job list:", err)
+				continue
+			}
+
+			l = append(l, jobs...)
+		}
+	}
+
+	sort.Sort(jobsByStart(l))
+	return l
+}
+
+// push adds a job to the end of the queue.
+func (q *JobQueue) push(j *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.jobs = append(q.jobs, j)
+	q.notify()
+}
+
+// notify wakes up the agents that are waiting for a job. The lock must be held.
+func (q *JobQueue) notify() {
+	close(q.ready)
+	q.ready = make(chan struct{})
+}
+
+// register records a new agent, and returns its ID.
+func (q *JobQueue) register(name string) string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	id := uuid.New()
+	q.agents[id] = &agentState{
+		name:     name,
+		lastSeen: time.Now(),
+		jobs:     make(map[JobRef]bool),
+		sent:     make(chan struct{}),
+	}
+
+	log.Printf("agent %s registered as %s", name, id)
+	return id
+}
+
+// seen records that an agent is still running.
+func (q *JobQueue) seen(id string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	a, ok := q.agents[id]
+	if !ok {
+		return errUnknownAgent
+	}
+
+	a.lastSeen = time.Now()
+	return nil
+}
+
+// poll waits for a job for an agent, and leases it to the agent until the agent acknowledges
+// it. It returns nil if there isn't a job before the timeout.
+func (q *JobQueue) poll(id string, timeout time.Duration) (*Job, error) {
+	deadline := time.After(timeout)
+
+	for {
+		q.mu.Lock()
+
+		a, ok := q.agents[id]
+		if !ok {
+			q.mu.Unlock()
+			return nil, errUnknownAgent
+		}
+		a.lastSeen = time.Now()
+
+		if len(q.jobs) > 0 {
+			j := q.jobs[0]
+			q.jobs = q.jobs[1:]
+			a.jobs[refOf(j)] = true
+			q.leases[refOf(j)] = &jobLease{
+				agent:   id,
+				job:     j,
+				expires: time.Now().Add(AgentLeaseTimeout),
+			}
+			q.mu.Unlock()
+
+			j.Agent = a.name
+			if err := q.store.Save(j); err != nil {
+				log.Println("error saving job:", err)
+			}
+
+			return j, nil
+		}
+
+		ready := q.ready
+		q.mu.Unlock()
+
+		select {
+		case <-ready:
+		case <-deadline:
+			return nil, nil
+		}
+	}
+}
+
+// ack acknowledges a job that an agent polled, so that it isn't queued again. It fails if the
+// job isn't leased to the agent, e.g. because the lease expired and the job was queued again.
+func (q *JobQueue) ack(id string, ref JobRef) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.agents[id]; !ok {
+		return errUnknownAgent
+	}
+
+	if l, ok := q.leases[ref]; !ok || l.agent != id {
+		return errNotAgentJob
+	}
+
+	delete(q.leases, ref)
+	return nil
+}
+
+// owns returns an error unless an agent is running a job, and records that the agent is still
+// running.
+func (q *JobQueue) owns(id string, ref JobRef) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	a, ok := q.agents[id]
+	if !ok {
+		return errUnknownAgent
+	}
+	a.lastSeen = time.Now()
+
+	if !a.jobs[ref] {
+		return errNotAgentJob
+	}
+
+	return nil
+}
+
+// send queues a command for the agent that is running a job. It fails if no agent has started
+// the job.
+func (q *JobQueue) send(cmd agentCommand) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, leased := q.leases[cmd.Job]; !leased {
+		for _, a := range q.agents {
+			if a.jobs[cmd.Job] {
+				a.command(cmd)
+				return nil
+			}
+		}
+	}
+
+	return errNotAgentJob
+}
+
+// receive waits for commands for an agent, and returns them. It returns nil if there aren't
+// any before the timeout.
+func (q *JobQueue) receive(id string, timeout time.Duration) ([]agentCommand, error) {
+	deadline := time.After(timeout)
+
+	for {
+		q.mu.Lock()
+
+		a, ok := q.agents[id]
+		if !ok {
+			q.mu.Unlock()
+			return nil, errUnknownAgent
+		}
+		a.lastSeen = time.Now()
+
+		if len(a.commands) > 0 {
+			cmds := a.commands
+			a.commands = nil
+			q.mu.Unlock()
+
+			return cmds, nil
+		}
+
+		sent := a.sent
+		q.mu.Unlock()
+
+		select {
+		case <-sent:
+		case <-deadline:
+			return nil, nil
+		}
+	}
+}
+
+// supersede supersedes a job for a newer job. If an agent has started the job, the agent is
+// told to supersede it, and true is returned. Otherwise the job is taken out of the queue, and
+// it's up to the caller to record that it was superseded.
+func (q *JobQueue) supersede(ref JobRef, by uint64) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i, j := range q.jobs {
+		if refOf(j) == ref {
+			q.jobs = append(q.jobs[:i:i], q.jobs[i+1:]...)
+			return false
+		}
+	}
+
+	// an agent that polled the job but hasn't acknowledged it yet won't be able to
+	if l, ok := q.leases[ref]; ok {
+		delete(q.leases, ref)
+		if a, ok := q.agents[l.agent]; ok {
+			delete(a.jobs, ref)
+		}
+
+		return false
+	}
+
+	for _, a := range q.agents {
+		if a.jobs[ref] {
+			a.command(agentCommand{Job: ref, SupersededBy: by})
+			return true
+		}
+	}
+
+	return false
+}
+
+// track records a job that an agent saved, so that it fails if the agent stops responding
+// before the job ends. Once the job ends, the agent can't make any more requests for it.
+func (q *JobQueue) track(id string, j *Job) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	a, ok := q.agents[id]
+	if !ok {
+		return
+	}
+
+	if j.EndedAt == nil {
+		a.jobs[refOf(j)] = true
+	} else {
+		delete(a.jobs, refOf(j))
+	}
+}
+
+// list returns the registered agents, sorted by name.
+func (q *JobQueue) list() []AgentInfo {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l := make([]AgentInfo, 0, len(q.agents))
+	for id, a := range q.agents {
+		t := a.lastSeen
+		info := AgentInfo{ID: id, Name: a.name, LastSeen: &t, Jobs: []JobRef{}}
+		for ref := range a.jobs {
+			info.Jobs = append(info.Jobs, ref)
+		}
+
+		l = append(l, info)
+	}
+
+	sort.Sort(agentsByName(l))
+	return l
+}
+
+// monitor checks for expired leases and lost agents every AgentTimeout/4.
+func (q *JobQueue) monitor() {
+	for range time.Tick(AgentTimeout / 4) {
+		q.check()
+	}
+}
+
+// check queues jobs whose leases expired again, and removes agents that haven't been heard from
+// in AgentTimeout, failing the jobs that they were running. Jobs that a lost agent never
+// acknowledged are queued again instead, since they never started.
+func (q *JobQueue) check() {
+	q.mu.Lock()
+
+	lostAgents := make(map[string]bool)
+	var lost []JobRef
+	for id, a := range q.agents {
+		if time.Since(a.lastSeen) < AgentTimeout {
+			continue
+		}
+
+		log.Printf("agent %s stopped responding", a.name)
+		for ref := range a.jobs {
+			if _, leased := q.leases[ref]; !leased {
+				lost = append(lost, ref)
+			}
+		}
+
+		lostAgents[id] = true
+		delete(q.agents, id)
+	}
+
+	var requeued []*Job
+	for ref, l := range q.leases {
+		if !lostAgents[l.agent] && time.Now().Before(l.expires) {
+			continue
+		}
+
+		if a, ok := q.agents[l.agent]; ok {
+			log.Printf("agent %s didn't acknowledge job %s/%s #%d, queueing it again", a.name,
+				ref.Owner, ref.Repo, ref.Number)
+			delete(a.jobs, ref)
+		}
+
+		delete(q.leases, ref)
+		requeued = append(requeued, l.job)
+	}
+
+	if len(requeued) > 0 {
+		// the jobs were at the front of the queue before they were polled
+		sort.Sort(jobsByStart(requeued))
+		q.jobs = append(requeued, q.jobs...)
+		q.notify()
+	}
+
+	q.mu.Unlock()
+
+	for _, j := range requeued {
+		j.Agent = ""
+		if err := q.store.Save(j); err != nil {
+			log.Println("error saving job:", err)
+		}
+	}
+
+	for _, ref := range lost {
+		q.fail(ref, "the agent running the job stopped responding")
+	}
+}
+
+// fail marks an unfinished job as failed.
+func (q *JobQueue) fail(ref JobRef, reason string) {
+	j, err := q.store.GetByNumber(ref.Owner, ref.Repo, ref.Number)
+	if err != nil || j == nil || j.EndedAt != nil {
+		return
+	}
+
+	t := time.Now()
+	j.EndedAt = &t
+	j.Status = JobFailed
+	j.Error = reason
+
+	if err := q.store.Save(j); err != nil {
+		log.Println("error saving failed job:", err)
+	}
+}
+
+type agentsByName []AgentInfo
+
+func (l agentsByName) Len() int           { return len(l) }
+func (l agentsByName) Swap(i, j int)      { l[i], l[j] = l[j], l[i] }
+func (l agentsByName) Less(i, j int) bool { return l[i].Name < l[j].Name }
+
+// jobsByStart sorts jobs from the oldest to the newest.
+type jobsByStart []*Job
+
+func (l jobsByStart) Len() int      { return len(l) }
+func (l jobsByStart) Swap(i, j int) { l[i], l[j] = l[j], l[i] }
+func (l jobsByStart) Less(i, j int) bool {
+	if l[i].StartedAt == nil || l[j].StartedAt == nil {
+		return l[j].StartedAt != nil
+	}
+
+	return l[i].StartedAt.Before(*l[j].StartedAt)
+}
+
+// Agent runs jobs that it pulls from a cion server, writing their status and logs back to the
+// server's JobStore.
+type Agent struct {
+	// Server is the base URL of the cion server, e.g. "https://cion.example.com", and Token is
+	// the token that the server requires from agents, if any.
+	Server string
+	Token  string
+
+	// Name identifies the agent on the server.
+	Name string
+
+	// Concurrency is the number of jobs that the agent runs at once. It defaults to 1.
+	Concurrency int
+
+	// Config is used to run jobs. Its JobStore is replaced with the server's, and its
+	// JobTracker receives the approvals and cancellations for the agent's jobs from the server.
+	Config Config
+
+	mu sync.Mutex
+	id string
+}
+
+// Run registers the agent with the server, and runs jobs from the server until it stops.
+func (a *Agent) Run() {
+	store := NewRemoteJobStore(a.Server, a.Token)
+	a.Config.JobStore = store
+
+	if a.Config.Tracker == nil {
+		a.Config.Tracker = NewJobTracker()
+	}
+
+	if a.Concurrency <= 0 {
+		a.Concurrency = 1
+	}
+
+	for {
+		if err := a.register(store); err == nil {
+			break
+		} else {
+			log.Println("error registering with server:", err)
+			time.Sleep(AgentHeartbeatInterval)
+		}
+	}
+
+	go a.heartbeat(store)
+	go a.listen(store)
+
+	var wg sync.WaitGroup
+	for i := 0; i < a.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a.work(store)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// register registers the agent with the server, and uses the ID it returns for any further
+// requests.
+func (a *Agent) register(s *RemoteJobStore) error {
+	var info AgentInfo
+	if err := s.doJSON("POST", "/api/agents/", AgentInfo{Name: a.Name}, &info); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.id = info.ID
+	s.setAgent(info.ID)
+
+	log.Printf("registered with %s as %s", a.Server, info.ID)
+	return nil
+}
+
+// reregister registers the agent again if the server doesn't know about it anymore.
+func (a *Agent) reregister(s *RemoteJobStore, id string, err error) {
+	if err != errUnknownAgent {
+		return
+	}
+
+	a.mu.Lock()
+	current := a.id
+	a.mu.Unlock()
+
+	// another worker may have registered already
+	if current != id {
+		return
+	}
+
+	if err := a.register(s); err != nil {
+		log.Println("error registering with server:", err)
+	}
+}
+
+// agentID returns the agent's current ID.
+func (a *Agent) agentID() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.id
+}
+
+// heartbeat tells the server that the agent is still running every AgentHeartbeatInterval.
+func (a *Agent) heartbeat(s *RemoteJobStore) {
+	for range time.Tick(AgentHeartbeatInterval) {
+		id := a.agentID()
+		if err := s.doJSON("POST", "/api/agents/"+id+"/heartbeat", nil, nil); err != nil {
+			log.Println("error sending heartbeat:", err)
+			a.reregister(s, id, err)
+		}
+	}
+}
+
+// listen receives commands for the agent's jobs from the server, and passes them on to the
+// JobTracker that the jobs are running with.
+func (a *Agent) listen(s *RemoteJobStore) {
+	for {
+		id := a.agentID()
+
+		var cmds []agentCommand
+		if err := s.doJSON("GET", "/api/agents/"+id+"/commands", nil, &cmds); err != nil {
+			log.Println("error receiving commands:", err)
+			a.reregister(s, id, err)
+
+			time.Sleep(time.Second)
+			continue
+		}
+
+		for _, c := range cmds {
+			switch {
+			case c.Approval != nil:
+				if !a.Config.Tracker.Decide(c.Job.Owner, c.Job.Repo, c.Job.Number,
+					*c.Approval) {
+					log.Printf("job %s/%s #%d is not waiting for approval", c.Job.Owner,
+						c.Job.Repo, c.Job.Number)
+				}
+			case c.SupersededBy != 0:
+				a.Config.Tracker.Supersede(c.Job, c.SupersededBy, a.Config.Executor)
+			}
+		}
+	}
+}
+
+// work polls the server for jobs, and runs them one at a time.
+func (a *Agent) work(s *RemoteJobStore) {
+	for {
+		id := a.agentID()
+
+		var j *Job
+		if err := s.doJSON("GET", "/api/agents/"+id+"/poll", nil, &j); err != nil {
+			log.Println("error polling for jobs:", err)
+			a.reregister(s, id, err)
+
+			time.Sleep(time.Second)
+			continue
+		}
+
+		if j == nil {
+			continue
+		}
+
+		// a job that can't be acknowledged has been queued again for another agent
+		js := s.forJob(j)
+		if err := js.doJSON("POST", js.jobPath("ack"), nil, nil); err != nil {
+			log.Println("error acknowledging job:", err)
+			continue
+		}
+
+		log.Printf("running job %s/%s #%d", j.Owner, j.Repo, j.Number)
+
+		// agents can only make requests to the server for the jobs that they're running
+		r := a.Config.NewJobRequest(j)
+		r.Store = js
+		r.Server = js
+		r.Run()
+	}
+}